@@ -0,0 +1,187 @@
+// Package activationcodes turns the matching IDs we get from an SM-DP+
+// into eSIM activation codes, and renders them as QR codes that can be
+// printed or handed to our customer apps.
+package activationcodes
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/qrcode"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ManifestFilename is the name of the CSV manifest written with the QR codes.
+const ManifestFilename = "manifest.csv"
+
+var matchingIDSyntax = regexp.MustCompile("^[0-9A-Z-]+$")
+
+// LpaActivationCode builds an activation code on the "LPA:1$<smdp-address>$<matchingId>"
+// form described in GSMA SGP.22, section 4.1.
+func LpaActivationCode(smdpAddress string, matchingID string) (string, error) {
+	if smdpAddress == "" || strings.ContainsAny(smdpAddress, "$ /") {
+		return "", fmt.Errorf("not a valid SM-DP+ address: '%s'", smdpAddress)
+	}
+	if !matchingIDSyntax.MatchString(matchingID) {
+		return "", fmt.Errorf("not a valid matching ID: '%s'", matchingID)
+	}
+	return fmt.Sprintf("LPA:1$%s$%s", smdpAddress, matchingID), nil
+}
+
+// ExportedProfile is one line of the manifest.
+type ExportedProfile struct {
+	Iccid          string
+	Imsi           string
+	Msisdn         string
+	MatchingID     string
+	ActivationCode string
+	QrFile         string
+}
+
+// ExportActivationCodes writes a QR code PNG for each of the sim entries, and a
+// CSV manifest, either into a directory or, if the output path ends in ".zip",
+// into a zip file.  All entries must have an activation code (matching ID).
+func ExportActivationCodes(entries []model.SimEntry, smdpAddress string, outputPath string, moduleSize int) ([]ExportedProfile, error) {
+	var missing []string
+	for _, entry := range entries {
+		if entry.ActivationCode == "" {
+			missing = append(missing, entry.Iccid)
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("%d profiles have no activation code, e.g. ICCID=%s", len(missing), missing[0])
+	}
+
+	sink, err := newOutputSink(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ExportedProfile
+	for _, entry := range entries {
+		activationCode, err := LpaActivationCode(smdpAddress, entry.ActivationCode)
+		if err != nil {
+			sink.close()
+			return nil, fmt.Errorf("ICCID=%s: %v", entry.Iccid, err)
+		}
+
+		code, err := qrcode.Encode(activationCode, qrcode.Medium)
+		if err != nil {
+			sink.close()
+			return nil, fmt.Errorf("ICCID=%s: %v", entry.Iccid, err)
+		}
+
+		png := &bytes.Buffer{}
+		if err := code.WritePNG(png, moduleSize); err != nil {
+			sink.close()
+			return nil, err
+		}
+
+		qrFile := entry.Iccid + ".png"
+		if err := sink.write(qrFile, png.Bytes()); err != nil {
+			sink.close()
+			return nil, err
+		}
+
+		result = append(result, ExportedProfile{
+			Iccid:          entry.Iccid,
+			Imsi:           entry.Imsi,
+			Msisdn:         entry.Msisdn,
+			MatchingID:     entry.ActivationCode,
+			ActivationCode: activationCode,
+			QrFile:         qrFile,
+		})
+	}
+
+	manifest := &bytes.Buffer{}
+	writer := csv.NewWriter(manifest)
+	writer.Write([]string{"ICCID", "IMSI", "MSISDN", "MATCHING_ID", "ACTIVATION_CODE", "QR_FILE"})
+	for _, p := range result {
+		writer.Write([]string{p.Iccid, p.Imsi, p.Msisdn, p.MatchingID, p.ActivationCode, p.QrFile})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		sink.close()
+		return nil, err
+	}
+
+	if err := sink.write(ManifestFilename, manifest.Bytes()); err != nil {
+		sink.close()
+		return nil, err
+	}
+	return result, sink.close()
+}
+
+// outputSink abstracts over writing the exported files to a directory or a zip file.
+type outputSink interface {
+	write(name string, content []byte) error
+	close() error
+}
+
+func newOutputSink(outputPath string) (outputSink, error) {
+	if _, err := os.Stat(outputPath); err == nil {
+		if strings.HasSuffix(outputPath, ".zip") {
+			return nil, fmt.Errorf("output file already exists.  '%s'", outputPath)
+		}
+		files, err := ioutil.ReadDir(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) != 0 {
+			return nil, fmt.Errorf("output directory is not empty.  '%s'", outputPath)
+		}
+	}
+
+	if strings.HasSuffix(outputPath, ".zip") {
+		f, err := os.Create(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		return &zipSink{file: f, writer: zip.NewWriter(f)}, nil
+	}
+
+	if err := os.MkdirAll(outputPath, 0700); err != nil {
+		return nil, err
+	}
+	return &directorySink{path: outputPath}, nil
+}
+
+type directorySink struct {
+	path string
+}
+
+func (d *directorySink) write(name string, content []byte) error {
+	return ioutil.WriteFile(filepath.Join(d.path, name), content, 0600)
+}
+
+func (d *directorySink) close() error {
+	return nil
+}
+
+type zipSink struct {
+	file   *os.File
+	writer *zip.Writer
+}
+
+func (z *zipSink) write(name string, content []byte) error {
+	w, err := z.writer.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+func (z *zipSink) close() error {
+	if err := z.writer.Close(); err != nil {
+		z.file.Close()
+		return err
+	}
+	return z.file.Close()
+}
@@ -0,0 +1,70 @@
+package activationcodes
+
+import (
+	"archive/zip"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLpaActivationCode(t *testing.T) {
+	code, err := LpaActivationCode("smdp.example.com", "ABCD-1234-EFGH")
+	assert.NilError(t, err)
+	assert.Equal(t, "LPA:1$smdp.example.com$ABCD-1234-EFGH", code)
+
+	_, err = LpaActivationCode("", "ABCD")
+	assert.Assert(t, err != nil)
+
+	_, err = LpaActivationCode("smdp.example.com", "abc$d")
+	assert.Assert(t, err != nil)
+}
+
+var testEntries = []model.SimEntry{
+	{Iccid: "8947000000000012141", Imsi: "242017100011213", Msisdn: "4790000001", ActivationCode: "AAAA-BBBB-CCCC"},
+	{Iccid: "8947000000000012158", Imsi: "242017100011214", Msisdn: "4790000002", ActivationCode: "DDDD-EEEE-FFFF"},
+}
+
+func TestExportToDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "activationcodes")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	exported, err := ExportActivationCodes(testEntries, "smdp.example.com", dir, 4)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(exported))
+	assert.Equal(t, "LPA:1$smdp.example.com$DDDD-EEEE-FFFF", exported[1].ActivationCode)
+
+	for _, name := range []string{ManifestFilename, "8947000000000012141.png", "8947000000000012158.png"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.NilError(t, err)
+	}
+
+	// A second export into the same directory is refused.
+	_, err = ExportActivationCodes(testEntries, "smdp.example.com", dir, 4)
+	assert.Assert(t, err != nil)
+}
+
+func TestExportToZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "activationcodes")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	zipFile := filepath.Join(dir, "codes.zip")
+	_, err = ExportActivationCodes(testEntries, "smdp.example.com", zipFile, 4)
+	assert.NilError(t, err)
+
+	reader, err := zip.OpenReader(zipFile)
+	assert.NilError(t, err)
+	defer reader.Close()
+	assert.Equal(t, 3, len(reader.File))
+	assert.Equal(t, ManifestFilename, reader.File[2].Name)
+}
+
+func TestExportRequiresActivationCodes(t *testing.T) {
+	entries := []model.SimEntry{{Iccid: "8947000000000012141"}}
+	_, err := ExportActivationCodes(entries, "smdp.example.com", "never-created", 4)
+	assert.Assert(t, err != nil)
+}
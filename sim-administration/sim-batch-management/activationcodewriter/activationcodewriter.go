@@ -0,0 +1,285 @@
+// Package activationcodewriter writes the activation codes (matching IDs)
+// of profiles to the sim-manager's database, where they mark the profiles as
+// released and ready to be handed out.  The updates go to a target, either a
+// SQL file for an operator to run, or the database itself, and can be
+// compared with the rows in the database before they are applied.
+package activationcodewriter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Update sets the matching ID of a profile in the sim-manager.
+type Update struct {
+	Iccid      string
+	MatchingID string
+}
+
+// Row is what the sim-manager has for a profile.
+type Row struct {
+	Iccid          string
+	MatchingID     string
+	SmdpPlusState  string
+	ProvisionState string
+}
+
+// The statement the updates are made with.  Only profiles that are still
+// available in the sim-manager are updated, so that profiles that have
+// already been handed out are never touched.
+const updateStatement = "UPDATE sim_entries SET matchingid = $1, smdpplusstate = 'RELEASED', provisionstate = 'AVAILABLE' WHERE iccid = $2 AND smdpplusstate = 'AVAILABLE'"
+
+// Target is where updates are written to.
+type Target interface {
+	// Apply writes the updates, and returns the number of rows changed,
+	// or, if the target can't tell, the number of updates written.
+	Apply(ctx context.Context, updates []Update) (int64, error)
+}
+
+// RowReader is implemented by targets that can tell what the sim-manager
+// currently has for profiles.
+type RowReader interface {
+	// CurrentRows returns the rows for the ICCIDs, those not found are left out.
+	CurrentRows(ctx context.Context, iccids []string) (map[string]Row, error)
+}
+
+var iccidSyntax = regexp.MustCompile("^[0-9]{18,20}F?$")
+var matchingIDSyntax = regexp.MustCompile("^[0-9A-Za-z-]+$")
+
+// UpdatesForBatch returns the updates for the profiles of a batch that have
+// an activation code, and the ICCIDs of those that don't.  Malformed ICCIDs
+// or activation codes are refused.
+func UpdatesForBatch(entries []model.SimEntry) ([]Update, []string, error) {
+	var updates []Update
+	var withoutCode []string
+	for _, entry := range entries {
+		if !iccidSyntax.MatchString(entry.Iccid) {
+			return nil, nil, fmt.Errorf("not a valid ICCID: '%s'", entry.Iccid)
+		}
+		if entry.ActivationCode == "" {
+			withoutCode = append(withoutCode, entry.Iccid)
+			continue
+		}
+		if !matchingIDSyntax.MatchString(entry.ActivationCode) {
+			return nil, nil, fmt.Errorf("not a valid activation code for Iccid='%s': '%s'", entry.Iccid, entry.ActivationCode)
+		}
+		updates = append(updates, Update{Iccid: entry.Iccid, MatchingID: entry.ActivationCode})
+	}
+	return updates, withoutCode, nil
+}
+
+// The outcomes of updates, as seen before they are applied.
+const (
+	OutcomeUpdate    = "UPDATE"
+	OutcomeUnchanged = "UNCHANGED"
+	OutcomeConflict  = "CONFLICT"
+	OutcomeMissing   = "MISSING"
+	OutcomeUnknown   = "UNKNOWN"
+)
+
+// Change is an update, with what the sim-manager has for the profile now.
+type Change struct {
+	Update
+	Outcome string
+
+	// Current is the row as it is, nil if it isn't known.
+	Current *Row
+}
+
+// Describe describes the change as one line of a diff.
+func (change Change) Describe() string {
+	if change.Current == nil {
+		return fmt.Sprintf("%s %s: matchingid -> '%s'", change.Outcome, change.Iccid, change.MatchingID)
+	}
+	return fmt.Sprintf("%s %s: matchingid '%s' -> '%s', smdpplusstate %s, provisionstate %s",
+		change.Outcome, change.Iccid, change.Current.MatchingID, change.MatchingID, change.Current.SmdpPlusState, change.Current.ProvisionState)
+}
+
+// Diff compares the updates with the rows they would change.  If the target
+// can't tell what rows it has, all the outcomes are unknown.
+func Diff(ctx context.Context, target Target, updates []Update) ([]Change, error) {
+	var current map[string]Row
+	reader, canRead := target.(RowReader)
+	if canRead {
+		var iccids []string
+		for _, update := range updates {
+			iccids = append(iccids, update.Iccid)
+		}
+		var err error
+		if current, err = reader.CurrentRows(ctx, iccids); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := make([]Change, 0, len(updates))
+	for _, update := range updates {
+		change := Change{Update: update, Outcome: OutcomeUnknown}
+		if canRead {
+			row, found := current[update.Iccid]
+			switch {
+			case !found:
+				change.Outcome = OutcomeMissing
+			case row.MatchingID == update.MatchingID && row.SmdpPlusState == "RELEASED":
+				change.Outcome = OutcomeUnchanged
+			case row.SmdpPlusState != "AVAILABLE":
+				change.Outcome = OutcomeConflict
+			default:
+				change.Outcome = OutcomeUpdate
+			}
+			if found {
+				change.Current = &row
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Summary counts the outcomes of changes.
+func Summary(changes []Change) map[string]int {
+	summary := make(map[string]int)
+	for _, change := range changes {
+		summary[change.Outcome]++
+	}
+	return summary
+}
+
+// NotInPlace returns the ICCIDs of the changes whose activation code the
+// sim-manager doesn't have, that is, all but the unchanged ones.
+func NotInPlace(changes []Change) []string {
+	var iccids []string
+	for _, change := range changes {
+		if change.Outcome != OutcomeUnchanged {
+			iccids = append(iccids, change.Iccid)
+		}
+	}
+	return iccids
+}
+
+//
+// SQL file target
+//
+
+// SQLFileTarget writes the updates as SQL statements, in a transaction, to
+// be run with psql.  All values are quoted as literals.
+type SQLFileTarget struct {
+	Writer io.Writer
+}
+
+// QuoteLiteral quotes a string as a PostgreSQL string literal.  The escape
+// string syntax is used, so that the literal means the same whatever
+// standard_conforming_strings is set to.
+func QuoteLiteral(value string) string {
+	escaped := strings.Replace(value, `\`, `\\`, -1)
+	escaped = strings.Replace(escaped, `'`, `''`, -1)
+	return "E'" + escaped + "'"
+}
+
+// Apply writes the statements, returns the number of them.
+func (target *SQLFileTarget) Apply(ctx context.Context, updates []Update) (int64, error) {
+	if _, err := io.WriteString(target.Writer, "BEGIN;\n"); err != nil {
+		return 0, err
+	}
+	for _, update := range updates {
+		if strings.ContainsRune(update.Iccid+update.MatchingID, 0) {
+			return 0, fmt.Errorf("refusing to write a NUL character for Iccid='%s'", update.Iccid)
+		}
+		statement := strings.NewReplacer("$1", QuoteLiteral(update.MatchingID), "$2", QuoteLiteral(update.Iccid)).Replace(updateStatement)
+		if _, err := io.WriteString(target.Writer, statement+";\n"); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.WriteString(target.Writer, "COMMIT;\n"); err != nil {
+		return 0, err
+	}
+	return int64(len(updates)), nil
+}
+
+//
+// Database target
+//
+
+// DatabaseTarget writes the updates directly to the sim-manager database,
+// with parameterized statements, in a single transaction.
+type DatabaseTarget struct {
+	DB *sql.DB
+}
+
+// The max number of ICCIDs asked for in one query.
+const queryChunkSize = 500
+
+// CurrentRows gets the rows for the ICCIDs from the database.
+func (target *DatabaseTarget) CurrentRows(ctx context.Context, iccids []string) (map[string]Row, error) {
+	rows := make(map[string]Row)
+	for start := 0; start < len(iccids); start += queryChunkSize {
+		end := start + queryChunkSize
+		if end > len(iccids) {
+			end = len(iccids)
+		}
+
+		var placeholders []string
+		var args []interface{}
+		for i, iccid := range iccids[start:end] {
+			placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+			args = append(args, iccid)
+		}
+		query := "SELECT iccid, COALESCE(matchingid, ''), smdpplusstate, provisionstate FROM sim_entries WHERE iccid IN (" + strings.Join(placeholders, ", ") + ")"
+		result, err := target.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for result.Next() {
+			var row Row
+			if err := result.Scan(&row.Iccid, &row.MatchingID, &row.SmdpPlusState, &row.ProvisionState); err != nil {
+				result.Close()
+				return nil, err
+			}
+			rows[row.Iccid] = row
+		}
+		err = result.Err()
+		result.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// Apply runs the updates in a transaction, returns the number of rows changed.
+// Nothing is changed if any of them fails.
+func (target *DatabaseTarget) Apply(ctx context.Context, updates []Update) (int64, error) {
+	tx, err := target.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	statement, err := tx.PrepareContext(ctx, updateStatement)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer statement.Close()
+
+	var changed int64
+	for _, update := range updates {
+		result, err := statement.ExecContext(ctx, update.MatchingID, update.Iccid)
+		if err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("couldn't update Iccid='%s': %s", update.Iccid, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		changed += affected
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return changed, nil
+}
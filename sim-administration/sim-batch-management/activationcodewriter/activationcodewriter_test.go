@@ -0,0 +1,97 @@
+package activationcodewriter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newSimManagerDB creates a stand-in for the sim-manager database, in memory.
+func newSimManagerDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NilError(t, err)
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE sim_entries (iccid TEXT, matchingid TEXT, smdpplusstate TEXT, provisionstate TEXT);
+		INSERT INTO sim_entries VALUES
+		  ('8947000000000012140', NULL, 'AVAILABLE', 'AVAILABLE'),
+		  ('8947000000000012157', 'AAAA-2', 'RELEASED', 'AVAILABLE'),
+		  ('8947000000000012165', 'OLD-3', 'DOWNLOADED', 'PROVISIONED');`)
+	assert.NilError(t, err)
+	return db
+}
+
+func testUpdates() []Update {
+	return []Update{
+		{Iccid: "8947000000000012140", MatchingID: "AAAA-1"},
+		{Iccid: "8947000000000012157", MatchingID: "AAAA-2"},
+		{Iccid: "8947000000000012165", MatchingID: "AAAA-3"},
+		{Iccid: "8947000000000012173", MatchingID: "AAAA-4"},
+	}
+}
+
+func TestUpdatesForBatch(t *testing.T) {
+	updates, withoutCode, err := UpdatesForBatch([]model.SimEntry{
+		{Iccid: "8947000000000012140", ActivationCode: "AAAA-1"},
+		{Iccid: "8947000000000012157"},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []Update{{Iccid: "8947000000000012140", MatchingID: "AAAA-1"}}, updates)
+	assert.DeepEqual(t, []string{"8947000000000012157"}, withoutCode)
+
+	_, _, err = UpdatesForBatch([]model.SimEntry{{Iccid: "8947000000000012140", ActivationCode: "x'; DROP TABLE sim_entries; --"}})
+	assert.ErrorContains(t, err, "not a valid activation code")
+	_, _, err = UpdatesForBatch([]model.SimEntry{{Iccid: "89470' OR 1=1"}})
+	assert.ErrorContains(t, err, "not a valid ICCID")
+}
+
+func TestSQLFileTargetQuotes(t *testing.T) {
+	assert.Equal(t, `E'it''s a \\ test'`, QuoteLiteral(`it's a \ test`))
+
+	var buffer bytes.Buffer
+	target := &SQLFileTarget{Writer: &buffer}
+	written, err := target.Apply(context.Background(), []Update{{Iccid: "8947000000000012140", MatchingID: "O'Brien"}})
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1), written)
+	assert.Equal(t, "BEGIN;\n"+
+		"UPDATE sim_entries SET matchingid = E'O''Brien', smdpplusstate = 'RELEASED', provisionstate = 'AVAILABLE' WHERE iccid = E'8947000000000012140' AND smdpplusstate = 'AVAILABLE';\n"+
+		"COMMIT;\n", buffer.String())
+
+	changes, err := Diff(context.Background(), target, testUpdates())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]int{OutcomeUnknown: 4}, Summary(changes))
+}
+
+func TestDatabaseTargetDiffAndApply(t *testing.T) {
+	db := newSimManagerDB(t)
+	defer db.Close()
+	target := &DatabaseTarget{DB: db}
+
+	changes, err := Diff(context.Background(), target, testUpdates())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{OutcomeUpdate, OutcomeUnchanged, OutcomeConflict, OutcomeMissing},
+		[]string{changes[0].Outcome, changes[1].Outcome, changes[2].Outcome, changes[3].Outcome})
+	assert.Equal(t, "CONFLICT 8947000000000012165: matchingid 'OLD-3' -> 'AAAA-3', smdpplusstate DOWNLOADED, provisionstate PROVISIONED", changes[2].Describe())
+	assert.Equal(t, "MISSING 8947000000000012173: matchingid -> 'AAAA-4'", changes[3].Describe())
+
+	changed, err := target.Apply(context.Background(), testUpdates())
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1), changed)
+
+	rows, err := target.CurrentRows(context.Background(), []string{"8947000000000012140", "8947000000000012165"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, Row{Iccid: "8947000000000012140", MatchingID: "AAAA-1", SmdpPlusState: "RELEASED", ProvisionState: "AVAILABLE"}, rows["8947000000000012140"])
+	assert.Equal(t, "OLD-3", rows["8947000000000012165"].MatchingID)
+
+	changes, err = Diff(context.Background(), target, testUpdates()[:2])
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]int{OutcomeUnchanged: 2}, Summary(changes))
+
+	changes, err = Diff(context.Background(), target, testUpdates())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"8947000000000012165", "8947000000000012173"}, NotInPlace(changes))
+}
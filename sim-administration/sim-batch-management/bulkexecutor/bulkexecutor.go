@@ -0,0 +1,135 @@
+// Package bulkexecutor runs an ES2+ operation for each ICCID in a (potentially
+// very large) set of ICCIDs, using a fixed number of workers so that the
+// number of connections to the SM-DP+ stays bounded and the connections
+// are reused from one operation to the next.
+package bulkexecutor
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Operation is the work done for a single ICCID.  The value returned is
+// handed back in the Result for that ICCID.
+type Operation func(ctx context.Context, iccid string) (interface{}, error)
+
+// Result is the outcome of running the operation for a single ICCID.
+type Result struct {
+	Iccid string
+	Value interface{}
+	Err   error
+}
+
+// Summary of a bulk run.  NotAttempted holds the ICCIDs that were never
+// handed to a worker because the context was cancelled or the run was
+// stopped first, and those whose operation stopped the run.  Stopped is the
+// error that stopped the run, if any.
+type Summary struct {
+	Succeeded    int
+	Failed       []Result
+	NotAttempted []string
+	Stopped      error
+}
+
+type stopError struct {
+	err error
+}
+
+func (e *stopError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stopError) Unwrap() error {
+	return e.err
+}
+
+// Stop wraps an error returned by an operation that did nothing for its ICCID,
+// and found that the run can't continue, e.g. because the SM-DP+ has stopped
+// accepting requests.  No new operations are started, and the ICCID is
+// reported as not attempted rather than failed.
+func Stop(err error) error {
+	return &stopError{err: err}
+}
+
+// Run applies the operation to all the ICCIDs using the given number of
+// workers.  The onResult function is called once for each attempted ICCID, as
+// results arrive, never concurrently, so it can safely print or write to
+// the database.  Cancelling the context, or an operation returning an error
+// made by Stop, stops new operations from being started; operations already
+// in flight are left to finish.
+func Run(ctx context.Context, workers int, iccids []string, operation Operation, onResult func(Result)) Summary {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// Operations in flight keep the caller's context, only the dispatching
+	// of new work is stopped by Stop.
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
+	defer stopDispatch()
+
+	work := make(chan string)
+	results := make(chan Result)
+
+	var waitgroup sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitgroup.Add(1)
+		go func() {
+			defer waitgroup.Done()
+			for iccid := range work {
+				value, err := operation(ctx, iccid)
+				results <- Result{Iccid: iccid, Value: value, Err: err}
+			}
+		}()
+	}
+
+	notAttempted := make(chan []string, 1)
+	go func() {
+		defer close(work)
+		for i, iccid := range iccids {
+			select {
+			case <-dispatchCtx.Done():
+				notAttempted <- iccids[i:]
+				return
+			default:
+			}
+			select {
+			case work <- iccid:
+			case <-dispatchCtx.Done():
+				notAttempted <- iccids[i:]
+				return
+			}
+		}
+		notAttempted <- nil
+	}()
+
+	go func() {
+		waitgroup.Wait()
+		close(results)
+	}()
+
+	summary := Summary{}
+	var stopped []string
+	for result := range results {
+		var stop *stopError
+		if errors.As(result.Err, &stop) {
+			if summary.Stopped == nil {
+				summary.Stopped = stop.err
+				stopDispatch()
+			}
+			stopped = append(stopped, result.Iccid)
+			continue
+		}
+
+		if result.Err != nil {
+			summary.Failed = append(summary.Failed, result)
+		} else {
+			summary.Succeeded++
+		}
+		if onResult != nil {
+			onResult(result)
+		}
+	}
+	summary.NotAttempted = append(stopped, <-notAttempted...)
+	return summary
+}
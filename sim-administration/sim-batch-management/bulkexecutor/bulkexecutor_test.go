@@ -0,0 +1,83 @@
+package bulkexecutor
+
+import (
+	"context"
+	"fmt"
+	"gotest.tools/assert"
+	"sync/atomic"
+	"testing"
+)
+
+func iccids(n int) []string {
+	var result []string
+	for i := 0; i < n; i++ {
+		result = append(result, fmt.Sprintf("89470000000000%05d", i))
+	}
+	return result
+}
+
+func TestRunBoundsConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	operation := func(ctx context.Context, iccid string) (interface{}, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		defer atomic.AddInt32(&inFlight, -1)
+		if iccid == "8947000000000000007" {
+			return nil, fmt.Errorf("boom")
+		}
+		return iccid + "-done", nil
+	}
+
+	seen := 0
+	summary := Run(context.Background(), 4, iccids(100), operation, func(result Result) {
+		seen++
+		if result.Err == nil {
+			assert.Equal(t, result.Iccid+"-done", result.Value)
+		}
+	})
+
+	assert.Equal(t, 100, seen)
+	assert.Equal(t, 99, summary.Succeeded)
+	assert.Equal(t, 1, len(summary.Failed))
+	assert.Equal(t, "8947000000000000007", summary.Failed[0].Iccid)
+	assert.Equal(t, 0, len(summary.NotAttempted))
+	assert.Assert(t, maxInFlight <= 4)
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	operation := func(ctx context.Context, iccid string) (interface{}, error) {
+		if iccid == "8947000000000000009" {
+			cancel()
+		}
+		return nil, nil
+	}
+
+	summary := Run(ctx, 1, iccids(100), operation, nil)
+	assert.Assert(t, summary.Succeeded >= 10)
+	assert.Equal(t, 100, summary.Succeeded+len(summary.NotAttempted))
+	assert.Assert(t, len(summary.NotAttempted) > 0)
+}
+
+func TestStopReportsRemainingIccidsAsNotAttempted(t *testing.T) {
+	operation := func(ctx context.Context, iccid string) (interface{}, error) {
+		if iccid >= "8947000000000000020" {
+			return nil, Stop(fmt.Errorf("breaker open"))
+		}
+		return nil, nil
+	}
+
+	summary := Run(context.Background(), 1, iccids(100), operation, func(result Result) {
+		assert.NilError(t, result.Err)
+	})
+	assert.Equal(t, 20, summary.Succeeded)
+	assert.Equal(t, 0, len(summary.Failed))
+	assert.Equal(t, 80, len(summary.NotAttempted))
+	assert.Equal(t, "8947000000000000020", summary.NotAttempted[0])
+	assert.ErrorContains(t, summary.Stopped, "breaker open")
+}
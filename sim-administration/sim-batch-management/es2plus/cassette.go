@@ -0,0 +1,247 @@
+package es2plus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Interaction is a recorded ES2+ request/response pair.  Cassette files
+// hold one interaction per line, as JSON, in the order they happened.  If
+// no response came back, the error is recorded instead.
+type Interaction struct {
+	Es2Function    string      `json:"es2Function"`
+	Iccids         string      `json:"iccids"`
+	Request        string      `json:"request"`
+	StatusCode     int         `json:"statusCode"`
+	ResponseHeader http.Header `json:"responseHeader"`
+	Response       string      `json:"response"`
+	Error          string      `json:"error,omitempty"`
+}
+
+// interactionKey finds the ES2+ function and the ICCIDs of a request.  The
+// function call identifiers in the headers are random, so they are not part
+// of the key.
+func interactionKey(request *http.Request, body []byte) (string, string) {
+	var payload struct {
+		Iccid     string  `json:"iccid"`
+		IccidList []ICCID `json:"iccidList"`
+	}
+	json.Unmarshal(body, &payload)
+
+	iccids := []string{}
+	if payload.Iccid != "" {
+		iccids = append(iccids, payload.Iccid)
+	}
+	for _, iccid := range payload.IccidList {
+		iccids = append(iccids, iccid.Iccid)
+	}
+	return path.Base(request.URL.Path), strings.Join(iccids, ",")
+}
+
+func readRequestBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Recorder is an http.RoundTripper that passes requests on to another
+// round tripper, and appends every exchange to a cassette file.
+type Recorder struct {
+	transport    http.RoundTripper
+	cassettePath string
+	redact       bool
+	dialect      Dialect
+	mutex        sync.Mutex
+}
+
+// NewRecorder returns a recorder wrapping the transport and appending to the
+// cassette file.  If redact is set, secrets are redacted from the recorded
+// responses, so that the cassette can be kept with the tests.  The exchanges
+// are recorded as they went over the wire, so the dialect spoken is needed
+// to know the vendor's names for the secrets.
+func NewRecorder(transport http.RoundTripper, cassettePath string, redact bool, dialect Dialect) *Recorder {
+	return &Recorder{transport: transport, cassettePath: cassettePath, redact: redact, dialect: dialect}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (recorder *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	requestBody, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	function, iccids := interactionKey(request, requestBody)
+	response, err := recorder.transport.RoundTrip(request)
+	if err != nil {
+		interaction := Interaction{Es2Function: function, Iccids: iccids, Request: string(requestBody), Error: err.Error()}
+		if recorder.redact {
+			interaction.Request = recorder.dialect.Redact(requestBody)
+		}
+		if recordErr := recorder.append(interaction); recordErr != nil {
+			return nil, fmt.Errorf("couldn't record %s exchange in '%s': %s, after: %s", function, recorder.cassettePath, recordErr, err)
+		}
+		return nil, err
+	}
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+
+	interaction := Interaction{
+		Es2Function:    function,
+		Iccids:         iccids,
+		Request:        string(requestBody),
+		StatusCode:     response.StatusCode,
+		ResponseHeader: response.Header,
+		Response:       string(responseBody),
+	}
+	if recorder.redact {
+		interaction.Request = recorder.dialect.Redact(requestBody)
+		interaction.Response = recorder.dialect.Redact(responseBody)
+	}
+
+	if err := recorder.append(interaction); err != nil {
+		return nil, fmt.Errorf("couldn't record %s exchange in '%s': %s", function, recorder.cassettePath, err)
+	}
+	return response, nil
+}
+
+func (recorder *Recorder) append(interaction Interaction) error {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	file, err := os.OpenFile(recorder.cassettePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Replayer is an http.RoundTripper that answers requests from a cassette
+// instead of talking to an SM-DP+.  A request is answered by the first
+// interaction not yet replayed with the same ES2+ function and ICCIDs, so
+// repeated requests, e.g. status polls, get the recorded answers in order.
+type Replayer struct {
+	interactions []Interaction
+	replayed     []bool
+	mutex        sync.Mutex
+}
+
+// NewReplayer reads a cassette file and returns a replayer for it.
+func NewReplayer(cassettePath string) (*Replayer, error) {
+	file, err := os.Open(cassettePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var interactions []Interaction
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal([]byte(line), &interaction); err != nil {
+			return nil, fmt.Errorf("cassette '%s', line %d: %s", cassettePath, lineNo, err)
+		}
+		interactions = append(interactions, interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Replayer{interactions: interactions, replayed: make([]bool, len(interactions))}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (replayer *Replayer) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	function, iccids := interactionKey(request, body)
+
+	replayer.mutex.Lock()
+	defer replayer.mutex.Unlock()
+
+	for i, interaction := range replayer.interactions {
+		if replayer.replayed[i] || interaction.Es2Function != function || interaction.Iccids != iccids {
+			continue
+		}
+		replayer.replayed[i] = true
+		if interaction.Error != "" {
+			return nil, &replayedError{message: interaction.Error}
+		}
+
+		header := interaction.ResponseHeader
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.StatusCode, http.StatusText(interaction.StatusCode)),
+			StatusCode:    interaction.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(strings.NewReader(interaction.Response)),
+			ContentLength: int64(len(interaction.Response)),
+			Request:       request,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded %s interaction left for ICCIDs '%s'", function, iccids)
+}
+
+// replayedError is the error a recorded request got instead of a response.
+type replayedError struct {
+	message string
+}
+
+func (e *replayedError) Error() string {
+	return e.message
+}
+
+// Unreplayed returns the number of interactions in the cassette that have
+// not been replayed yet.
+func (replayer *Replayer) Unreplayed() int {
+	replayer.mutex.Lock()
+	defer replayer.mutex.Unlock()
+
+	n := 0
+	for _, replayed := range replayer.replayed {
+		if !replayed {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,131 @@
+package es2plus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newReplayingClient(t *testing.T, cassettePath string) (*ClientState, *Replayer) {
+	replayer, err := NewReplayer(cassettePath)
+	assert.NilError(t, err)
+
+	client, err := NewClientWithConfig(ClientConfig{
+		Hostport:      "smdp.example.com:4711",
+		RequesterID:   "1.2.3",
+		WrapTransport: func(http.RoundTripper) http.RoundTripper { return replayer },
+		Replaying:     true,
+	})
+	assert.NilError(t, err)
+	return client, replayer
+}
+
+func TestActivateIccidFromAvailable(t *testing.T) {
+	client, replayer := newReplayingClient(t, "testdata/activate_available.cassette")
+
+	status, err := client.ActivateIccid(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "RELEASED", status.State)
+	assert.Equal(t, "ABCD-1234-EFGH-5678", status.ACToken)
+	assert.Equal(t, "2020-01-20T10:00:02Z", status.StatusLastUpdateTimestamp)
+
+	// AVAILABLE -> downloadOrder -> ALLOCATED -> confirmOrder -> RELEASED
+	assert.Equal(t, 0, replayer.Unreplayed())
+}
+
+func TestActivateIccidAlreadyReleased(t *testing.T) {
+	client, replayer := newReplayingClient(t, "testdata/activate_released.cassette")
+
+	status, err := client.ActivateIccid(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "ABCD-1234-EFGH-5678", status.ACToken)
+
+	// No downloadOrder or confirmOrder is replayed, so none was sent.
+	assert.Equal(t, 0, replayer.Unreplayed())
+}
+
+func TestReplayFailsForUnrecordedRequests(t *testing.T) {
+	client, _ := newReplayingClient(t, "testdata/activate_released.cassette")
+
+	_, err := client.GetStatus(context.Background(), "8947000000000012158")
+	assert.ErrorContains(t, err, "no recorded getProfileStatus interaction left")
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request GetProfileStatusRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		response := es2ProfileStatusResponse{}
+		response.ProfileStatusList = []ProfileStatus{{Iccid: request.IccidList[0].Iccid, State: "RELEASED", ACToken: "SECRET"}}
+		w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.0.0")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	cassettePath := filepath.Join(dir, "recorded.cassette")
+
+	recordingClient := newTestClient(server)
+	recordingClient.httpClient.Transport = NewRecorder(recordingClient.httpClient.Transport, cassettePath, true, Dialect{})
+
+	for _, iccid := range []string{"8947000000000012141", "8947000000000012158"} {
+		_, err := recordingClient.GetStatus(context.Background(), iccid)
+		assert.NilError(t, err)
+	}
+
+	// Replay in the opposite order: matching is on function and ICCID, not on
+	// order or on the function call identifiers in the headers.
+	client, replayer := newReplayingClient(t, cassettePath)
+	for _, iccid := range []string{"8947000000000012158", "8947000000000012141"} {
+		status, err := client.GetStatus(context.Background(), iccid)
+		assert.NilError(t, err)
+		assert.Equal(t, iccid, status.Iccid)
+		assert.Equal(t, RedactedValue, status.ACToken)
+	}
+	assert.Equal(t, 0, replayer.Unreplayed())
+}
+
+func TestTransportErrorsAreRecordedAndReplayed(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	cassettePath := filepath.Join(dir, "recorded.cassette")
+
+	recordingClient := newTestClient(server)
+	recordingClient.httpClient.Transport = NewRecorder(recordingClient.httpClient.Transport, cassettePath, true, Dialect{})
+	_, err = recordingClient.GetStatus(context.Background(), "8947000000000012141")
+	var recorded *transportError
+	assert.Assert(t, errors.As(err, &recorded))
+
+	client, replayer := newReplayingClient(t, cassettePath)
+	_, err = client.GetStatus(context.Background(), "8947000000000012141")
+	var replayed *transportError
+	assert.Assert(t, errors.As(err, &replayed))
+	assert.ErrorContains(t, err, "EOF")
+	assert.Equal(t, 0, replayer.Unreplayed())
+}
+
+func TestOnlyReplayingClientsCanDoWithoutCertificate(t *testing.T) {
+	_, err := NewClientWithConfig(ClientConfig{Hostport: "smdp.example.com:4711"})
+	assert.ErrorContains(t, err, "certificate")
+
+	_, err = NewClientWithConfig(ClientConfig{Hostport: "smdp.example.com:4711", Replaying: true})
+	assert.NilError(t, err)
+
+	_, err = NewClientWithConfig(ClientConfig{Hostport: "smdp.example.com:4711", CertFilePath: "testdata/client.crt", KeyFilePath: "testdata/client.key"})
+	assert.NilError(t, err)
+}
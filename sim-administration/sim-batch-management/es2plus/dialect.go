@@ -0,0 +1,144 @@
+package es2plus
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Defaults for the parts of the ES2+ protocol that differ between SM-DP+ vendors.
+const (
+	DefaultProtocolVersion = "2.0.0"
+	DefaultBasePath        = "/gsma/rsp2/es2plus"
+)
+
+var protocolVersionSyntax = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// Dialect describes the version of the ES2+ protocol a vendor's SM-DP+ speaks,
+// where it lives, and the field names it uses where these differ from the
+// ones used by this client (the json tags of the request and response types).
+type Dialect struct {
+	ProtocolVersion string
+	BasePath        string
+
+	// FieldNames maps our field names to the vendor's.
+	FieldNames map[string]string
+}
+
+// WithDefaults returns a copy of the dialect where unset values are replaced by their defaults.
+func (dialect Dialect) WithDefaults() Dialect {
+	if dialect.ProtocolVersion == "" {
+		dialect.ProtocolVersion = DefaultProtocolVersion
+	}
+	if dialect.BasePath == "" {
+		dialect.BasePath = DefaultBasePath
+	}
+	dialect.BasePath = "/" + strings.Trim(dialect.BasePath, "/")
+	return dialect
+}
+
+// Validate checks that the protocol version and base path are well formed.
+func (dialect Dialect) Validate() error {
+	if dialect.ProtocolVersion != "" && !protocolVersionSyntax.MatchString(dialect.ProtocolVersion) {
+		return fmt.Errorf("not a valid ES2+ protocol version (should be like '2.1.0'): '%s'", dialect.ProtocolVersion)
+	}
+	if dialect.BasePath != "" && !strings.HasPrefix(dialect.BasePath, "/") {
+		return fmt.Errorf("ES2+ base path must start with '/': '%s'", dialect.BasePath)
+	}
+	return nil
+}
+
+// AdminProtocolHeader is the value of the X-Admin-Protocol header for the dialect.
+func (dialect Dialect) AdminProtocolHeader() string {
+	return "gsma/rsp/v" + dialect.ProtocolVersion
+}
+
+// checkAdminProtocolHeader verifies that the X-Admin-Protocol header of a
+// response, if there is one, is for the same major version as the one we sent.
+func (dialect Dialect) checkAdminProtocolHeader(header string) error {
+	if header == "" {
+		return nil
+	}
+	major := strings.SplitN(dialect.ProtocolVersion, ".", 2)[0]
+	if !strings.HasPrefix(header, "gsma/rsp/v"+major+".") {
+		return fmt.Errorf("SM-DP+ answered with X-Admin-Protocol '%s', expected '%s'", header, dialect.AdminProtocolHeader())
+	}
+	return nil
+}
+
+// ParseFieldNames parses field name variants on the form
+// "ourName=theirName,ourName2=theirName2".
+func ParseFieldNames(variants string) (map[string]string, error) {
+	fieldNames := make(map[string]string)
+	for _, variant := range strings.Split(variants, ",") {
+		variant = strings.TrimSpace(variant)
+		if variant == "" {
+			continue
+		}
+		parts := strings.Split(variant, "=")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("not a valid field name variant (should be like 'ourName=theirName'): '%s'", variant)
+		}
+		fieldNames[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return fieldNames, nil
+}
+
+// FormatFieldNames formats field name variants the way ParseFieldNames parses them.
+func FormatFieldNames(fieldNames map[string]string) string {
+	var variants []string
+	for ours, theirs := range fieldNames {
+		variants = append(variants, ours+"="+theirs)
+	}
+	sort.Strings(variants)
+	return strings.Join(variants, ",")
+}
+
+// toVendor renames the fields of a JSON request to the vendor's names.
+func (dialect Dialect) toVendor(payload []byte) ([]byte, error) {
+	return renameFields(payload, dialect.FieldNames)
+}
+
+// fromVendor renames the fields of a JSON response from the vendor's names to ours.
+func (dialect Dialect) fromVendor(payload []byte) ([]byte, error) {
+	if len(dialect.FieldNames) == 0 {
+		return payload, nil
+	}
+	reversed := make(map[string]string)
+	for ours, theirs := range dialect.FieldNames {
+		reversed[theirs] = ours
+	}
+	return renameFields(payload, reversed)
+}
+
+func renameFields(payload []byte, names map[string]string) ([]byte, error) {
+	if len(names) == 0 {
+		return payload, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(renameKeys(value, names))
+}
+
+func renameKeys(value interface{}, names map[string]string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			if newKey, found := names[key]; found {
+				key = newKey
+			}
+			renamed[key] = renameKeys(field, names)
+		}
+		return renamed
+	case []interface{}:
+		for i, element := range v {
+			v[i] = renameKeys(element, names)
+		}
+	}
+	return value
+}
@@ -0,0 +1,103 @@
+package es2plus
+
+import (
+	"context"
+	"encoding/json"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAndFormatFieldNames(t *testing.T) {
+	fieldNames, err := ParseFieldNames(" status_last_update_timestamp=statusLastUpdateTimestamp, iccidList=iccids ")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]string{"status_last_update_timestamp": "statusLastUpdateTimestamp", "iccidList": "iccids"}, fieldNames)
+	assert.Equal(t, "iccidList=iccids,status_last_update_timestamp=statusLastUpdateTimestamp", FormatFieldNames(fieldNames))
+
+	_, err = ParseFieldNames("iccidList")
+	assert.Assert(t, err != nil)
+}
+
+func TestValidateDialect(t *testing.T) {
+	assert.NilError(t, Dialect{ProtocolVersion: "2.2.0", BasePath: "/es2plus"}.Validate())
+	assert.Assert(t, Dialect{ProtocolVersion: "v2.2"}.Validate() != nil)
+	assert.Assert(t, Dialect{BasePath: "es2plus"}.Validate() != nil)
+}
+
+func TestClientSpeaksVendorDialect(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/vendor/es2/getProfileStatus", r.URL.Path)
+		assert.Equal(t, "gsma/rsp/v2.2.0", r.Header.Get("X-Admin-Protocol"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Assert(t, strings.Contains(string(body), `"iccids":[`))
+
+		w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.2.1")
+		w.Write([]byte(`{"header":{"functionExecutionStatus":{"status":"Executed-Success"}},
+		                 "profileStatusList":[{"statusLastUpdateTimestamp":"2020-01-20T10:00:02Z","state":"RELEASED","iccid":"8947000000000012141"}]}`))
+	}))
+	defer server.Close()
+
+	client := newTestClient(server)
+	client.dialect = Dialect{
+		ProtocolVersion: "2.2.0",
+		BasePath:        "/vendor/es2/",
+		FieldNames: map[string]string{
+			"status_last_update_timestamp": "statusLastUpdateTimestamp",
+			"iccidList":                    "iccids",
+		},
+	}.WithDefaults()
+
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "2020-01-20T10:00:02Z", status.StatusLastUpdateTimestamp)
+	assert.Equal(t, "RELEASED", status.State)
+}
+
+func TestMismatchingProtocolVersionIsAnError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Admin-Protocol", "gsma/rsp/v3.0.0")
+		json.NewEncoder(w).Encode(es2ProfileStatusResponse{})
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(server).GetStatus(context.Background(), "8947000000000012141")
+	assert.ErrorContains(t, err, "X-Admin-Protocol 'gsma/rsp/v3.0.0'")
+}
+
+func TestSecretsAreRedactedUnderTheVendorsNames(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Admin-Protocol", "gsma/rsp/v2.0.0")
+		w.Write([]byte(`{"header":{"functionExecutionStatus":{"status":"Executed-Success"}},
+		                 "profileStatusList":[{"state":"RELEASED","iccid":"8947000000000012141","activation_token":"SECRET-MATCHING-ID"}]}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dialect")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	cassettePath := filepath.Join(dir, "recorded.cassette")
+
+	journal := &memoryJournal{}
+	client := newTestClient(server)
+	client.journal = journal
+	client.dialect = Dialect{FieldNames: map[string]string{"acToken": "activation_token"}}.WithDefaults()
+	client.httpClient.Transport = NewRecorder(client.httpClient.Transport, cassettePath, true, client.dialect)
+
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "SECRET-MATCHING-ID", status.ACToken)
+
+	assert.Equal(t, 1, len(journal.entries))
+	assert.Assert(t, !strings.Contains(journal.entries[0].Response, "SECRET-MATCHING-ID"))
+	assert.Assert(t, strings.Contains(journal.entries[0].Response, `"activation_token":"REDACTED"`))
+
+	recorded, err := ioutil.ReadFile(cassettePath)
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(string(recorded), "SECRET-MATCHING-ID"))
+}
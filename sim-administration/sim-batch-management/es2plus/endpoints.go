@@ -0,0 +1,193 @@
+package es2plus
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEndpointCooldown is how long an endpoint is avoided after a transport error.
+const DefaultEndpointCooldown = 30 * time.Second
+
+// endpoint is one of the SM-DP+ endpoints of a vendor, e.g. the primary or the
+// disaster recovery site.
+type endpoint struct {
+	hostport       string
+	unhealthyUntil time.Time
+}
+
+// endpointSet keeps track of the health of a vendor's endpoints, and of
+// which endpoint was last used for each ICCID, so that all the state changes
+// of a profile go through the same endpoint as long as it is healthy.
+type endpointSet struct {
+	mutex     sync.Mutex
+	endpoints []*endpoint
+	sticky    map[string]*endpoint
+	cooldown  time.Duration
+}
+
+func newEndpointSet(hostports []string, cooldown time.Duration) *endpointSet {
+	set := &endpointSet{sticky: make(map[string]*endpoint), cooldown: cooldown}
+	for _, hostport := range hostports {
+		set.endpoints = append(set.endpoints, &endpoint{hostport: hostport})
+	}
+	return set
+}
+
+// candidates returns the endpoints to try for a request about some ICCIDs, in
+// order: the healthy endpoints, those most of the ICCIDs are sticky to first
+// and otherwise in the configured order, and finally the unhealthy ones, as
+// a last resort.
+func (set *endpointSet) candidates(iccids []string) []*endpoint {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	stickyCounts := make(map[*endpoint]int)
+	for _, iccid := range iccids {
+		if e, found := set.sticky[iccid]; found {
+			stickyCounts[e]++
+		}
+	}
+	ordered := append([]*endpoint{}, set.endpoints...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return stickyCounts[ordered[i]] > stickyCounts[ordered[j]]
+	})
+
+	now := time.Now()
+	var healthy, unhealthy []*endpoint
+	for _, e := range ordered {
+		if now.After(e.unhealthyUntil) {
+			healthy = append(healthy, e)
+		} else {
+			unhealthy = append(unhealthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (set *endpointSet) markFailed(e *endpoint) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	e.unhealthyUntil = time.Now().Add(set.cooldown)
+}
+
+func (set *endpointSet) markSucceeded(e *endpoint, iccids []string) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	e.unhealthyUntil = time.Time{}
+	for _, iccid := range iccids {
+		set.sticky[iccid] = e
+	}
+}
+
+func (set *endpointSet) stickyEndpoint(iccid string) string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if e, found := set.sticky[iccid]; found {
+		return e.hostport
+	}
+	return ""
+}
+
+// transportError is returned when a request didn't get an HTTP response
+// from an endpoint.
+type transportError struct {
+	endpoint string
+	err      error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// canFailOver decides if a request that failed with a transport error can
+// be sent to another endpoint.  Only status queries can, since they change
+// nothing.  The state changing functions are left to the retry policy, which
+// checks the state of the profile before sending them again, so that the
+// state of a profile is never changed through two sites at once.
+func canFailOver(es2plusCommand string) bool {
+	return es2plusCommand == "getProfileStatus"
+}
+
+func splitIccids(iccids string) []string {
+	if iccids == "" {
+		return nil
+	}
+	return strings.Split(iccids, ",")
+}
+
+// EndpointHealth is the outcome of a health check of a single endpoint.
+type EndpointHealth struct {
+	Endpoint string
+	Healthy  bool
+	Latency  time.Duration
+	Err      error
+}
+
+// errReplaying is the outcome of health checks of a client that replays
+// recorded exchanges, which never connects to the endpoints.
+var errReplaying = errors.New("not checked, the ES2+ exchanges are replayed from a cassette")
+
+// CheckEndpoints checks that a TLS connection can be made to each of the
+// client's endpoints, and marks the ones that fail as unhealthy.
+func (client *ClientState) CheckEndpoints(ctx context.Context) []EndpointHealth {
+	var result []EndpointHealth
+	for _, e := range client.endpoints.endpoints {
+		if client.replaying {
+			result = append(result, EndpointHealth{Endpoint: e.hostport, Err: errReplaying})
+			continue
+		}
+		start := time.Now()
+		err := client.checkEndpoint(ctx, e.hostport)
+		health := EndpointHealth{Endpoint: e.hostport, Healthy: err == nil, Latency: time.Since(start), Err: err}
+		if err != nil {
+			client.endpoints.markFailed(e)
+		}
+		result = append(result, health)
+	}
+	return result
+}
+
+func (client *ClientState) checkEndpoint(ctx context.Context, hostport string) error {
+	ctx, cancel := context.WithTimeout(ctx, client.tlsHandshakeTimeout)
+	defer cancel()
+
+	dial := client.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", hostport)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tlsConfig := &tls.Config{}
+	if client.tlsConfig != nil {
+		tlsConfig = client.tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(hostport)
+		tlsConfig.ServerName = host
+	}
+	return tls.Client(conn, tlsConfig).Handshake()
+}
+
+// Endpoint returns the endpoint (host:port) last used successfully for
+// requests about the ICCID, or an empty string if there has been none.
+func (client *ClientState) Endpoint(iccid string) string {
+	return client.endpoints.stickyEndpoint(iccid)
+}
@@ -0,0 +1,203 @@
+package es2plus
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/outboundproxy"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/outboundproxy/proxytest"
+	"gotest.tools/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func hostport(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+func newStatusServer(state string) *httptest.Server {
+	return httptest.NewTLSServer(statusHandler(state))
+}
+
+// statusHandler answers getProfileStatus requests with the given state for all ICCIDs.
+func statusHandler(state string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request GetProfileStatusRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Executed-Success"
+		for _, iccid := range request.IccidList {
+			response.ProfileStatusList = append(response.ProfileStatusList, ProfileStatus{Iccid: iccid.Iccid, State: state})
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// newFailoverClient returns a client with the endpoints in the given order.
+func newFailoverClient(servers ...*httptest.Server) *ClientState {
+	client := newTestClient(servers[0])
+	client.tlsConfig = servers[0].Client().Transport.(*http.Transport).TLSClientConfig
+	client.tlsHandshakeTimeout = DefaultTLSHandshakeTimeout
+	var hostports []string
+	for _, server := range servers {
+		hostports = append(hostports, hostport(server))
+	}
+	client.endpoints = newEndpointSet(hostports, DefaultEndpointCooldown)
+	return client
+}
+
+func TestFailoverWhenPrimaryIsDown(t *testing.T) {
+	primary := newStatusServer("AVAILABLE")
+	dr := newStatusServer("ALLOCATED")
+	defer dr.Close()
+
+	journal := &memoryJournal{}
+	client := newFailoverClient(primary, dr)
+	client.journal = journal
+	client.retryPolicy.MaxAttempts = 1
+	primary.Close()
+
+	// State changes don't fail over, not even when no connection could be
+	// made, they are left to the retry policy.
+	_, err := client.DownloadOrder(context.Background(), "8947000000000012141")
+	assert.Assert(t, err != nil)
+	assert.Equal(t, "", client.Endpoint("8947000000000012141"))
+	assert.Equal(t, 1, len(journal.entries))
+	assert.Equal(t, hostport(primary), journal.entries[0].Endpoint)
+	assert.Assert(t, journal.entries[0].Error != "")
+
+	// Status queries do.
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "ALLOCATED", status.State)
+	assert.Equal(t, hostport(dr), client.Endpoint("8947000000000012141"))
+}
+
+func TestIccidsStickToTheirEndpoint(t *testing.T) {
+	primary := newStatusServer("AVAILABLE")
+	defer primary.Close()
+	dr := newStatusServer("ALLOCATED")
+	defer dr.Close()
+
+	client := newFailoverClient(primary, dr)
+
+	// Make the ICCID sticky to the DR site.
+	client.endpoints.markSucceeded(client.endpoints.endpoints[1], []string{"8947000000000012141"})
+
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "ALLOCATED", status.State)
+
+	// Other ICCIDs go to the primary.
+	status, err = client.GetStatus(context.Background(), "8947000000000012158")
+	assert.NilError(t, err)
+	assert.Equal(t, "AVAILABLE", status.State)
+	assert.Equal(t, hostport(primary), client.Endpoint("8947000000000012158"))
+
+	// Requests about several ICCIDs go to the endpoint most of them are sticky to.
+	client.endpoints.markSucceeded(client.endpoints.endpoints[1], []string{"8947000000000012166"})
+	candidates := client.endpoints.candidates([]string{"8947000000000012158", "8947000000000012141", "8947000000000012166"})
+	assert.Equal(t, hostport(dr), candidates[0].hostport)
+	candidates = client.endpoints.candidates([]string{"8947000000000012158", "8947000000000012174"})
+	assert.Equal(t, hostport(primary), candidates[0].hostport)
+}
+
+func TestFailedRequestsDontMakeIccidsSticky(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not json</html>"))
+	}))
+	defer server.Close()
+
+	client := newFailoverClient(server)
+	_, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.Assert(t, err != nil)
+	assert.Equal(t, "", client.Endpoint("8947000000000012141"))
+}
+
+func TestNoFailoverWhenRequestMayHaveBeenReceived(t *testing.T) {
+	primary := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Drop the connection after having received the request.
+		panic(http.ErrAbortHandler)
+	}))
+	defer primary.Close()
+	dr := newStatusServer("ALLOCATED")
+	defer dr.Close()
+
+	client := newFailoverClient(primary, dr)
+	client.retryPolicy.MaxAttempts = 1
+	_, err := client.ConfirmOrder(context.Background(), "8947000000000012141")
+	assert.Assert(t, err != nil)
+	assert.Equal(t, "", client.Endpoint("8947000000000012141"))
+
+	// Status queries are safe to repeat, so they fail over.
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "ALLOCATED", status.State)
+}
+
+func TestCheckEndpoints(t *testing.T) {
+	primary := newStatusServer("AVAILABLE")
+	dr := newStatusServer("ALLOCATED")
+	defer dr.Close()
+
+	client := newFailoverClient(primary, dr)
+	primary.Close()
+
+	health := client.CheckEndpoints(context.Background())
+	assert.Equal(t, 2, len(health))
+	assert.Assert(t, !health[0].Healthy)
+	assert.Assert(t, health[0].Err != nil)
+	assert.Assert(t, health[1].Healthy)
+
+	// The unhealthy primary is now tried last.
+	candidates := client.endpoints.candidates([]string{"8947000000000012141"})
+	assert.Equal(t, hostport(dr), candidates[0].hostport)
+}
+
+func TestReplayingClientDoesntCheckEndpoints(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	connections := 0
+	server.Config.ConnState = func(net.Conn, http.ConnState) { connections++ }
+
+	client := newFailoverClient(server)
+	client.replaying = true
+	health := client.CheckEndpoints(context.Background())
+	assert.Equal(t, 1, len(health))
+	assert.Assert(t, !health[0].Healthy)
+	assert.ErrorContains(t, health[0].Err, "replayed from a cassette")
+	assert.Equal(t, 0, connections)
+}
+
+func TestRequestsAndHealthChecksGoThroughProxy(t *testing.T) {
+	server := newStatusServer("RELEASED")
+	defer server.Close()
+
+	for _, proxy := range []*proxytest.Proxy{
+		proxytest.NewConnectProxy("user", "secret"),
+		proxytest.NewSocks5Proxy("user", "secret"),
+	} {
+		proxyURL, err := outboundproxy.Parse(proxy.URL)
+		assert.NilError(t, err)
+
+		client, err := NewClientWithConfig(ClientConfig{
+			Hostport:     hostport(server),
+			CertFilePath: "testdata/client.crt",
+			KeyFilePath:  "testdata/client.key",
+			Proxy:        proxyURL,
+		})
+		assert.NilError(t, err)
+
+		status, err := client.GetStatus(context.Background(), "8947000000000012141")
+		assert.NilError(t, err, proxy.URL)
+		assert.Equal(t, "RELEASED", status.State)
+
+		health := client.CheckEndpoints(context.Background())
+		assert.Assert(t, health[0].Healthy)
+
+		assert.DeepEqual(t, []string{hostport(server), hostport(server)}, proxy.Targets())
+		proxy.Close()
+	}
+}
@@ -2,25 +2,38 @@ package es2plus
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/fieldsyntaxchecks"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/outboundproxy"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 
 // Client is an external interface for ES2+ client
 type Client interface {
-	GetStatus(iccid string) (*ProfileStatus, error)
-	RecoverProfile(iccid string, targetState string) (*RecoverProfileResponse, error)
-	CancelOrder(iccid string, targetState string) (*CancelOrderResponse, error)
-	DownloadOrder(iccid string) (*DownloadOrderResponse, error)
-	ConfirmOrder(iccid string) (*ConfirmOrderResponse, error)
-	ActivateIccid(iccid string) (*ProfileStatus, error)
+	GetStatus(ctx context.Context, iccid string) (*ProfileStatus, error)
+	GetStatuses(ctx context.Context, iccids []string) (map[string]*ProfileStatus, error)
+	RecoverProfile(ctx context.Context, iccid string, targetState string) (*RecoverProfileResponse, error)
+	CancelOrder(ctx context.Context, iccid string, targetState string) (*CancelOrderResponse, error)
+	DownloadOrder(ctx context.Context, iccid string) (*DownloadOrderResponse, error)
+	ConfirmOrder(ctx context.Context, iccid string) (*ConfirmOrderResponse, error)
+	ActivateIccid(ctx context.Context, iccid string) (*ProfileStatus, error)
 	RequesterID() string
+	MaxConcurrentRequests() int
+	Endpoint(iccid string) string
+	CheckEndpoints(ctx context.Context) []EndpointHealth
 }
 
 ///
@@ -166,45 +179,241 @@ type ConfirmOrderResponse struct {
 //
 
 
+// Defaults used for the parts of a ClientConfig that are not set.
+const (
+	DefaultStatusListSize      = 100
+	DefaultRequestTimeout      = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultMaxIdleConns        = 100
+	DefaultMaxConnsPerHost     = 20
+)
+
+// ClientConfig holds everything needed to set up a client for
+// the ES2+ endpoint of a profile vendor.
+type ClientConfig struct {
+	CertFilePath        string
+	KeyFilePath         string
+	Hostport            string
+	FailoverHostports   []string
+	EndpointCooldown    time.Duration
+	RequesterID         string
+	StatusListSize      int
+	RequestTimeout      time.Duration
+	TLSHandshakeTimeout time.Duration
+	MaxIdleConns        int
+	MaxConnsPerHost     int
+	EnableHTTP2         bool
+
+	// Overload protection: the circuit breaker opens after this many
+	// overload signals in a row, and stays open for the given duration.
+	BreakerThreshold    int
+	BreakerOpenDuration time.Duration
+
+	// How state changing calls are retried when no answer comes back, and
+	// where they are kept until their outcome is known.
+	RetryPolicy       RetryPolicy
+	PendingOperations PendingOperations
+
+	// If set, all connections to the SM-DP+ are made through this
+	// HTTP CONNECT or SOCKS5 proxy (see package outboundproxy).
+	Proxy *url.URL
+
+	// If a journal is given, all exchanges are recorded in it, tagged
+	// with the name of the profile vendor.
+	ProfileVendor string
+	Journal       Journal
+
+	// How the vendor's SM-DP+ speaks ES2+, the defaults are used if not set.
+	Dialect Dialect
+
+	// If set, the HTTP transport is passed through this function, e.g.
+	// to record the exchanges with a Recorder, or to replace the transport
+	// by a Replayer.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+
+	// Replaying is set when WrapTransport replaces the transport by a
+	// Replayer, so that the client never connects to the SM-DP+.  Only a
+	// replaying client can do without a certificate and key.
+	Replaying bool
+}
+
+// WithDefaults returns a copy of the config where all unset (zero or negative)
+// sizes and timeouts are replaced by their defaults.
+func (config ClientConfig) WithDefaults() ClientConfig {
+	if config.StatusListSize <= 0 {
+		config.StatusListSize = DefaultStatusListSize
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = DefaultRequestTimeout
+	}
+	if config.TLSHandshakeTimeout <= 0 {
+		config.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if config.MaxConnsPerHost <= 0 {
+		config.MaxConnsPerHost = DefaultMaxConnsPerHost
+	}
+	if config.EndpointCooldown <= 0 {
+		config.EndpointCooldown = DefaultEndpointCooldown
+	}
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = DefaultBreakerThreshold
+	}
+	if config.BreakerOpenDuration <= 0 {
+		config.BreakerOpenDuration = DefaultBreakerOpenDuration
+	}
+	config.RetryPolicy = config.RetryPolicy.WithDefaults()
+	return config
+}
+
 // ClientState struct representing the state of a ES2+ client.
 type ClientState struct {
-	httpClient  *http.Client
-	hostport    string
-	requesterID string
-	logPayload  bool
-	logHeaders  bool
+	httpClient          *http.Client
+	tlsConfig           *tls.Config
+	tlsHandshakeTimeout time.Duration
+	dial                func(ctx context.Context, network string, address string) (net.Conn, error)
+	endpoints           *endpointSet
+	requesterID         string
+	statusListSize      int
+	maxConnsPerHost     int
+	breaker             *circuitBreaker
+	limiter             *concurrencyLimiter
+	retryPolicy         RetryPolicy
+	pending             PendingOperations
+	profileVendor       string
+	dialect             Dialect
+	journal             Journal
+	replaying           bool
+	logPayload          bool
+	logHeaders          bool
 }
 
 
-// NewClient create a new es2+ client instance
-func NewClient(certFilePath string, keyFilePath string, hostport string, requesterID string) *ClientState {
-	return &ClientState{
-		httpClient:  newHTTPClient(certFilePath, keyFilePath),
-		hostport:    hostport,
-		requesterID: requesterID,
-		logPayload:  false,
-		logHeaders:  false,
-	}
+// NewClient create a new es2+ client instance, using the default
+// transport settings.
+func NewClient(certFilePath string, keyFilePath string, hostport string, requesterID string) (*ClientState, error) {
+	return NewClientWithConfig(ClientConfig{
+		CertFilePath: certFilePath,
+		KeyFilePath:  keyFilePath,
+		Hostport:     hostport,
+		RequesterID:  requesterID,
+		EnableHTTP2:  true,
+	})
 }
 
-func newHTTPClient(certFilePath string, keyFilePath string) *http.Client {
-	cert, err := tls.LoadX509KeyPair(
-		certFilePath,
-		keyFilePath)
+// NewClientWithConfig create a new es2+ client instance from a client config.
+func NewClientWithConfig(config ClientConfig) (*ClientState, error) {
+	config = config.WithDefaults()
+	if err := config.Dialect.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(config)
 	if err != nil {
-		log.Fatalf("server: loadkeys: %s", err)
+		return nil, err
+	}
+	dial := newDialFunc(config)
+	httpClient := newHTTPClientWithTLSConfig(config, tlsConfig, dial)
+	if config.WrapTransport != nil {
+		httpClient.Transport = config.WrapTransport(httpClient.Transport)
 	}
 
+	hostports := append([]string{config.Hostport}, config.FailoverHostports...)
+	return &ClientState{
+		httpClient:          httpClient,
+		tlsConfig:           tlsConfig,
+		tlsHandshakeTimeout: config.TLSHandshakeTimeout,
+		dial:                dial,
+		endpoints:           newEndpointSet(hostports, config.EndpointCooldown),
+		requesterID:         config.RequesterID,
+		statusListSize:      config.StatusListSize,
+		maxConnsPerHost:     config.MaxConnsPerHost,
+		breaker:             newCircuitBreaker(config.BreakerThreshold, config.BreakerOpenDuration),
+		limiter:             newConcurrencyLimiter(config.MaxConnsPerHost),
+		retryPolicy:         config.RetryPolicy,
+		pending:             config.PendingOperations,
+		profileVendor:       config.ProfileVendor,
+		dialect:             config.Dialect.WithDefaults(),
+		journal:             config.Journal,
+		replaying:           config.Replaying,
+		logPayload:          false,
+		logHeaders:          false,
+	}, nil
+}
+
+// SetStatusListSize sets the max number of ICCIDs sent in a single
+// getProfileStatus request by GetStatuses.  Sizes less than one are ignored.
+func (client *ClientState) SetStatusListSize(size int) {
+	if size > 0 {
+		client.statusListSize = size
+	}
+}
+
+func newTLSConfig(config ClientConfig) (*tls.Config, error) {
 	// TODO: The certificate used to sign the other end of the TLS connection
 	//       is privately signed, and at this time we don't require the full
 	//       certificate chain to  be available.
-	config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &config,
-		},
+	tlsConfig := tls.Config{InsecureSkipVerify: true}
+
+	// A replaying client never opens a connection, so it doesn't need a certificate.
+	if config.Replaying && config.CertFilePath == "" && config.KeyFilePath == "" {
+		return &tlsConfig, nil
+	}
+	if config.CertFilePath == "" || config.KeyFilePath == "" {
+		return nil, fmt.Errorf("both a certificate and a key file are needed to connect to the SM-DP+ at %s", config.Hostport)
+	}
+	cert, err := tls.LoadX509KeyPair(
+		config.CertFilePath,
+		config.KeyFilePath)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return &tlsConfig, nil
+}
+
+// newDialFunc returns the function used to open connections to the SM-DP+,
+// either directly or through the configured proxy.
+func newDialFunc(config ClientConfig) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	if config.Proxy != nil {
+		return outboundproxy.NewDialer(config.Proxy, config.TLSHandshakeTimeout).DialContext
+	}
+	dialer := &net.Dialer{Timeout: config.TLSHandshakeTimeout, KeepAlive: 30 * time.Second}
+	return dialer.DialContext
+}
+
+// newHTTPClientWithTLSConfig builds a http client with a connection pool
+// that is sized so that all the requests we allow to be in flight at the same
+// time can reuse idle connections, instead of opening new ones.
+func newHTTPClientWithTLSConfig(
+	config ClientConfig,
+	tlsConfig *tls.Config,
+	dial func(ctx context.Context, network string, address string) (net.Conn, error)) *http.Client {
+	maxIdleConnsPerHost := config.MaxConnsPerHost
+	if config.MaxIdleConns < maxIdleConnsPerHost {
+		maxIdleConnsPerHost = config.MaxIdleConns
+	}
+
+	transport := &http.Transport{
+		DialContext:         dial,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: config.TLSHandshakeTimeout,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		MaxConnsPerHost:     config.MaxConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   config.EnableHTTP2,
+	}
+	if !config.EnableHTTP2 {
+		// A non-nil, empty map disables HTTP/2.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.RequestTimeout,
 	}
-	return client
 }
 
 ///
@@ -264,43 +473,154 @@ func newHeader(client Client) (*Header, error) {
 // by json serializing it, then execute an ES2+ command
 // and unmarshal the result into the result object.
 func (client *ClientState) execute(
+	ctx context.Context,
 	es2plusCommand string,
 	payload interface{}, result interface{}) error {
 
-	// Serialize payload as json.
+	// Serialize payload as json, using the vendor's field names.
 	jsonStrB := new(bytes.Buffer)
 	err := json.NewEncoder(jsonStrB).Encode(payload)
 
 	if err != nil {
-		return err
+		return notSent(err)
+	}
+
+	requestBody, err := client.dialect.toVendor(jsonStrB.Bytes())
+	if err != nil {
+		return notSent(err)
 	}
 
 	if client.logPayload {
-		log.Print("Payload ->", jsonStrB.String())
+		log.Print("Payload ->", string(requestBody))
 	}
 
-	url := fmt.Sprintf("https://%s/gsma/rsp2/es2plus/%s", client.hostport, es2plusCommand)
-	req, err := http.NewRequest("POST", url, jsonStrB)
+	_, iccids := journalKeys(payload)
+	stickyIccids := splitIccids(iccids)
+
+	return client.executeGuarded(ctx, es2plusCommand, func() error {
+		// Try the endpoints in order, failing over to the next one on
+		// transport errors, as long as it is safe to do so.
+		candidates := client.endpoints.candidates(stickyIccids)
+		for i, e := range candidates {
+			err := client.executeAt(ctx, e.hostport, es2plusCommand, payload, requestBody, result)
+			if err == nil {
+				client.endpoints.markSucceeded(e, stickyIccids)
+				return nil
+			}
+
+			var transportErr *transportError
+			if !errors.As(err, &transportErr) {
+				return err
+			}
+
+			client.endpoints.markFailed(e)
+			if ctx.Err() != nil || i == len(candidates)-1 || !canFailOver(es2plusCommand) {
+				return err
+			}
+			log.Printf("ES2+ %s via %s failed (%s), failing over to %s\n", es2plusCommand, e.hostport, err, candidates[i+1].hostport)
+		}
+		return fmt.Errorf("no ES2+ endpoints configured")
+	})
+}
+
+// executeAt sends an ES2+ request to a single endpoint.  Errors where no
+// HTTP response was received are returned as transportErrors.
+func (client *ClientState) executeAt(
+	ctx context.Context,
+	hostport string,
+	es2plusCommand string,
+	payload interface{},
+	requestBody []byte,
+	result interface{}) error {
+
+	url := fmt.Sprintf("https://%s%s/%s", hostport, client.dialect.BasePath, es2plusCommand)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(requestBody))
 	if err != nil {
-		return err
+		return notSent(err)
 	}
-	req.Header.Set("X-Admin-Protocol", "gsma/rsp/v2.0.0")
+	req.Header.Set("X-Admin-Protocol", client.dialect.AdminProtocolHeader())
 	req.Header.Set("Content-Type", "application/json")
 
 	if client.logHeaders {
 		log.Printf("Request -> %s\n", formatRequest(req))
 	}
 
+	start := time.Now()
 	resp, err := client.httpClient.Do(req)
 	if err != nil {
-		return err
+		client.journalExchange(hostport, es2plusCommand, payload, start, requestBody, 0, nil, err)
+		return &transportError{endpoint: hostport, err: err}
 	}
 	defer resp.Body.Close()
 
-	// TODO Should check response headers here!
-	// (in particular X-admin-protocol) and fail if not OK.
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	client.journalExchange(hostport, es2plusCommand, payload, start, requestBody, resp.StatusCode, responseBody, err)
+	if err != nil {
+		return err
+	}
 
-	return json.NewDecoder(resp.Body).Decode(&result)
+	if client.logPayload {
+		log.Print("Response <-", string(responseBody))
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter := defaultRetryAfter
+		if header := resp.Header.Get("Retry-After"); header != "" {
+			retryAfter = parseRetryAfter(header, time.Now())
+		}
+		return &OverloadError{Endpoint: hostport, StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+	}
+
+	if err := client.dialect.checkAdminProtocolHeader(resp.Header.Get("X-Admin-Protocol")); err != nil {
+		return err
+	}
+
+	responseBody, err = client.dialect.fromVendor(responseBody)
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s response (HTTP status %d): %s", es2plusCommand, resp.StatusCode, err)
+	}
+
+	return json.Unmarshal(responseBody, result)
+}
+
+// journalExchange records an ES2+ exchange in the client's journal, if it has one.
+// Failing to write the journal is logged, and left to the journal to keep track of,
+// but does not fail the ES2+ operation, since by then the SM-DP+ may already have
+// acted on the request.
+func (client *ClientState) journalExchange(
+	hostport string,
+	es2plusCommand string,
+	payload interface{},
+	start time.Time,
+	requestBody []byte,
+	httpStatus int,
+	responseBody []byte,
+	exchangeErr error) {
+
+	if client.journal == nil {
+		return
+	}
+
+	functionCallIdentifier, iccids := journalKeys(payload)
+	entry := &model.Es2JournalEntry{
+		Timestamp:              start.UTC().Format(time.RFC3339),
+		ProfileVendor:          client.profileVendor,
+		Endpoint:               hostport,
+		Es2Function:            es2plusCommand,
+		FunctionCallIdentifier: functionCallIdentifier,
+		Iccids:                 iccids,
+		HTTPStatus:             httpStatus,
+		LatencyMillis:          int64(time.Since(start) / time.Millisecond),
+		Request:                client.dialect.Redact(requestBody),
+		Response:               client.dialect.Redact(responseBody),
+	}
+	if exchangeErr != nil {
+		entry.Error = exchangeErr.Error()
+	}
+
+	if err := client.journal.CreateEs2JournalEntry(entry); err != nil {
+		log.Printf("ERROR: Couldn't journal %s exchange %s: %s\n", es2plusCommand, functionCallIdentifier, err)
+	}
 }
 
 ///
@@ -309,7 +629,7 @@ func (client *ClientState) execute(
 
 
 // GetStatus  will return the status of a profile with a specific ICCID.
-func (client *ClientState) GetStatus(iccid string) (*ProfileStatus, error) {
+func (client *ClientState) GetStatus(ctx context.Context, iccid string) (*ProfileStatus, error) {
 	result := new(es2ProfileStatusResponse)
 	es2plusCommand := "getProfileStatus"
 	header, err := newHeader(client)
@@ -320,7 +640,7 @@ func (client *ClientState) GetStatus(iccid string) (*ProfileStatus, error) {
 		Header:    *header,
 		IccidList: []ICCID{ICCID{Iccid: iccid}},
 	}
-	if err = client.execute(es2plusCommand, payload, result); err != nil {
+	if err = client.execute(ctx, es2plusCommand, payload, result); err != nil {
 		return nil, err
 	}
 
@@ -333,57 +653,212 @@ func (client *ClientState) GetStatus(iccid string) (*ProfileStatus, error) {
 	}
 }
 
-// RecoverProfile will recover the state of the profile with a particular ICCID,
-// by setting it to the target state.
-func (client *ClientState) RecoverProfile(iccid string, targetState string) (*RecoverProfileResponse, error) {
-	result := new(RecoverProfileResponse)
-	es2plusCommand := "recoverProfile"
+// GetStatuses will return the statuses of all the profiles with the given ICCIDs,
+// mapped by ICCID.  The ICCIDs are sent in chunks of at most the client's
+// status list size, so a large batch will need only a few round trips.  ICCIDs the
+// SM-DP+ returns no status for are not present in the map.  The statuses are
+// mapped by the ICCIDs as given, also when the SM-DP+ spells them with or
+// without the Luhn checksum, or padded with an 'F'.  If some of the chunks
+// fail, the statuses from the others are returned along with a *StatusesError.
+func (client *ClientState) GetStatuses(ctx context.Context, iccids []string) (map[string]*ProfileStatus, error) {
+	statuses := make(map[string]*ProfileStatus)
+	index := newIccidIndex(iccids)
+	var failed []ChunkError
+
+	chunkSize := client.statusListSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultStatusListSize
+	}
+
+	for start := 0; start < len(iccids); start += chunkSize {
+		end := start + chunkSize
+		if end > len(iccids) {
+			end = len(iccids)
+		}
+
+		chunk, err := client.getStatusChunk(ctx, iccids[start:end])
+		if err != nil {
+			failed = append(failed, ChunkError{Iccids: iccids[start:end], Err: err})
+			continue
+		}
+		for _, status := range chunk {
+			iccid, found := index.lookup(status.Iccid)
+			if !found {
+				log.Printf("getProfileStatus returned the status of Iccid='%s', which wasn't asked for\n", status.Iccid)
+				continue
+			}
+			statuses[iccid] = status
+		}
+	}
+
+	if len(failed) > 0 {
+		return statuses, &StatusesError{Chunks: failed}
+	}
+	return statuses, nil
+}
+
+// getStatusChunk gets the statuses of the ICCIDs with a single getProfileStatus request.
+func (client *ClientState) getStatusChunk(ctx context.Context, iccids []string) ([]*ProfileStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	header, err := newHeader(client)
 	if err != nil {
 		return nil, err
 	}
-	payload := &RecoverProfileRequest{
-		Header:        *header,
-		Iccid:         iccid,
-		ProfileStatus: targetState,
+
+	iccidList := make([]ICCID, 0, len(iccids))
+	for _, iccid := range iccids {
+		iccidList = append(iccidList, ICCID{Iccid: iccid})
+	}
+
+	result := new(es2ProfileStatusResponse)
+	payload := &GetProfileStatusRequest{
+		Header:    *header,
+		IccidList: iccidList,
+	}
+	if err = client.execute(ctx, "getProfileStatus", payload, result); err != nil {
+		return nil, err
+	}
+
+	executionStatus := result.Header.FunctionExecutionStatus
+	if executionStatus.FunctionExecutionStatusType == "Failed" {
+		return nil, fmt.Errorf("getProfileStatus failed for ICCIDs %s..%s: %s", iccids[0], iccids[len(iccids)-1], executionStatus.StatusCodeData.Message)
+	}
+
+	statuses := make([]*ProfileStatus, 0, len(result.ProfileStatusList))
+	for i := range result.ProfileStatusList {
+		statuses = append(statuses, &result.ProfileStatusList[i])
+	}
+	return statuses, nil
+}
+
+// ChunkError is a chunk of ICCIDs whose statuses GetStatuses couldn't get.
+type ChunkError struct {
+	Iccids []string
+	Err    error
+}
+
+// StatusesError is returned by GetStatuses, along with the statuses it did
+// get, when some of the chunks failed.
+type StatusesError struct {
+	Chunks []ChunkError
+}
+
+func (e *StatusesError) Error() string {
+	return fmt.Sprintf("couldn't get the statuses of %d profiles in %d requests, the first error: %s", len(e.Iccids()), len(e.Chunks), e.Chunks[0].Err)
+}
+
+// Iccids returns the ICCIDs whose statuses GetStatuses couldn't get.
+func (e *StatusesError) Iccids() []string {
+	var iccids []string
+	for _, chunk := range e.Chunks {
+		iccids = append(iccids, chunk.Iccids...)
+	}
+	return iccids
+}
+
+// iccidIndex finds the ICCID asked for from the ICCID in a response, which
+// may be spelled differently.
+type iccidIndex map[string]string
+
+// normalizeIccid strips the 'F' an ICCID may be padded with.
+func normalizeIccid(iccid string) string {
+	return strings.TrimRight(iccid, "Ff")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func newIccidIndex(iccids []string) iccidIndex {
+	index := make(iccidIndex)
+	for _, iccid := range iccids {
+		index[normalizeIccid(iccid)] = iccid
+	}
+	// An ICCID in the response may have a Luhn checksum the one asked for
+	// didn't have.  The ICCIDs as asked for win if they are the same.
+	for _, iccid := range iccids {
+		if normalized := normalizeIccid(iccid); isDigits(normalized) {
+			withChecksum := fieldsyntaxchecks.AddLuhnChecksum(normalized)
+			if _, taken := index[withChecksum]; !taken {
+				index[withChecksum] = iccid
+			}
+		}
+	}
+	return index
+}
+
+// lookup returns the ICCID asked for that the ICCID from a response is, if any.
+func (index iccidIndex) lookup(iccid string) (string, bool) {
+	normalized := normalizeIccid(iccid)
+	if asked, found := index[normalized]; found {
+		return asked, true
+	}
+	// Or it may lack the Luhn checksum the one asked for had.
+	if isDigits(normalized) {
+		asked, found := index[fieldsyntaxchecks.AddLuhnChecksum(normalized)]
+		return asked, found
 	}
-	return result,  client.execute(es2plusCommand, payload, result)
+	return "", false
+}
+
+// RecoverProfile will recover the state of the profile with a particular ICCID,
+// by setting it to the target state.
+func (client *ClientState) RecoverProfile(ctx context.Context, iccid string, targetState string) (*RecoverProfileResponse, error) {
+	result := new(RecoverProfileResponse)
+	change := stateChange{es2Function: "recoverProfile", iccid: iccid, done: inState(targetState)}
+	_, err := client.executeStateChange(ctx, change, func(header Header) interface{} {
+		return &RecoverProfileRequest{
+			Header:        header,
+			Iccid:         iccid,
+			ProfileStatus: targetState,
+		}
+	}, result)
+	return result, err
 }
 
 // CancelOrder will cancel an order by setting  the state of the profile with a particular ICCID,
 // the target state.
-func (client *ClientState) CancelOrder(iccid string, targetState string) (*CancelOrderResponse, error) {
+func (client *ClientState) CancelOrder(ctx context.Context, iccid string, targetState string) (*CancelOrderResponse, error) {
 	result := new(CancelOrderResponse)
-	es2plusCommand := "cancelOrder"
-	header, err := newHeader(client)
-	if err != nil {
-		return nil, err
-	}
-	payload := &CancelOrderRequest{
-		Header:                      *header,
-		Iccid:                       iccid,
-		FinalProfileStatusIndicator: targetState,
-	}
-	return result,  client.execute(es2plusCommand, payload, result)
+	change := stateChange{es2Function: "cancelOrder", iccid: iccid, done: inState(targetState)}
+	_, err := client.executeStateChange(ctx, change, func(header Header) interface{} {
+		return &CancelOrderRequest{
+			Header:                      header,
+			Iccid:                       iccid,
+			FinalProfileStatusIndicator: targetState,
+		}
+	}, result)
+	return result, err
 }
 
 // DownloadOrder will prepare the profile to be downloaded (first of two steps, the
-// ConfirmDownload is also necessary).
-func (client *ClientState) DownloadOrder(iccid string) (*DownloadOrderResponse, error) {
+// ConfirmDownload is also necessary).  Like the other state changing calls it
+// is retried according to the client's RetryPolicy, and if a retry finds that
+// an earlier attempt has already taken effect, the response is empty.
+func (client *ClientState) DownloadOrder(ctx context.Context, iccid string) (*DownloadOrderResponse, error) {
 	result := new(DownloadOrderResponse)
-	es2plusCommand := "downloadOrder"
-	header, err := newHeader(client)
+	change := stateChange{es2Function: "downloadOrder", iccid: iccid, done: downloadOrderDone}
+	alreadyDone, err := client.executeStateChange(ctx, change, func(header Header) interface{} {
+		return &DownloadOrderRequest{
+			Header:      header,
+			Iccid:       iccid,
+			Eid:         "",
+			Profiletype: "",
+		}
+	}, result)
 	if err != nil {
 		return nil, err
 	}
-	payload := &DownloadOrderRequest{
-		Header:      *header,
-		Iccid:       iccid,
-		Eid:         "",
-		Profiletype: "",
-	}
-	if err =  client.execute(es2plusCommand, payload, result); err != nil {
-		return nil, err
+	if alreadyDone {
+		return result, nil
 	}
 
 	executionStatus := result.Header.FunctionExecutionStatus.FunctionExecutionStatusType
@@ -395,25 +870,25 @@ func (client *ClientState) DownloadOrder(iccid string) (*DownloadOrderResponse,
 
 // ConfirmOrder will execute the second of the two steps that are necessary to prepare a profile for
 // to be downloaded.
-func (client *ClientState) ConfirmOrder(iccid string) (*ConfirmOrderResponse, error) {
+func (client *ClientState) ConfirmOrder(ctx context.Context, iccid string) (*ConfirmOrderResponse, error) {
 	result := new(ConfirmOrderResponse)
-	es2plusCommand := "confirmOrder"
-	header, err := newHeader(client)
+	change := stateChange{es2Function: "confirmOrder", iccid: iccid, done: confirmOrderDone}
+	alreadyDone, err := client.executeStateChange(ctx, change, func(header Header) interface{} {
+		return &ConfirmOrderRequest{
+			Header:           header,
+			Iccid:            iccid,
+			Eid:              "",
+			ConfirmationCode: "",
+			MatchingID:       "",
+			SmdpAddress:      "",
+			ReleaseFlag:      true,
+		}
+	}, result)
 	if err != nil {
 		return nil, err
 	}
-	payload := &ConfirmOrderRequest{
-		Header:           *header,
-		Iccid:            iccid,
-		Eid:              "",
-		ConfirmationCode: "",
-		MatchingID:       "",
-		SmdpAddress:      "",
-		ReleaseFlag:      true,
-	}
-
-	if err =  client.execute(es2plusCommand, payload, result); err != nil {
-		return nil, err
+	if alreadyDone {
+		return result, nil
 	}
 
 	executionStatus := result.Header.FunctionExecutionStatus.FunctionExecutionStatusType
@@ -428,33 +903,55 @@ func (client *ClientState) ConfirmOrder(iccid string) (*ConfirmOrderResponse, er
 // ActivateIccid will take a profile to the state "READY" where it can be downloaded.
 // This function will if poll the current status of the profile, and if
 // necessary advance the state by executing the DownloadOrder and
-// ConfirmOrder functions.
-func (client *ClientState) ActivateIccid(iccid string) (*ProfileStatus, error) {
+// ConfirmOrder functions.  A BreakerOpenError is only returned if the
+// breaker was open before anything was sent.
+func (client *ClientState) ActivateIccid(ctx context.Context, iccid string) (*ProfileStatus, error) {
 
-	result, err := client.GetStatus(iccid)
+	result, err := client.GetStatus(ctx, iccid)
 	if err != nil {
 		return nil, err
 	}
+	if result == nil {
+		return nil, fmt.Errorf("no profile status found for ICCID '%s'", iccid)
+	}
 
 	if result.ACToken == "" {
 
 		if result.State == "AVAILABLE" {
-			if _, err := client.DownloadOrder(iccid); err != nil {
-				return nil, err
+			if _, err := client.DownloadOrder(ctx, iccid); err != nil {
+				return nil, interruptedByBreaker(iccid, err)
 			}
-			if result, err = client.GetStatus(iccid); err != nil {
-				return nil, err
+			if result, err = client.GetStatus(ctx, iccid); err != nil {
+				return nil, interruptedByBreaker(iccid, err)
 			}
 		}
 
 		if result.State == "ALLOCATED" {
-			if _, err = client.ConfirmOrder(iccid); err != nil {
-				return nil, err
+			if _, err = client.ConfirmOrder(ctx, iccid); err != nil {
+				return nil, interruptedByBreaker(iccid, err)
 			}
 		}
 	}
-	result, err = client.GetStatus(iccid)
-	return result, err
+	result, err = client.GetStatus(ctx, iccid)
+	return result, interruptedByBreaker(iccid, err)
+}
+
+// interruptedByBreaker turns a BreakerOpenError from a later step of
+// ActivateIccid into a plain error, so that a BreakerOpenError from
+// ActivateIccid always means that nothing was sent for the ICCID.
+func interruptedByBreaker(iccid string, err error) error {
+	var breakerErr *BreakerOpenError
+	if errors.As(err, &breakerErr) {
+		return fmt.Errorf("activation of ICCID '%s' interrupted half way: %s", iccid, err)
+	}
+	return err
+}
+
+// MaxConcurrentRequests is the number of requests that can be in flight
+// at the same time without opening more connections than the client is
+// configured for.  Bulk operations should not use more workers than this.
+func (client *ClientState) MaxConcurrentRequests() int {
+	return client.maxConnsPerHost
 }
 
 // RequesterID TODO: This shouldn't have to be public, but how can it be avoided?
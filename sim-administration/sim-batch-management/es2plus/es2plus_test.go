@@ -0,0 +1,251 @@
+package es2plus
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client talking to the test server.
+func newTestClient(server *httptest.Server) *ClientState {
+	return &ClientState{
+		httpClient:     server.Client(),
+		endpoints:      newEndpointSet([]string{strings.TrimPrefix(server.URL, "https://")}, DefaultEndpointCooldown),
+		requesterID:    "test-requester",
+		statusListSize: DefaultStatusListSize,
+		breaker:        newCircuitBreaker(DefaultBreakerThreshold, DefaultBreakerOpenDuration),
+		limiter:        newConcurrencyLimiter(DefaultMaxConnsPerHost),
+		retryPolicy:    RetryPolicy{}.WithDefaults(),
+		dialect:        Dialect{}.WithDefaults(),
+	}
+}
+
+func TestGetStatusesChunksAndMapsByIccid(t *testing.T) {
+	var listSizes []int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/gsma/rsp2/es2plus/getProfileStatus", r.URL.Path)
+
+		var request GetProfileStatusRequest
+		assert.NilError(t, json.NewDecoder(r.Body).Decode(&request))
+		listSizes = append(listSizes, len(request.IccidList))
+
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Executed-Success"
+		for _, iccid := range request.IccidList {
+			// Pretend the SM-DP+ doesn't know about one of the profiles.
+			if iccid.Iccid == "8947000000000000004" {
+				continue
+			}
+			response.ProfileStatusList = append(response.ProfileStatusList, ProfileStatus{Iccid: iccid.Iccid, State: "AVAILABLE"})
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server)
+	client.SetStatusListSize(2)
+
+	iccids := []string{"8947000000000000001", "8947000000000000002", "8947000000000000003", "8947000000000000004", "8947000000000000005"}
+	statuses, err := client.GetStatuses(context.Background(), iccids)
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []int{2, 2, 1}, listSizes)
+	assert.Equal(t, 4, len(statuses))
+	assert.Equal(t, "AVAILABLE", statuses["8947000000000000005"].State)
+	_, found := statuses["8947000000000000004"]
+	assert.Assert(t, !found)
+}
+
+func TestGetStatusesReportsFailure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Failed"
+		response.Header.FunctionExecutionStatus.StatusCodeData.Message = "too many ICCIDs"
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	_, err := newTestClient(server).GetStatuses(context.Background(), []string{"8947000000000000001"})
+	assert.ErrorContains(t, err, "too many ICCIDs")
+}
+
+func TestGetStatusesReturnsTheChunksThatSucceeded(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request GetProfileStatusRequest
+		assert.NilError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Executed-Success"
+		for _, iccid := range request.IccidList {
+			if iccid.Iccid == "8947000000000000003" {
+				response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Failed"
+				response.Header.FunctionExecutionStatus.StatusCodeData.Message = "no such luck"
+			}
+			response.ProfileStatusList = append(response.ProfileStatusList, ProfileStatus{Iccid: iccid.Iccid, State: "AVAILABLE"})
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	client := newTestClient(server)
+	client.SetStatusListSize(2)
+
+	iccids := []string{"8947000000000000001", "8947000000000000002", "8947000000000000003", "8947000000000000004", "8947000000000000005"}
+	statuses, err := client.GetStatuses(context.Background(), iccids)
+	var statusesErr *StatusesError
+	assert.Assert(t, errors.As(err, &statusesErr))
+	assert.ErrorContains(t, err, "no such luck")
+	assert.DeepEqual(t, []string{"8947000000000000003", "8947000000000000004"}, statusesErr.Iccids())
+	assert.Equal(t, 3, len(statuses))
+	assert.Equal(t, "AVAILABLE", statuses["8947000000000000005"].State)
+}
+
+func TestGetStatusesMapsDifferentlySpelledIccids(t *testing.T) {
+	// The SM-DP+ adds or strips the Luhn checksum, or pads with an 'F'.
+	spelled := map[string]string{
+		"894700000000001214":   "8947000000000012140",
+		"8947000000000012157":  "894700000000001215",
+		"8947000000000012165":  "8947000000000012165F",
+		"89470000000000121730": "89470000000000121730",
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request GetProfileStatusRequest
+		assert.NilError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Executed-Success"
+		for _, iccid := range request.IccidList {
+			response.ProfileStatusList = append(response.ProfileStatusList, ProfileStatus{Iccid: spelled[iccid.Iccid], State: "RELEASED"})
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	var iccids []string
+	for iccid := range spelled {
+		iccids = append(iccids, iccid)
+	}
+	statuses, err := newTestClient(server).GetStatuses(context.Background(), iccids)
+	assert.NilError(t, err)
+	assert.Equal(t, 4, len(statuses))
+	for _, iccid := range iccids {
+		assert.Equal(t, "RELEASED", statuses[iccid].State, iccid)
+	}
+}
+
+func TestRequestTimeoutFromConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	config := ClientConfig{RequestTimeout: 50 * time.Millisecond}.WithDefaults()
+	client := newTestClient(server)
+	client.httpClient = newHTTPClientWithTLSConfig(config, &tls.Config{InsecureSkipVerify: true}, newDialFunc(config))
+
+	_, err := client.GetStatus(context.Background(), "8947000000000000001")
+	assert.Assert(t, err != nil)
+}
+
+func TestCancelledContextStopsRequest(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should never reach the server")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := newTestClient(server).GetStatus(ctx, "8947000000000000001")
+	assert.ErrorContains(t, err, "context canceled")
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config := ClientConfig{MaxConnsPerHost: 7}.WithDefaults()
+	assert.Equal(t, 7, config.MaxConnsPerHost)
+	assert.Equal(t, DefaultMaxIdleConns, config.MaxIdleConns)
+	assert.Equal(t, DefaultRequestTimeout, config.RequestTimeout)
+	assert.Equal(t, DefaultStatusListSize, config.StatusListSize)
+}
+
+type memoryJournal struct {
+	entries []*model.Es2JournalEntry
+}
+
+func (j *memoryJournal) CreateEs2JournalEntry(entry *model.Es2JournalEntry) error {
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func TestExchangesAreJournalledWithSecretsRedacted(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Executed-Success"
+		response.ProfileStatusList = []ProfileStatus{{Iccid: "8947000000000000001", State: "RELEASED", ACToken: "SECRET-MATCHING-ID"}}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	journal := &memoryJournal{}
+	client := newTestClient(server)
+	client.journal = journal
+	client.profileVendor = "Durian"
+
+	status, err := client.GetStatus(context.Background(), "8947000000000000001")
+	assert.NilError(t, err)
+	assert.Equal(t, "SECRET-MATCHING-ID", status.ACToken)
+
+	assert.Equal(t, 1, len(journal.entries))
+	entry := journal.entries[0]
+	assert.Equal(t, "Durian", entry.ProfileVendor)
+	assert.Equal(t, "getProfileStatus", entry.Es2Function)
+	assert.Equal(t, "8947000000000000001", entry.Iccids)
+	assert.Equal(t, 200, entry.HTTPStatus)
+	assert.Assert(t, strings.HasPrefix(entry.FunctionCallIdentifier, "urn:uuid:"))
+	assert.Assert(t, strings.Contains(entry.Request, entry.FunctionCallIdentifier))
+	assert.Assert(t, !strings.Contains(entry.Response, "SECRET-MATCHING-ID"))
+	assert.Assert(t, strings.Contains(entry.Response, RedactedValue))
+}
+
+func TestTransportErrorsAreJournalled(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	client := newTestClient(server)
+	server.Close()
+
+	journal := &memoryJournal{}
+	client.journal = journal
+	client.retryPolicy.MaxAttempts = 1
+
+	_, err := client.DownloadOrder(context.Background(), "8947000000000000001")
+	assert.Assert(t, err != nil)
+	assert.Equal(t, 1, len(journal.entries))
+	assert.Equal(t, 0, journal.entries[0].HTTPStatus)
+	assert.Assert(t, journal.entries[0].Error != "")
+}
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, `{"header":{"x":1},"matchingId":"REDACTED","profileStatusList":[{"acToken":"REDACTED","iccid":"1"}]}`,
+		Redact([]byte(`{"header":{"x":1},"matchingId":"M","profileStatusList":[{"acToken":"A","iccid":"1"}]}`)))
+	assert.Equal(t, "<html>not json</html>", Redact([]byte("<html>not json</html>")))
+
+	// However the vendor spells them.
+	assert.Equal(t, `{"AC_TOKEN":"REDACTED","confirmation-code":"REDACTED","iccid":"1","matchingID":"REDACTED","matching_id":"REDACTED"}`,
+		Redact([]byte(`{"matching_id":"M","matchingID":"M","AC_TOKEN":"A","confirmation-code":"C","iccid":"1"}`)))
+}
+
+func TestNewClientReturnsErrors(t *testing.T) {
+	_, err := NewClient("no-such.crt", "no-such.key", "smdp.example.com:4711", "1.2.3")
+	assert.ErrorContains(t, err, "no-such.crt")
+
+	client, err := NewClient("testdata/client.crt", "testdata/client.key", "smdp.example.com:4711", "1.2.3")
+	assert.NilError(t, err)
+	assert.Assert(t, client != nil)
+}
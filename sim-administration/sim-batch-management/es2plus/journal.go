@@ -0,0 +1,110 @@
+package es2plus
+
+import (
+	"encoding/json"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"strings"
+)
+
+// Journal is where the client records the ES2+ exchanges it makes, so that
+// there is an audit trail when activations are disputed.
+type Journal interface {
+	CreateEs2JournalEntry(entry *model.Es2JournalEntry) error
+}
+
+// RedactedValue replaces the secrets in journalled requests and responses.
+const RedactedValue = "REDACTED"
+
+// redactedFields are the ES2+ fields that can be used to download a profile,
+// and that for that reason should never be stored in the journal.  They are
+// matched however they are spelled, see normalizeFieldName.
+var redactedFields = map[string]bool{
+	"acToken":          true,
+	"matchingId":       true,
+	"confirmationCode": true,
+	"activationCode":   true,
+}
+
+// normalizeFieldName makes the spellings of a field name the same, so that
+// "matchingId", "matching_id", "MATCHING-ID" and "matchingID" all match.
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// Redact returns the JSON payload with all secret fields replaced by RedactedValue.
+// Payloads that are not JSON, e.g. error pages, are returned as they are.
+func Redact(payload []byte) string {
+	return Dialect{}.Redact(payload)
+}
+
+// Redact returns the JSON payload, as sent to or received from a vendor speaking
+// the dialect, with all secret fields replaced by RedactedValue, whether they have
+// our names or the vendor's.
+func (dialect Dialect) Redact(payload []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return string(payload)
+	}
+	redacted, err := json.Marshal(redactValue(value, dialect.redactedFields()))
+	if err != nil {
+		return string(payload)
+	}
+	return string(redacted)
+}
+
+// redactedFields returns the normalized names of the secret fields, ours and
+// the vendor's.
+func (dialect Dialect) redactedFields() map[string]bool {
+	fields := make(map[string]bool, 2*len(redactedFields))
+	for name := range redactedFields {
+		fields[normalizeFieldName(name)] = true
+		if theirs, renamed := dialect.FieldNames[name]; renamed {
+			fields[normalizeFieldName(theirs)] = true
+		}
+	}
+	return fields
+}
+
+func redactValue(value interface{}, fields map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if fields[normalizeFieldName(key)] {
+				if s, isString := field.(string); isString && s == "" {
+					continue
+				}
+				v[key] = RedactedValue
+			} else {
+				v[key] = redactValue(field, fields)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = redactValue(element, fields)
+		}
+	}
+	return value
+}
+
+// journalKeys returns the function call identifier and the ICCIDs (comma separated)
+// of an ES2+ request payload.
+func journalKeys(payload interface{}) (string, string) {
+	switch p := payload.(type) {
+	case *GetProfileStatusRequest:
+		var iccids []string
+		for _, iccid := range p.IccidList {
+			iccids = append(iccids, iccid.Iccid)
+		}
+		return p.Header.FunctionCallIdentifier, strings.Join(iccids, ",")
+	case *RecoverProfileRequest:
+		return p.Header.FunctionCallIdentifier, p.Iccid
+	case *CancelOrderRequest:
+		return p.Header.FunctionCallIdentifier, p.Iccid
+	case *DownloadOrderRequest:
+		return p.Header.FunctionCallIdentifier, p.Iccid
+	case *ConfirmOrderRequest:
+		return p.Header.FunctionCallIdentifier, p.Iccid
+	default:
+		return "", ""
+	}
+}
@@ -0,0 +1,298 @@
+package es2plus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The ES2+ function an SM-DP+ calls on the operator to report download progress.
+const handleDownloadProgressInfo = "handleDownloadProgressInfo"
+
+// Notification points of handleDownloadProgressInfo (SGP.22), i.e. the
+// steps of a profile download the SM-DP+ reports on.
+const (
+	NotificationPointEligibilityCheck    = 1
+	NotificationPointConfirmationFailure = 2
+	NotificationPointBppDownload         = 3
+	NotificationPointBppInstallation     = 4
+	NotificationPointDeleted             = 5
+)
+
+// StateDeleted is the state of profiles the SM-DP+ reports deleted.
+const StateDeleted = "DELETED"
+
+// DefaultNotificationStates are the states a profile is in after a
+// successfully completed notification point.  Notification points not
+// listed only update the EID.
+var DefaultNotificationStates = map[int]string{
+	NotificationPointBppDownload:     StateDownloaded,
+	NotificationPointBppInstallation: StateInstalled,
+	NotificationPointDeleted:         StateDeleted,
+}
+
+// DownloadProgressInfo is the payload of the handleDownloadProgressInfo request.
+type DownloadProgressInfo struct {
+	Header                  Header                  `json:"header"`
+	Eid                     string                  `json:"eid"`
+	Iccid                   string                  `json:"iccid"`
+	ProfileType             string                  `json:"profileType"`
+	Timestamp               string                  `json:"timestamp"`
+	NotificationPointID     int                     `json:"notificationPointId"`
+	NotificationPointStatus FunctionExecutionStatus `json:"notificationPointStatus"`
+	ResultData              string                  `json:"resultData"`
+}
+
+// notificationResponse is the header-only response to a notification.  Unlike
+// ResponseHeader it spells functionExecutionStatus the way SGP.22 does, since
+// it is what the SM-DP+ parses.
+type notificationResponse struct {
+	Header struct {
+		FunctionExecutionStatus struct {
+			Status         string          `json:"status"`
+			StatusCodeData *StatusCodeData `json:"statusCodeData,omitempty"`
+		} `json:"functionExecutionStatus"`
+	} `json:"header"`
+}
+
+// ProfileStates is where the notification handler records what it learns
+// about the profiles.
+type ProfileStates interface {
+	GetSimProfileByIccid(iccid string) (*model.SimEntry, error)
+	GetBatchByID(id int64) (*model.Batch, error)
+	UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error)
+}
+
+// NotificationConfig configures the handler for ES2+ notifications from an SM-DP+.
+type NotificationConfig struct {
+	// Dialect gives the base path, protocol version and field names the
+	// notifications use.
+	Dialect Dialect
+
+	// States maps notification points to the states they leave the
+	// profile in when successful, DefaultNotificationStates if nil.
+	States map[int]string
+
+	Profiles ProfileStates
+
+	// Journal, if set, records the notifications.  They are journalled
+	// under ProfileVendor.
+	Journal Journal
+
+	// ProfileVendor is the vendor whose SM-DP+ sends the notifications.  If
+	// set, notifications about profiles in batches of other vendors are
+	// rejected, so that an SM-DP+ can only change the state of its own
+	// profiles.
+	ProfileVendor string
+}
+
+type notificationHandler struct {
+	config NotificationConfig
+	now    func() time.Time
+}
+
+// NewNotificationHandler returns an HTTP handler implementing the operator's
+// side of ES2+ handleDownloadProgressInfo.  It records the state and EID of
+// the profiles reported on, and acknowledges every notification it could
+// process with Executed-Success.
+func NewNotificationHandler(config NotificationConfig) http.Handler {
+	config.Dialect = config.Dialect.WithDefaults()
+	if config.States == nil {
+		config.States = DefaultNotificationStates
+	}
+	return &notificationHandler{config: config, now: time.Now}
+}
+
+// NotificationPath is the path the handler serves handleDownloadProgressInfo on.
+func (config NotificationConfig) NotificationPath() string {
+	return config.Dialect.WithDefaults().BasePath + "/" + handleDownloadProgressInfo
+}
+
+// ParseNotificationStates parses notification point to state mappings on the form
+// "6=ENABLED,7=DISABLED", adding them to the default ones.
+func ParseNotificationStates(mappings string) (map[int]string, error) {
+	states := make(map[int]string)
+	for point, state := range DefaultNotificationStates {
+		states[point] = state
+	}
+	for _, mapping := range strings.Split(mappings, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+		parts := strings.Split(mapping, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("not a valid notification point state (should be like '6=ENABLED'): '%s'", mapping)
+		}
+		point, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		state := strings.ToUpper(strings.TrimSpace(parts[1]))
+		if err != nil || point < 1 || state == "" {
+			return nil, fmt.Errorf("not a valid notification point state (should be like '6=ENABLED'): '%s'", mapping)
+		}
+		states[point] = state
+	}
+	return states, nil
+}
+
+func (handler *notificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != handler.config.NotificationPath() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := handler.now()
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "couldn't read request", http.StatusBadRequest)
+		return
+	}
+
+	httpStatus, notification, failure := handler.handle(r, requestBody)
+
+	response := notificationResponse{}
+	if failure == nil {
+		response.Header.FunctionExecutionStatus.Status = "Executed-Success"
+	} else {
+		response.Header.FunctionExecutionStatus.Status = "Failed"
+		response.Header.FunctionExecutionStatus.StatusCodeData = failure
+		log.Printf("ERROR: Couldn't handle ES2+ %s from %s: %s\n", handleDownloadProgressInfo, r.RemoteAddr, failure.Message)
+	}
+
+	responseBody, err := json.Marshal(response)
+	if err == nil {
+		responseBody, err = handler.config.Dialect.toVendor(responseBody)
+	}
+	if err != nil {
+		http.Error(w, "couldn't encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Admin-Protocol", handler.config.Dialect.AdminProtocolHeader())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(responseBody)
+
+	handler.journal(r, start, notification, requestBody, httpStatus, responseBody, failure)
+}
+
+// handle processes a notification, and returns the HTTP status to answer
+// with, the parsed notification, and what went wrong, if anything did.
+func (handler *notificationHandler) handle(r *http.Request, requestBody []byte) (int, *DownloadProgressInfo, *StatusCodeData) {
+	if err := handler.config.Dialect.checkAdminProtocolHeader(r.Header.Get("X-Admin-Protocol")); err != nil {
+		return http.StatusBadRequest, nil, &StatusCodeData{Message: err.Error()}
+	}
+
+	body, err := handler.config.Dialect.fromVendor(requestBody)
+	if err != nil {
+		return http.StatusBadRequest, nil, &StatusCodeData{Message: fmt.Sprintf("couldn't parse request: %s", err)}
+	}
+	notification := &DownloadProgressInfo{}
+	if err := json.Unmarshal(body, notification); err != nil {
+		return http.StatusBadRequest, nil, &StatusCodeData{Message: fmt.Sprintf("couldn't parse request: %s", err)}
+	}
+
+	// Some SM-DP+s pad ICCIDs with an odd number of digits with an 'F'.
+	notification.Iccid = strings.TrimRight(strings.ToUpper(strings.TrimSpace(notification.Iccid)), "F")
+	if notification.Iccid == "" || notification.NotificationPointID == 0 {
+		return http.StatusOK, notification, &StatusCodeData{ReasonCode: "2.2", Message: "iccid and notificationPointId are mandatory"}
+	}
+
+	profile, err := handler.config.Profiles.GetSimProfileByIccid(notification.Iccid)
+	if err != nil {
+		return http.StatusInternalServerError, notification, &StatusCodeData{SubjectIdentifier: notification.Iccid, Message: err.Error()}
+	}
+	if profile == nil {
+		return http.StatusOK, notification, &StatusCodeData{SubjectCode: "8.2.1", ReasonCode: "3.9", SubjectIdentifier: notification.Iccid, Message: "unknown ICCID"}
+	}
+	if handler.config.ProfileVendor != "" {
+		batch, err := handler.config.Profiles.GetBatchByID(profile.BatchID)
+		if err != nil {
+			return http.StatusInternalServerError, notification, &StatusCodeData{SubjectIdentifier: notification.Iccid, Message: err.Error()}
+		}
+		if batch == nil || batch.ProfileVendor != handler.config.ProfileVendor {
+			return http.StatusOK, notification, &StatusCodeData{SubjectCode: "8.2.1", ReasonCode: "1.2", SubjectIdentifier: notification.Iccid,
+				Message: fmt.Sprintf("ICCID is not a profile of '%s'", handler.config.ProfileVendor)}
+		}
+	}
+
+	status := notification.NotificationPointStatus.FunctionExecutionStatusType
+	state := ""
+	if status == "Executed-Success" || status == "Executed-WithWarning" {
+		state = handler.config.States[notification.NotificationPointID]
+	} else if notification.NotificationPointID == NotificationPointBppDownload || notification.NotificationPointID == NotificationPointBppInstallation {
+		state = StateError
+	}
+	log.Printf("ES2+ %s: Iccid='%s', notification point %d %s (%s), eid='%s'\n",
+		handleDownloadProgressInfo, notification.Iccid, notification.NotificationPointID, status,
+		notification.NotificationPointStatus.StatusCodeData.Message, notification.Eid)
+
+	if state == "" && notification.Eid == "" {
+		return http.StatusOK, notification, nil
+	}
+
+	// A timestamp in the future, e.g. from an SM-DP+ with a clock that is
+	// off, would make all later notifications for the profile look stale.
+	now := handler.now()
+	timestamp := now.UTC().Format(time.RFC3339)
+	if reported, err := time.Parse(time.RFC3339, notification.Timestamp); err == nil && !reported.After(now) {
+		timestamp = reported.UTC().Format(time.RFC3339)
+	}
+	updated, err := handler.config.Profiles.UpdateSimProfileState(notification.Iccid, state, notification.Eid, timestamp)
+	if err != nil {
+		return http.StatusInternalServerError, notification, &StatusCodeData{SubjectIdentifier: notification.Iccid, Message: err.Error()}
+	}
+	if !updated {
+		// Still a success, the SM-DP+ has nothing to retry.
+		log.Printf("Ignoring ES2+ %s for Iccid='%s' from %s, a later one has already been recorded\n", handleDownloadProgressInfo, notification.Iccid, timestamp)
+	} else if state != "" {
+		log.Printf("Iccid='%s' is now in state %s\n", notification.Iccid, state)
+	}
+	return http.StatusOK, notification, nil
+}
+
+// journal records a notification and the response to it, if there is a journal.
+func (handler *notificationHandler) journal(
+	r *http.Request,
+	start time.Time,
+	notification *DownloadProgressInfo,
+	requestBody []byte,
+	httpStatus int,
+	responseBody []byte,
+	failure *StatusCodeData) {
+
+	if handler.config.Journal == nil {
+		return
+	}
+
+	entry := &model.Es2JournalEntry{
+		Timestamp:     start.UTC().Format(time.RFC3339),
+		ProfileVendor: handler.config.ProfileVendor,
+		Endpoint:      r.RemoteAddr,
+		Es2Function:   handleDownloadProgressInfo,
+		HTTPStatus:    httpStatus,
+		LatencyMillis: handler.now().Sub(start).Milliseconds(),
+		Request:       handler.config.Dialect.Redact(requestBody),
+		Response:      handler.config.Dialect.Redact(responseBody),
+	}
+	if notification != nil {
+		entry.FunctionCallIdentifier = notification.Header.FunctionCallIdentifier
+		entry.Iccids = notification.Iccid
+	}
+	if failure != nil {
+		entry.Error = failure.Message
+	}
+	if err := handler.config.Journal.CreateEs2JournalEntry(entry); err != nil {
+		log.Printf("ERROR: Couldn't journal ES2+ %s from %s: %s\n", handleDownloadProgressInfo, r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,160 @@
+package es2plus
+
+import (
+	"encoding/json"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type profileUpdate struct {
+	iccid     string
+	state     string
+	eid       string
+	timestamp string
+}
+
+// memoryProfileStates has the profiles of a single batch, of the vendor Durian.
+type memoryProfileStates struct {
+	iccids  map[string]bool
+	updates []profileUpdate
+}
+
+func (p *memoryProfileStates) GetSimProfileByIccid(iccid string) (*model.SimEntry, error) {
+	if !p.iccids[iccid] {
+		return nil, nil
+	}
+	return &model.SimEntry{Iccid: iccid, BatchID: 1}, nil
+}
+
+func (p *memoryProfileStates) GetBatchByID(id int64) (*model.Batch, error) {
+	if id != 1 {
+		return nil, nil
+	}
+	return &model.Batch{BatchID: 1, Name: "b1", ProfileVendor: "Durian"}, nil
+}
+
+func (p *memoryProfileStates) UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error) {
+	p.updates = append(p.updates, profileUpdate{iccid, state, eid, timestamp})
+	return true, nil
+}
+
+func notify(handler http.Handler, body string) (*httptest.ResponseRecorder, notificationResponse) {
+	request := httptest.NewRequest(http.MethodPost, "/gsma/rsp2/es2plus/handleDownloadProgressInfo", strings.NewReader(body))
+	request.Header.Set("X-Admin-Protocol", "gsma/rsp/v2.1.0")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	var response notificationResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder, response
+}
+
+func TestNotificationsUpdateStateAndEid(t *testing.T) {
+	profiles := &memoryProfileStates{iccids: map[string]bool{"8947000000000012141": true}}
+	journal := &memoryJournal{}
+	handler := NewNotificationHandler(NotificationConfig{Profiles: profiles, Journal: journal, ProfileVendor: "Durian"}).(*notificationHandler)
+	handler.now = func() time.Time { return time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC) }
+
+	recorder, response := notify(handler, `{
+		"header": {"functionRequesterIdentifier": "smdp", "functionCallIdentifier": "urn:uuid:0b4c"},
+		"eid": "89049032123451234512345678901235",
+		"iccid": "8947000000000012141F",
+		"profileType": "BAR_FOOTEL_STD",
+		"timestamp": "2026-10-19T12:00:00+02:00",
+		"notificationPointId": 4,
+		"notificationPointStatus": {"status": "Executed-Success"}}`)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "gsma/rsp/v2.0.0", recorder.Header().Get("X-Admin-Protocol"))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Assert(t, strings.Contains(recorder.Body.String(), `"functionExecutionStatus":{"status":"Executed-Success"}`))
+	assert.Equal(t, "Executed-Success", response.Header.FunctionExecutionStatus.Status)
+
+	assert.Equal(t, 1, len(profiles.updates))
+	assert.Equal(t, profileUpdate{"8947000000000012141", StateInstalled, "89049032123451234512345678901235", "2026-10-19T10:00:00Z"}, profiles.updates[0])
+
+	assert.Equal(t, 1, len(journal.entries))
+	assert.Equal(t, "handleDownloadProgressInfo", journal.entries[0].Es2Function)
+	assert.Equal(t, "urn:uuid:0b4c", journal.entries[0].FunctionCallIdentifier)
+	assert.Equal(t, "8947000000000012141", journal.entries[0].Iccids)
+	assert.Equal(t, "Durian", journal.entries[0].ProfileVendor)
+}
+
+func TestFailedDownloadIsRecordedAsError(t *testing.T) {
+	profiles := &memoryProfileStates{iccids: map[string]bool{"8947000000000012141": true}}
+	handler := NewNotificationHandler(NotificationConfig{Profiles: profiles})
+
+	_, response := notify(handler, `{"iccid": "8947000000000012141", "timestamp": "2026-10-19T10:00:00Z", "notificationPointId": 3,
+		"notificationPointStatus": {"status": "Failed", "statusCodeData": {"message": "download failed"}}}`)
+	assert.Equal(t, "Executed-Success", response.Header.FunctionExecutionStatus.Status)
+	assert.Equal(t, StateError, profiles.updates[0].state)
+
+	// Failed eligibility checks don't change the state.
+	_, response = notify(handler, `{"iccid": "8947000000000012141", "notificationPointId": 1, "notificationPointStatus": {"status": "Failed"}}`)
+	assert.Equal(t, "Executed-Success", response.Header.FunctionExecutionStatus.Status)
+	assert.Equal(t, 1, len(profiles.updates))
+}
+
+func TestUnknownIccidIsRejected(t *testing.T) {
+	profiles := &memoryProfileStates{}
+	handler := NewNotificationHandler(NotificationConfig{Profiles: profiles})
+
+	recorder, response := notify(handler, `{"iccid": "8947000000000099999", "notificationPointId": 4, "notificationPointStatus": {"status": "Executed-Success"}}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "Failed", response.Header.FunctionExecutionStatus.Status)
+	assert.Equal(t, "8.2.1", response.Header.FunctionExecutionStatus.StatusCodeData.SubjectCode)
+	assert.Equal(t, "3.9", response.Header.FunctionExecutionStatus.StatusCodeData.ReasonCode)
+	assert.Equal(t, 0, len(profiles.updates))
+
+	recorder, _ = notify(handler, `not json`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestNotificationsAboutOtherVendorsProfilesAreRejected(t *testing.T) {
+	profiles := &memoryProfileStates{iccids: map[string]bool{"8947000000000012141": true}}
+	handler := NewNotificationHandler(NotificationConfig{Profiles: profiles, ProfileVendor: "Idemia"})
+
+	_, response := notify(handler, `{"iccid": "8947000000000012141", "notificationPointId": 5, "notificationPointStatus": {"status": "Executed-Success"}}`)
+	assert.Equal(t, "Failed", response.Header.FunctionExecutionStatus.Status)
+	assert.Equal(t, "1.2", response.Header.FunctionExecutionStatus.StatusCodeData.ReasonCode)
+	assert.Equal(t, 0, len(profiles.updates))
+}
+
+func TestTimestampsInTheFutureAreClampedToNow(t *testing.T) {
+	profiles := &memoryProfileStates{iccids: map[string]bool{"8947000000000012141": true}}
+	handler := NewNotificationHandler(NotificationConfig{Profiles: profiles}).(*notificationHandler)
+	handler.now = func() time.Time { return time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC) }
+
+	notify(handler, `{"iccid": "8947000000000012141", "timestamp": "2036-10-19T10:00:00Z", "notificationPointId": 4,
+		"notificationPointStatus": {"status": "Executed-Success"}}`)
+	assert.Equal(t, "2026-10-19T10:00:00Z", profiles.updates[0].timestamp)
+}
+
+func TestNotificationsInVendorDialect(t *testing.T) {
+	profiles := &memoryProfileStates{iccids: map[string]bool{"8947000000000012141": true}}
+	states, err := ParseNotificationStates("6=enabled")
+	assert.NilError(t, err)
+	handler := NewNotificationHandler(NotificationConfig{
+		Profiles: profiles,
+		States:   states,
+		Dialect:  Dialect{BasePath: "/es2", FieldNames: map[string]string{"iccid": "ICCID"}},
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/es2/handleDownloadProgressInfo",
+		strings.NewReader(`{"ICCID": "8947000000000012141", "notificationPointId": 6, "notificationPointStatus": {"status": "Executed-Success"}}`))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "ENABLED", profiles.updates[0].state)
+
+	recorder, _ = notify(handler, `{}`)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	_, err = ParseNotificationStates("six=ENABLED")
+	assert.ErrorContains(t, err, "not a valid notification point state")
+}
@@ -0,0 +1,320 @@
+package es2plus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for the circuit breaker protecting a vendor's SM-DP+.
+const (
+	// DefaultBreakerThreshold is the number of overload signals in a row
+	// (HTTP 429/503, timeouts, failed connections) that opens the breaker.
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerOpenDuration is how long the breaker stays open
+	// before a single probe request is let through.
+	DefaultBreakerOpenDuration = 30 * time.Second
+)
+
+// How long to hold back requests after an overloaded response that
+// didn't say for how long with a Retry-After header.
+const defaultRetryAfter = time.Second
+
+// The longest a Retry-After header can hold back requests, so that a
+// misconfigured SM-DP+ can't stop us for days.
+const maxRetryAfter = 5 * time.Minute
+
+// The concurrency towards an SM-DP+ is halved at most this often, so that
+// a burst of errors from requests that were all in flight at the same time
+// counts as a single signal.
+const concurrencyDecreaseInterval = time.Second
+
+// OverloadError is returned when the SM-DP+ answers HTTP 429 (Too Many
+// Requests) or 503 (Service Unavailable).  A 429 says the request was not
+// processed, a 503 may also come from something in front of the SM-DP+.
+type OverloadError struct {
+	Endpoint   string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("SM-DP+ at %s is overloaded (HTTP %d), retry after %s", e.Endpoint, e.StatusCode, e.RetryAfter)
+}
+
+// BreakerOpenError is returned, without anything being sent, while the
+// circuit breaker for a vendor's SM-DP+ is open.
+type BreakerOpenError struct {
+	ProfileVendor string
+	Until         time.Time
+	Cause         string
+}
+
+func (e *BreakerOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for the SM-DP+ of '%s' is open until %s, after: %s",
+		e.ProfileVendor, e.Until.Format(time.RFC3339), e.Cause)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date.  Returns zero if there is no usable value.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// isOverloadSignal tells if an error from a request means the SM-DP+ is
+// unable to keep up: it is overloaded, doesn't answer in time or can't be
+// connected to.
+func isOverloadSignal(err error) bool {
+	var overloadErr *OverloadError
+	var transportErr *transportError
+	return errors.As(err, &overloadErr) || errors.As(err, &transportErr)
+}
+
+// circuitBreaker stops requests from being sent to an SM-DP+ that keeps
+// signalling that it is overloaded.  It also holds requests back for as
+// long as the SM-DP+ has asked us to, using Retry-After.
+type circuitBreaker struct {
+	mutex        sync.Mutex
+	threshold    int
+	openDuration time.Duration
+	failures     int
+	openUntil    time.Time
+	backoffUntil time.Time
+	probing      bool
+	lastCause    string
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, openDuration: openDuration}
+}
+
+// wait returns when a request may be sent, after having waited out any
+// Retry-After period.  A BreakerOpenError is returned at once if the breaker
+// is open.  When the open period has passed, a single probe request is let
+// through; the breaker closes if it succeeds.  Returns true if the request
+// is the probe, in which case endProbe must be called when it is done,
+// however it ends.
+func (b *circuitBreaker) wait(ctx context.Context, profileVendor string) (bool, error) {
+	for {
+		b.mutex.Lock()
+		now := time.Now()
+		if b.failures >= b.threshold {
+			if now.Before(b.openUntil) || b.probing {
+				err := &BreakerOpenError{ProfileVendor: profileVendor, Until: b.openUntil, Cause: b.lastCause}
+				b.mutex.Unlock()
+				return false, err
+			}
+			b.probing = true
+			b.mutex.Unlock()
+			return true, nil
+		}
+		backoff := b.backoffUntil.Sub(now)
+		b.mutex.Unlock()
+
+		if backoff <= 0 {
+			return false, nil
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// endProbe lets another probe through, once the open period has passed,
+// if the probe didn't close the breaker.
+func (b *circuitBreaker) endProbe() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+}
+
+func (b *circuitBreaker) recordFailure(err error, retryAfter time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.failures++
+	b.lastCause = err.Error()
+
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+
+	if retryAfter > 0 && now.Add(retryAfter).After(b.backoffUntil) {
+		b.backoffUntil = now.Add(retryAfter)
+	}
+	if b.failures >= b.threshold {
+		openDuration := b.openDuration
+		if retryAfter > openDuration {
+			openDuration = retryAfter
+		}
+		b.openUntil = now.Add(openDuration)
+	}
+}
+
+// concurrencyLimiter bounds the number of requests in flight to an SM-DP+.
+// The limit is halved when the SM-DP+ signals overload, and grows by one
+// again for every "limit" successful requests, up to the configured max.
+type concurrencyLimiter struct {
+	mutex        sync.Mutex
+	max          int
+	limit        int
+	inFlight     int
+	successes    int
+	lastDecrease time.Time
+	released     chan struct{}
+}
+
+func newConcurrencyLimiter(max int) *concurrencyLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &concurrencyLimiter{max: max, limit: max, released: make(chan struct{})}
+}
+
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mutex.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mutex.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees the slot taken by acquire, and adjusts the limit depending on
+// whether the SM-DP+ signalled overload.  Returns the new limit if it changed.
+func (l *concurrencyLimiter) release(overloaded bool) (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inFlight--
+
+	changed := false
+	if overloaded {
+		l.successes = 0
+		now := time.Now()
+		if l.limit > 1 && now.Sub(l.lastDecrease) >= concurrencyDecreaseInterval {
+			l.limit /= 2
+			l.lastDecrease = now
+			changed = true
+		}
+	} else if l.limit < l.max {
+		l.successes++
+		if l.successes >= l.limit {
+			l.limit++
+			l.successes = 0
+			changed = true
+		}
+	}
+
+	close(l.released)
+	l.released = make(chan struct{})
+	return l.limit, changed
+}
+
+func (l *concurrencyLimiter) currentLimit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
+
+// executeGuarded sends a request through the circuit breaker and the
+// concurrency limiter.  Requests the SM-DP+ refused with HTTP 429 were not
+// processed, so they are sent again once the Retry-After period is over,
+// until they succeed or the breaker opens.  A state changing call answered
+// with HTTP 503 may have been acted on, so it is returned instead, and left
+// to executeStateChange to check the state of the profile before retrying
+// it.  Status queries change nothing, and are also sent again after a 503.
+func (client *ClientState) executeGuarded(ctx context.Context, es2plusCommand string, send func() error) error {
+	for {
+		retry, err := client.sendGuarded(ctx, send)
+		if !retry {
+			return err
+		}
+		if mayHaveBeenReceived(err) && es2plusCommand != "getProfileStatus" {
+			return err
+		}
+		var overloadErr *OverloadError
+		errors.As(err, &overloadErr)
+		log.Printf("ES2+ %s refused by overloaded SM-DP+ (HTTP %d), will retry\n", es2plusCommand, overloadErr.StatusCode)
+	}
+}
+
+// sendGuarded makes one attempt at sending a request through the circuit
+// breaker and the concurrency limiter.  Returns true if the SM-DP+ refused
+// it as overloaded, so that it may be sent again.
+func (client *ClientState) sendGuarded(ctx context.Context, send func() error) (bool, error) {
+	probe, err := client.breaker.wait(ctx, client.profileVendor)
+	if err != nil {
+		return false, notSent(err)
+	}
+	if probe {
+		defer client.breaker.endProbe()
+	}
+	if err := client.limiter.acquire(ctx); err != nil {
+		return false, notSent(err)
+	}
+
+	err = send()
+
+	// Errors caused by our own cancellation says nothing about the SM-DP+.
+	overloaded := ctx.Err() == nil && isOverloadSignal(err)
+	if limit, changed := client.limiter.release(overloaded); changed && overloaded {
+		log.Printf("SM-DP+ of '%s' is struggling (%s), reducing concurrency to %d\n", client.profileVendor, err, limit)
+	}
+
+	if !overloaded {
+		if ctx.Err() == nil {
+			client.breaker.recordSuccess()
+		}
+		return false, err
+	}
+
+	var overloadErr *OverloadError
+	if !errors.As(err, &overloadErr) {
+		client.breaker.recordFailure(err, 0)
+		return false, err
+	}
+	client.breaker.recordFailure(err, overloadErr.RetryAfter)
+	return true, err
+}
+
+// ConcurrencyLimit is the number of requests currently allowed to be in
+// flight to the SM-DP+.  It is lowered when the SM-DP+ is overloaded.
+func (client *ClientState) ConcurrencyLimit() int {
+	return client.limiter.currentLimit()
+}
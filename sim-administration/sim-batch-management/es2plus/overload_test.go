@@ -0,0 +1,184 @@
+package es2plus
+
+import (
+	"context"
+	"errors"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+}
+
+// newOverloadServer returns a server answering getProfileStatus with the
+// given state, unless the overload function has already answered.
+func newOverloadServer(state string, overload func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	handler := statusHandler(state)
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !overload(w, r) {
+			handler.ServeHTTP(w, r)
+		}
+	}))
+}
+
+func TestOverloadedRequestsAreRetriedAfterRetryAfter(t *testing.T) {
+	var requests int32
+	server := newOverloadServer("RELEASED", func(w http.ResponseWriter, r *http.Request) bool {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return true
+		}
+		return false
+	})
+	defer server.Close()
+
+	client := newTestClient(server)
+	start := time.Now()
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "RELEASED", status.State)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Assert(t, time.Since(start) >= time.Second)
+}
+
+func TestBreakerOpensAndProbesAfterOpenDuration(t *testing.T) {
+	var requests int32
+	overloaded := int32(1)
+	server := newOverloadServer("AVAILABLE", func(w http.ResponseWriter, r *http.Request) bool {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&overloaded) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	defer server.Close()
+
+	client := newTestClient(server)
+	client.profileVendor = "Durian"
+	client.breaker = newCircuitBreaker(3, 200*time.Millisecond)
+
+	// The request is retried until the breaker opens.
+	_, err := client.GetStatus(context.Background(), "8947000000000012141")
+	var breakerErr *BreakerOpenError
+	assert.Assert(t, errors.As(err, &breakerErr), err)
+	assert.ErrorContains(t, err, "HTTP 503")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// While open, nothing is sent.
+	_, err = client.GetStatus(context.Background(), "8947000000000012141")
+	assert.Assert(t, errors.As(err, &breakerErr))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// After the open duration a probe is let through, and closes the breaker.
+	atomic.StoreInt32(&overloaded, 0)
+	time.Sleep(250 * time.Millisecond)
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "AVAILABLE", status.State)
+	assert.Equal(t, 0, client.breaker.failures)
+}
+
+func TestOverloadedStateChangesAreCheckedBeforeRetrying(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", overloadConfirms: 10}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+
+	client := newRetryingClient(server, newMemoryPendingOperations())
+	client.breaker = newCircuitBreaker(3, time.Minute)
+
+	// Every 503 is followed by a status check, instead of by sending the
+	// call again right away until the breaker opens.
+	_, err := client.ConfirmOrder(context.Background(), "8947000000000012141")
+	var breakerErr *BreakerOpenError
+	assert.Assert(t, !errors.As(err, &breakerErr), err)
+	assert.ErrorContains(t, err, "unknown after 3 attempt(s)")
+	assert.Equal(t, 3, len(smdp.confirmCallIdentifiers))
+	assert.Equal(t, 2, smdp.statusRequests)
+}
+
+func TestCancelledProbeLetsAnotherProbeThrough(t *testing.T) {
+	server := newStatusServer("AVAILABLE")
+	defer server.Close()
+
+	client := newTestClient(server)
+	client.breaker = newCircuitBreaker(1, time.Millisecond)
+	client.breaker.recordFailure(errors.New("HTTP 503"), 0)
+	time.Sleep(5 * time.Millisecond)
+
+	// The probe is let through, but stopped before it is sent.
+	client.limiter = newConcurrencyLimiter(1)
+	assert.NilError(t, client.limiter.acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.GetStatus(ctx, "8947000000000012141")
+	assert.ErrorContains(t, err, "context deadline exceeded")
+	client.limiter.release(false)
+
+	status, err := client.GetStatus(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, "AVAILABLE", status.State)
+	assert.Equal(t, 0, client.breaker.failures)
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	breaker := newCircuitBreaker(1, time.Second)
+	start := time.Now()
+	breaker.recordFailure(errors.New("HTTP 503"), 30*24*time.Hour)
+	assert.Assert(t, breaker.backoffUntil.Before(start.Add(maxRetryAfter+time.Second)))
+	assert.Assert(t, breaker.openUntil.Before(start.Add(maxRetryAfter+time.Second)))
+}
+
+func TestActivateIccidOnlyReportsBreakerWhenNothingWasSent(t *testing.T) {
+	server := newStatusServer("AVAILABLE")
+	defer server.Close()
+
+	client := newTestClient(server)
+	client.breaker = newCircuitBreaker(1, time.Minute)
+	client.breaker.recordFailure(errors.New("HTTP 503"), 0)
+
+	_, err := client.ActivateIccid(context.Background(), "8947000000000012141")
+	var breakerErr *BreakerOpenError
+	assert.Assert(t, errors.As(err, &breakerErr))
+
+	assert.ErrorContains(t, interruptedByBreaker("8947000000000012141", err), "interrupted half way")
+	assert.Assert(t, !errors.As(interruptedByBreaker("8947000000000012141", err), &breakerErr))
+}
+
+func TestConcurrencyLimitShrinksOnOverloadAndGrowsBack(t *testing.T) {
+	limiter := newConcurrencyLimiter(8)
+	ctx := context.Background()
+
+	for i := 0; i < 8; i++ {
+		assert.NilError(t, limiter.acquire(ctx))
+	}
+
+	// A burst of errors from requests in flight at the same time halves the limit once.
+	for i := 0; i < 4; i++ {
+		limiter.release(true)
+	}
+	assert.Equal(t, 4, limiter.currentLimit())
+
+	// No more than the limit can be in flight.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.Assert(t, limiter.acquire(timeoutCtx) != nil)
+
+	// Successes make the limit grow again.
+	for i := 0; i < 4; i++ {
+		limiter.release(false)
+	}
+	assert.Equal(t, 5, limiter.currentLimit())
+}
@@ -0,0 +1,262 @@
+package es2plus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Defaults for the RetryPolicy.
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryDelay    = 2 * time.Second
+)
+
+// RetryPolicy says how often state changing ES2+ calls (downloadOrder,
+// confirmOrder, cancelOrder and recoverProfile) are sent when no answer
+// comes back from the SM-DP+, e.g. because the request timed out.  Every
+// attempt reuses the functionCallIdentifier of the first one, so that the
+// SM-DP+ can tell that it is a retry, and before every retry the status of
+// the profile is checked, so that a call that has already taken effect is
+// not sent again.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of times a call is sent, including the first.
+	MaxAttempts int
+
+	// Delay is the delay before the first retry.  It is doubled for every retry.
+	Delay time.Duration
+}
+
+// WithDefaults returns a copy of the policy where unset values are replaced by their defaults.
+func (policy RetryPolicy) WithDefaults() RetryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryAttempts
+	}
+	if policy.Delay <= 0 {
+		policy.Delay = DefaultRetryDelay
+	}
+	return policy
+}
+
+// PendingOperations is where the client keeps the state changing ES2+ calls
+// whose outcome is not yet known, so that they can be retried with the same
+// functionCallIdentifier also after the program has been restarted.
+type PendingOperations interface {
+	CreatePendingEs2Operation(op *model.PendingEs2Operation) error
+	GetPendingEs2Operation(profileVendor string, iccid string, es2Function string) (*model.PendingEs2Operation, error)
+	UpdatePendingEs2Operation(op *model.PendingEs2Operation) error
+	DeletePendingEs2Operation(id int64) error
+}
+
+// stateChange describes a state changing ES2+ call on a single profile.
+type stateChange struct {
+	es2Function string
+	iccid       string
+
+	// done tells, from the current status of the profile, whether the
+	// call has already taken effect.
+	done func(status *ProfileStatus) bool
+}
+
+// The states a profile can be in before downloadOrder and confirmOrder
+// have taken effect (SGP.22 / ES2+).
+var notDownloadOrdered = map[string]bool{"AVAILABLE": true}
+var notConfirmed = map[string]bool{"AVAILABLE": true, "ALLOCATED": true, "LINKED": true}
+
+func downloadOrderDone(status *ProfileStatus) bool {
+	return !notDownloadOrdered[status.State]
+}
+
+func confirmOrderDone(status *ProfileStatus) bool {
+	return !notConfirmed[status.State]
+}
+
+func inState(state string) func(status *ProfileStatus) bool {
+	return func(status *ProfileStatus) bool {
+		return status.State == state
+	}
+}
+
+// notSentError is an error that stopped a request before it was sent.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notSentError) Unwrap() error {
+	return e.err
+}
+
+// notSent marks an error as having stopped a request before it was sent.
+func notSent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &notSentError{err: err}
+}
+
+// mayHaveBeenReceived tells if the SM-DP+ may have received, and acted on, a
+// request that failed with this error.  Once a request has been sent that is
+// always the case, whether no response came back, the response was an HTTP
+// error, or it couldn't be understood.  Only requests that were never sent,
+// e.g. because the breaker was open, and requests the SM-DP+ refused with
+// HTTP 429 (Too Many Requests), are known not to have been acted on.
+func mayHaveBeenReceived(err error) bool {
+	var notSentErr *notSentError
+	if errors.As(err, &notSentErr) {
+		return false
+	}
+	var breakerErr *BreakerOpenError
+	if errors.As(err, &breakerErr) {
+		return false
+	}
+	var overloadErr *OverloadError
+	if errors.As(err, &overloadErr) {
+		return overloadErr.StatusCode != http.StatusTooManyRequests
+	}
+	return true
+}
+
+// executeStateChange sends a state changing ES2+ call according to the
+// client's retry policy.  The payload function builds the request from the
+// header.  If a retry finds that an earlier attempt, maybe made by an earlier
+// run, has already taken effect, nothing more is sent, true is returned and
+// the result is left empty.  Once an attempt may have been received, the
+// operation is left pending if it is stopped, and a BreakerOpenError is not
+// returned as such, since that would say that nothing was sent.
+func (client *ClientState) executeStateChange(
+	ctx context.Context,
+	change stateChange,
+	payload func(header Header) interface{},
+	result interface{}) (bool, error) {
+
+	pending, resumed, err := client.pendingOperation(change)
+	if err != nil {
+		return false, err
+	}
+
+	header := Header{FunctionCallIdentifier: pending.FunctionCallIdentifier, FunctionrequesterIDentifier: client.RequesterID()}
+	delay := client.retryPolicy.Delay
+	checkFirst := resumed
+	maybeSent := resumed
+
+	for attempt := 1; ; attempt++ {
+		if checkFirst {
+			status, err := client.GetStatus(ctx, change.iccid)
+			if err != nil {
+				return false, leftPending(change, pending, err)
+			}
+			if status != nil && change.done(status) {
+				log.Printf("ES2+ %s %s for ICCID '%s' has already taken effect (state %s), not sending it again\n",
+					change.es2Function, pending.FunctionCallIdentifier, change.iccid, status.State)
+				client.forgetPendingOperation(pending)
+				return true, nil
+			}
+			log.Printf("Retrying ES2+ %s %s for ICCID '%s' (state %s)\n", change.es2Function, pending.FunctionCallIdentifier, change.iccid, describeState(status))
+		}
+
+		err = client.execute(ctx, change.es2Function, payload(header), result)
+		if err != nil && !mayHaveBeenReceived(err) && maybeSent {
+			// Nothing was sent this time, but an earlier attempt may have been received.
+			return false, leftPending(change, pending, err)
+		}
+		if err == nil || !mayHaveBeenReceived(err) {
+			client.forgetPendingOperation(pending)
+			return false, err
+		}
+
+		maybeSent = true
+		pending.Attempts++
+		pending.LastError = err.Error()
+		client.updatePendingOperation(pending)
+
+		if ctx.Err() != nil || attempt >= client.retryPolicy.MaxAttempts {
+			return false, fmt.Errorf("outcome of ES2+ %s %s for ICCID '%s' unknown after %d attempt(s), it will be checked and retried by the next run: %s",
+				change.es2Function, pending.FunctionCallIdentifier, change.iccid, attempt, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		delay *= 2
+		checkFirst = true
+	}
+}
+
+// leftPending is the error for a state change that was stopped after an
+// earlier attempt may have been received.  It doesn't wrap the cause, so
+// that it can't be taken for a BreakerOpenError.
+func leftPending(change stateChange, pending *model.PendingEs2Operation, err error) error {
+	return fmt.Errorf("ES2+ %s %s for ICCID '%s' may have been received, it will be checked and retried by the next run: %s",
+		change.es2Function, pending.FunctionCallIdentifier, change.iccid, err)
+}
+
+func describeState(status *ProfileStatus) string {
+	if status == nil {
+		return "unknown"
+	}
+	return status.State
+}
+
+// pendingOperation returns the pending operation for a state change, and
+// whether it was left pending by an earlier attempt.  A new one, with a new
+// functionCallIdentifier, is made and stored if there is none.
+func (client *ClientState) pendingOperation(change stateChange) (*model.PendingEs2Operation, bool, error) {
+	if client.pending != nil {
+		op, err := client.pending.GetPendingEs2Operation(client.profileVendor, change.iccid, change.es2Function)
+		if err != nil {
+			return nil, false, err
+		}
+		if op != nil {
+			return op, true, nil
+		}
+	}
+
+	functionCallIdentifier, err := newUUID()
+	if err != nil {
+		return nil, false, err
+	}
+	op := &model.PendingEs2Operation{
+		ProfileVendor:          client.profileVendor,
+		Iccid:                  change.iccid,
+		Es2Function:            change.es2Function,
+		FunctionCallIdentifier: functionCallIdentifier,
+		Created:                time.Now().UTC().Format(time.RFC3339),
+	}
+	if client.pending != nil {
+		if err := client.pending.CreatePendingEs2Operation(op); err != nil {
+			return nil, false, err
+		}
+	}
+	return op, false, nil
+}
+
+func (client *ClientState) updatePendingOperation(op *model.PendingEs2Operation) {
+	if client.pending == nil {
+		return
+	}
+	if err := client.pending.UpdatePendingEs2Operation(op); err != nil {
+		log.Printf("ERROR: Couldn't update pending ES2+ %s %s: %s\n", op.Es2Function, op.FunctionCallIdentifier, err)
+	}
+}
+
+// forgetPendingOperation deletes a pending operation once its outcome is known.
+// Failing to do so is logged, but doesn't fail the operation; the next run
+// will find that it has taken effect when it checks the profile status.
+func (client *ClientState) forgetPendingOperation(op *model.PendingEs2Operation) {
+	if client.pending == nil || op.ID == 0 {
+		return
+	}
+	if err := client.pending.DeletePendingEs2Operation(op.ID); err != nil {
+		log.Printf("ERROR: Couldn't delete pending ES2+ %s %s: %s\n", op.Es2Function, op.FunctionCallIdentifier, err)
+	}
+}
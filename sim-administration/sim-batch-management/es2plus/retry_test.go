@@ -0,0 +1,266 @@
+package es2plus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryPendingOperations struct {
+	mutex  sync.Mutex
+	nextID int64
+	ops    map[int64]*model.PendingEs2Operation
+}
+
+func newMemoryPendingOperations() *memoryPendingOperations {
+	return &memoryPendingOperations{ops: make(map[int64]*model.PendingEs2Operation)}
+}
+
+func (m *memoryPendingOperations) CreatePendingEs2Operation(op *model.PendingEs2Operation) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nextID++
+	op.ID = m.nextID
+	stored := *op
+	m.ops[op.ID] = &stored
+	return nil
+}
+
+func (m *memoryPendingOperations) GetPendingEs2Operation(profileVendor string, iccid string, es2Function string) (*model.PendingEs2Operation, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, op := range m.ops {
+		if op.ProfileVendor == profileVendor && op.Iccid == iccid && op.Es2Function == es2Function {
+			found := *op
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryPendingOperations) UpdatePendingEs2Operation(op *model.PendingEs2Operation) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stored := *op
+	m.ops[op.ID] = &stored
+	return nil
+}
+
+func (m *memoryPendingOperations) DeletePendingEs2Operation(id int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.ops, id)
+	return nil
+}
+
+// fakeSmdp is an SM-DP+ holding the state of a single profile.  It drops
+// the connection instead of answering the first dropConfirms confirmOrder
+// requests, optionally after having acted on them, acts on the first
+// failConfirms ones but answers them with an HTTP error page, and answers
+// the first overloadConfirms ones with HTTP 503 without acting on them.
+type fakeSmdp struct {
+	mutex                  sync.Mutex
+	state                  string
+	dropConfirms           int
+	actOnDropped           bool
+	failConfirms           int
+	overloadConfirms       int
+	onStatus               func()
+	confirmCallIdentifiers []string
+	statusRequests         int
+}
+
+func (smdp *fakeSmdp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	smdp.mutex.Lock()
+	defer smdp.mutex.Unlock()
+
+	response := es2ProfileStatusResponse{}
+	response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Executed-Success"
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/getProfileStatus"):
+		smdp.statusRequests++
+		if smdp.onStatus != nil {
+			smdp.onStatus()
+		}
+		response.ProfileStatusList = []ProfileStatus{{Iccid: "8947000000000012141", State: smdp.state}}
+	case strings.HasSuffix(r.URL.Path, "/confirmOrder"):
+		var request ConfirmOrderRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		smdp.confirmCallIdentifiers = append(smdp.confirmCallIdentifiers, request.Header.FunctionCallIdentifier)
+		if smdp.dropConfirms > 0 {
+			smdp.dropConfirms--
+			if smdp.actOnDropped {
+				smdp.state = "RELEASED"
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if smdp.failConfirms > 0 {
+			smdp.failConfirms--
+			smdp.state = "RELEASED"
+			http.Error(w, "<html>Internal Server Error</html>", http.StatusInternalServerError)
+			return
+		}
+		if smdp.overloadConfirms > 0 {
+			smdp.overloadConfirms--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		smdp.state = "RELEASED"
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func newRetryingClient(server *httptest.Server, pending PendingOperations) *ClientState {
+	client := newTestClient(server)
+	client.profileVendor = "Durian"
+	client.pending = pending
+	client.retryPolicy = RetryPolicy{MaxAttempts: 3, Delay: 10 * time.Millisecond}
+	return client
+}
+
+func TestRetryReusesFunctionCallIdentifier(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", dropConfirms: 1}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+
+	pending := newMemoryPendingOperations()
+	_, err := newRetryingClient(server, pending).ConfirmOrder(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+
+	assert.Equal(t, 2, len(smdp.confirmCallIdentifiers))
+	assert.Equal(t, smdp.confirmCallIdentifiers[0], smdp.confirmCallIdentifiers[1])
+	assert.Equal(t, 1, smdp.statusRequests)
+	assert.Equal(t, 0, len(pending.ops))
+}
+
+func TestRetryIsNotSentWhenFirstAttemptTookEffect(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", dropConfirms: 1, actOnDropped: true}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+
+	pending := newMemoryPendingOperations()
+	_, err := newRetryingClient(server, pending).ConfirmOrder(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+
+	assert.Equal(t, 1, len(smdp.confirmCallIdentifiers))
+	assert.Equal(t, 0, len(pending.ops))
+}
+
+func TestUnknownOutcomeIsPersistedAndResumedByNextRun(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", dropConfirms: 3}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+
+	pending := newMemoryPendingOperations()
+	_, err := newRetryingClient(server, pending).ConfirmOrder(context.Background(), "8947000000000012141")
+	assert.ErrorContains(t, err, "unknown after 3 attempt(s)")
+
+	op, _ := pending.GetPendingEs2Operation("Durian", "8947000000000012141", "confirmOrder")
+	assert.Assert(t, op != nil)
+	assert.Equal(t, 3, op.Attempts)
+	assert.Equal(t, smdp.confirmCallIdentifiers[0], op.FunctionCallIdentifier)
+
+	// A new client, as in the next run, checks the status first and then
+	// sends the call again with the same identifier.
+	statusRequestsBefore := smdp.statusRequests
+	_, err = newRetryingClient(server, pending).ConfirmOrder(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, statusRequestsBefore+1, smdp.statusRequests)
+	assert.Equal(t, 4, len(smdp.confirmCallIdentifiers))
+	assert.Equal(t, op.FunctionCallIdentifier, smdp.confirmCallIdentifiers[3])
+	assert.Equal(t, 0, len(pending.ops))
+}
+
+func TestDefinitiveAnswersAreNotRetried(t *testing.T) {
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		response := es2ProfileStatusResponse{}
+		response.Header.FunctionExecutionStatus.FunctionExecutionStatusType = "Failed"
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	pending := newMemoryPendingOperations()
+	_, err := newRetryingClient(server, pending).DownloadOrder(context.Background(), "8947000000000012141")
+	assert.ErrorContains(t, err, "Failed")
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 0, len(pending.ops))
+}
+
+func TestServerErrorsAreCheckedBeforeRetrying(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", failConfirms: 1}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+	pending := newMemoryPendingOperations()
+
+	_, err := newRetryingClient(server, pending).ConfirmOrder(context.Background(), "8947000000000012141")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(smdp.confirmCallIdentifiers))
+	assert.Equal(t, 1, smdp.statusRequests)
+	assert.Equal(t, 0, len(pending.ops))
+}
+
+func TestBreakerOpeningAfterAnOverloadedConfirmKeepsItPending(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", overloadConfirms: 1}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+	pending := newMemoryPendingOperations()
+
+	client := newRetryingClient(server, pending)
+	client.breaker = newCircuitBreaker(1, time.Minute)
+	_, err := client.ConfirmOrder(context.Background(), "8947000000000012141")
+
+	// The 503 may have been acted on, so the breaker opening before the
+	// retry must not look like nothing was sent.
+	var breakerErr *BreakerOpenError
+	assert.Assert(t, !errors.As(err, &breakerErr), err)
+	assert.ErrorContains(t, err, "will be checked and retried by the next run")
+	assert.Equal(t, 1, len(smdp.confirmCallIdentifiers))
+	op, _ := pending.GetPendingEs2Operation("Durian", "8947000000000012141", "confirmOrder")
+	assert.Assert(t, op != nil)
+	assert.Equal(t, smdp.confirmCallIdentifiers[0], op.FunctionCallIdentifier)
+}
+
+func TestCancelledRetryKeepsItPending(t *testing.T) {
+	smdp := &fakeSmdp{state: "ALLOCATED", overloadConfirms: 1}
+	server := httptest.NewTLSServer(smdp)
+	defer server.Close()
+	pending := newMemoryPendingOperations()
+
+	// The status check before the retry goes through, but the retry
+	// itself is held back until the context is done.
+	client := newRetryingClient(server, pending)
+	smdp.onStatus = func() {
+		client.breaker.mutex.Lock()
+		defer client.breaker.mutex.Unlock()
+		client.breaker.backoffUntil = time.Now().Add(time.Minute)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := client.ConfirmOrder(ctx, "8947000000000012141")
+	assert.ErrorContains(t, err, "context deadline exceeded")
+	assert.ErrorContains(t, err, "will be checked and retried by the next run")
+	assert.Equal(t, 1, len(smdp.confirmCallIdentifiers))
+	assert.Equal(t, 1, smdp.statusRequests)
+	assert.Equal(t, 1, len(pending.ops))
+}
+
+func TestMayHaveBeenReceived(t *testing.T) {
+	assert.Assert(t, mayHaveBeenReceived(errors.New("couldn't parse confirmOrder response")))
+	assert.Assert(t, mayHaveBeenReceived(&OverloadError{StatusCode: http.StatusServiceUnavailable}))
+	assert.Assert(t, !mayHaveBeenReceived(&OverloadError{StatusCode: http.StatusTooManyRequests}))
+	assert.Assert(t, !mayHaveBeenReceived(&BreakerOpenError{}))
+	assert.Assert(t, !mayHaveBeenReceived(notSent(context.Canceled)))
+}
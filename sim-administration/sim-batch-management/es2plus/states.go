@@ -0,0 +1,75 @@
+package es2plus
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile states, as reported by getProfileStatus (SGP.22).
+const (
+	StateAvailable   = "AVAILABLE"
+	StateAllocated   = "ALLOCATED"
+	StateLinked      = "LINKED"
+	StateConfirmed   = "CONFIRMED"
+	StateReleased    = "RELEASED"
+	StateDownloaded  = "DOWNLOADED"
+	StateInstalled   = "INSTALLED"
+	StateError       = "ERROR"
+	StateUnavailable = "UNAVAILABLE"
+)
+
+// States are all the profile states.
+var States = []string{StateAvailable, StateAllocated, StateLinked, StateConfirmed, StateReleased, StateDownloaded, StateInstalled, StateError, StateUnavailable}
+
+// CancelOrderFinalStates are the final profile states cancelOrder can
+// leave a profile in.
+var CancelOrderFinalStates = []string{StateAvailable, StateUnavailable}
+
+// CancelOrderFromStates are the states a profile must be in for its
+// order to be cancelled.
+var CancelOrderFromStates = []string{StateAllocated, StateLinked, StateConfirmed, StateReleased}
+
+// RecoverProfileTargetStates are the states recoverProfile can set a
+// profile to.
+var RecoverProfileTargetStates = []string{StateAvailable, StateAllocated, StateLinked, StateConfirmed, StateReleased, StateUnavailable}
+
+func contains(states []string, state string) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTargetState returns an error if the target state is not one of the legal ones.
+func CheckTargetState(target string, legal []string) error {
+	if !contains(legal, target) {
+		return fmt.Errorf("target ES2+ state unexpected, legal value(s) is(are): '%s'", strings.Join(legal, "', '"))
+	}
+	return nil
+}
+
+// CheckCancelOrder returns an error if the order of a profile in the current
+// state can't be cancelled, leaving it in the target state.
+func CheckCancelOrder(current string, target string) error {
+	if err := CheckTargetState(target, CancelOrderFinalStates); err != nil {
+		return err
+	}
+	if !contains(CancelOrderFromStates, current) {
+		return fmt.Errorf("can't cancel the order of a profile in state %s, only in state %s", current, strings.Join(CancelOrderFromStates, ", "))
+	}
+	return nil
+}
+
+// CheckRecoverProfile returns an error if a profile in the current state
+// can't be recovered to the target state.
+func CheckRecoverProfile(current string, target string) error {
+	if err := CheckTargetState(target, RecoverProfileTargetStates); err != nil {
+		return err
+	}
+	if current == target {
+		return fmt.Errorf("profile is already in state %s", target)
+	}
+	return nil
+}
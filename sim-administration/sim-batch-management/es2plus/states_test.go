@@ -0,0 +1,19 @@
+package es2plus
+
+import (
+	"gotest.tools/assert"
+	"testing"
+)
+
+func TestCancelOrderStates(t *testing.T) {
+	assert.NilError(t, CheckCancelOrder(StateReleased, StateUnavailable))
+	assert.NilError(t, CheckCancelOrder(StateAllocated, StateAvailable))
+	assert.ErrorContains(t, CheckCancelOrder(StateInstalled, StateAvailable), "can't cancel the order")
+	assert.ErrorContains(t, CheckCancelOrder(StateReleased, StateLinked), "legal value(s) is(are): 'AVAILABLE', 'UNAVAILABLE'")
+}
+
+func TestRecoverProfileStates(t *testing.T) {
+	assert.NilError(t, CheckRecoverProfile(StateError, StateReleased))
+	assert.ErrorContains(t, CheckRecoverProfile(StateReleased, StateReleased), "already in state RELEASED")
+	assert.ErrorContains(t, CheckRecoverProfile(StateError, StateInstalled), "target ES2+ state unexpected")
+}
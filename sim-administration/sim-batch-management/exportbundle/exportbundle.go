@@ -0,0 +1,430 @@
+// Package exportbundle writes and checks export bundles, the directories the
+// files for an HSS or prime are sent in.  A bundle has a manifest telling
+// what batch the files are for, how many records they hold and their
+// SHA-256, and the manifest is signed with the operator's ed25519 key, so
+// that the recipient can check that the files came from us unaltered.
+//
+// The files can also be encrypted to the recipient's RSA public key.  Every
+// file is then encrypted with AES-256-GCM, using a key that is in the
+// manifest, encrypted with RSA-OAEP (SHA-256).
+package exportbundle
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The names of the manifest and its signature in a bundle.
+const (
+	ManifestFileName  = "manifest.json"
+	SignatureFileName = "manifest.sig"
+)
+
+// EncryptionAlgorithm names how encrypted bundles are encrypted.
+const EncryptionAlgorithm = "RSA-OAEP-SHA256/AES-256-GCM"
+
+// The suffix of encrypted files.
+const encryptedSuffix = ".enc"
+
+// Content is a file to put in a bundle.
+type Content struct {
+	Name    string
+	Records int
+	Data    []byte
+}
+
+// File describes a file in a bundle.
+type File struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Size    int64  `json:"size"`
+	Sha256  string `json:"sha256"`
+
+	// PlaintextSha256 is the SHA-256 of the file before it was
+	// encrypted, only set for encrypted files.
+	PlaintextSha256 string `json:"plaintextSha256,omitempty"`
+}
+
+// Encryption tells how the files of a bundle are encrypted.
+type Encryption struct {
+	Algorithm          string `json:"algorithm"`
+	RecipientKeySha256 string `json:"recipientKeySha256"`
+
+	// WrappedKey is the AES key, encrypted to the recipient's key, in base64.
+	WrappedKey string `json:"wrappedKey"`
+}
+
+// Manifest describes a bundle.
+type Manifest struct {
+	BatchName       string      `json:"batchName"`
+	HssVendor       string      `json:"hssVendor,omitempty"`
+	HssFormat       string      `json:"hssFormat,omitempty"`
+	ProfileCount    int         `json:"profileCount"`
+	Created         string      `json:"created"`
+	Operator        string      `json:"operator"`
+	SignerKeySha256 string      `json:"signerKeySha256"`
+	Encryption      *Encryption `json:"encryption,omitempty"`
+	Files           []File      `json:"files"`
+}
+
+// Create writes a bundle with the contents to a new directory.  The
+// manifest is filled in with the files, and signed.  If recipient isn't nil
+// the files are encrypted to it.
+func Create(dir string, manifest Manifest, contents []Content, signer ed25519.PrivateKey, recipient *rsa.PublicKey, random io.Reader) (*Manifest, error) {
+	signerKeySha256, err := KeySha256(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	manifest.SignerKeySha256 = signerKeySha256
+	manifest.Files = nil
+
+	var aead cipher.AEAD
+	if recipient != nil {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(random, key); err != nil {
+			return nil, err
+		}
+		wrappedKey, err := rsa.EncryptOAEP(sha256.New(), random, recipient, key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encrypt the bundle key to the recipient's key: %v", err)
+		}
+		recipientKeySha256, err := KeySha256(recipient)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Encryption = &Encryption{
+			Algorithm:          EncryptionAlgorithm,
+			RecipientKeySha256: recipientKeySha256,
+			WrappedKey:         base64.StdEncoding.EncodeToString(wrappedKey),
+		}
+		if aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create bundle directory: %v", err)
+	}
+	written, err := writeBundle(dir, manifest, contents, signer, aead, random)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return written, nil
+}
+
+// writeBundle writes the files, encrypted if aead isn't nil, and the signed
+// manifest for them.
+func writeBundle(dir string, manifest Manifest, contents []Content, signer ed25519.PrivateKey, aead cipher.AEAD, random io.Reader) (*Manifest, error) {
+	for _, content := range contents {
+		if !isPlainFileName(content.Name) {
+			return nil, fmt.Errorf("not a valid file name in a bundle: '%s'", content.Name)
+		}
+		file := File{Name: content.Name, Records: content.Records}
+		data := content.Data
+		if aead != nil {
+			file.Name += encryptedSuffix
+			file.PlaintextSha256 = sha256Hex(data)
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := io.ReadFull(random, nonce); err != nil {
+				return nil, err
+			}
+			data = aead.Seal(nonce, nonce, data, []byte(file.Name))
+		}
+		file.Size = int64(len(data))
+		file.Sha256 = sha256Hex(data)
+		if err := ioutil.WriteFile(filepath.Join(dir, file.Name), data, 0600); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	manifestJSON = append(manifestJSON, '\n')
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(signer, manifestJSON))
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestFileName), manifestJSON, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, SignatureFileName), []byte(signature+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Verify checks that the manifest of a bundle is signed with the signer's
+// key, and that the bundle holds exactly the files in the manifest, unaltered.
+func Verify(dir string, signer ed25519.PublicKey) (*Manifest, error) {
+	manifestJSON, err := ioutil.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	encodedSignature, err := ioutil.ReadFile(filepath.Join(dir, SignatureFileName))
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedSignature)))
+	if err != nil {
+		return nil, fmt.Errorf("the manifest signature is not base64: %v", err)
+	}
+	if !ed25519.Verify(signer, manifestJSON, signature) {
+		return nil, fmt.Errorf("the manifest is not signed by the signer's key")
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, fmt.Errorf("couldn't parse the manifest: %v", err)
+	}
+
+	expected := map[string]bool{ManifestFileName: true, SignatureFileName: true}
+	for _, file := range manifest.Files {
+		if !isPlainFileName(file.Name) {
+			return nil, fmt.Errorf("not a valid file name in a bundle: '%s'", file.Name)
+		}
+		expected[file.Name] = true
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != file.Size || sha256Hex(data) != file.Sha256 {
+			return nil, fmt.Errorf("the file '%s' is not the one in the manifest", file.Name)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var unexpected []string
+	for _, info := range infos {
+		if !expected[info.Name()] {
+			unexpected = append(unexpected, info.Name())
+		}
+	}
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		return nil, fmt.Errorf("files not in the manifest: %s", strings.Join(unexpected, ", "))
+	}
+	return &manifest, nil
+}
+
+// Open returns the contents of a verified bundle, decrypted with the
+// recipient's key if the bundle is encrypted.
+func Open(dir string, manifest *Manifest, recipient *rsa.PrivateKey) ([]Content, error) {
+	var aead cipher.AEAD
+	if manifest.Encryption != nil {
+		if recipient == nil {
+			return nil, fmt.Errorf("the bundle is encrypted, a key to decrypt it with is needed")
+		}
+		if manifest.Encryption.Algorithm != EncryptionAlgorithm {
+			return nil, fmt.Errorf("unknown bundle encryption algorithm '%s'", manifest.Encryption.Algorithm)
+		}
+		wrappedKey, err := base64.StdEncoding.DecodeString(manifest.Encryption.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("the wrapped key is not base64: %v", err)
+		}
+		key, err := rsa.DecryptOAEP(sha256.New(), nil, recipient, wrappedKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decrypt the bundle key, is the bundle encrypted to this key? %v", err)
+		}
+		if aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+
+	var contents []Content
+	for _, file := range manifest.Files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name))
+		if err != nil {
+			return nil, err
+		}
+		name := file.Name
+		if aead != nil {
+			if len(data) < aead.NonceSize() {
+				return nil, fmt.Errorf("the file '%s' is too short to be encrypted", file.Name)
+			}
+			nonce := data[:aead.NonceSize()]
+			if data, err = aead.Open(nil, nonce, data[aead.NonceSize():], []byte(file.Name)); err != nil {
+				return nil, fmt.Errorf("couldn't decrypt the file '%s': %v", file.Name, err)
+			}
+			if sha256Hex(data) != file.PlaintextSha256 {
+				return nil, fmt.Errorf("the decrypted file '%s' is not the one in the manifest", file.Name)
+			}
+			name = strings.TrimSuffix(name, encryptedSuffix)
+		}
+		contents = append(contents, Content{Name: name, Records: file.Records, Data: data})
+	}
+	return contents, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isPlainFileName is true for names of files directly in the bundle
+// directory, that aren't the manifest or its signature.
+func isPlainFileName(name string) bool {
+	return name != "" && name != "." && name != ".." &&
+		!strings.ContainsAny(name, `/\`) &&
+		name != ManifestFileName && name != SignatureFileName
+}
+
+//
+// Keys
+//
+
+// KeySha256 returns the SHA-256 of the DER encoding of a public key, the
+// fingerprint keys are identified by in manifests.
+func KeySha256(key interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return sha256Hex(der), nil
+}
+
+// GenerateSigningKey generates an ed25519 key, and returns the private key
+// in PKCS #8 and the public key in PKIX, both PEM encoded.
+func GenerateSigningKey(random io.Reader) ([]byte, []byte, error) {
+	public, private, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}),
+		nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in '%s'", path)
+	}
+	return block, nil
+}
+
+// ReadSigningKey reads an ed25519 private key from a PKCS #8 PEM file.
+func ReadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key in '%s': %v", path, err)
+	}
+	signer, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the key in '%s' is not an ed25519 key", path)
+	}
+	return signer, nil
+}
+
+// ReadVerifyingKey reads an ed25519 public key from a PEM file.
+func ReadVerifyingKey(path string) (ed25519.PublicKey, error) {
+	key, err := readPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	verifier, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the key in '%s' is not an ed25519 key", path)
+	}
+	return verifier, nil
+}
+
+// ReadRecipientKey reads an RSA public key from a PEM file, with either the
+// key or a certificate for it.
+func ReadRecipientKey(path string) (*rsa.PublicKey, error) {
+	key, err := readPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	recipient, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the key in '%s' is not an RSA key", path)
+	}
+	return recipient, nil
+}
+
+func readPublicKey(path string) (interface{}, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse certificate in '%s': %v", path, err)
+		}
+		return certificate.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse public key in '%s': %v", path, err)
+		}
+		return key, nil
+	}
+}
+
+// ReadRecipientPrivateKey reads an RSA private key from a PEM file, in
+// PKCS #1 or PKCS #8.
+func ReadRecipientPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse private key in '%s': %v", path, err)
+	}
+	recipient, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the key in '%s' is not an RSA key", path)
+	}
+	return recipient, nil
+}
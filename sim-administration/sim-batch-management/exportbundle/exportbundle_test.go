@@ -0,0 +1,155 @@
+package exportbundle
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testContents = []Content{
+	{Name: "b1.csv", Records: 2, Data: []byte("ICCID, IMSI, KI\n8947000000000012140, 242017100011213, 000102030405060708090a0b0c0d0e0f\n8947000000000012157, 242017100011214, 202122232425262728292a2b2c2d2e2f\n")},
+	{Name: "b1-prime.csv", Records: 2, Data: []byte("ICCID, IMSI, MSISDN, PROFILE\n8947000000000012140, 242017100011213, 4790000001, FOO\n8947000000000012157, 242017100011214, 4790000002, FOO\n")},
+}
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "exportbundle")
+	assert.NilError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func newSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+	return public, private
+}
+
+func TestCreateAndVerify(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	bundleDir := filepath.Join(dir, "bundle")
+	public, private := newSigningKey(t)
+
+	created, err := Create(bundleDir, Manifest{BatchName: "b1", ProfileCount: 2}, testContents, private, nil, rand.Reader)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(created.Files))
+	assert.Equal(t, "b1.csv", created.Files[0].Name)
+	assert.Equal(t, int64(len(testContents[0].Data)), created.Files[0].Size)
+
+	verified, err := Verify(bundleDir, public)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, created, verified)
+
+	contents, err := Open(bundleDir, verified, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, testContents, contents)
+
+	otherPublic, _ := newSigningKey(t)
+	_, err = Verify(bundleDir, otherPublic)
+	assert.ErrorContains(t, err, "the manifest is not signed by the signer's key")
+
+	_, err = Create(bundleDir, Manifest{BatchName: "b1"}, testContents, private, nil, rand.Reader)
+	assert.ErrorContains(t, err, "couldn't create bundle directory")
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	public, private := newSigningKey(t)
+
+	altered := filepath.Join(dir, "altered")
+	_, err := Create(altered, Manifest{BatchName: "b1"}, testContents, private, nil, rand.Reader)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(altered, "b1.csv"), []byte("ICCID, IMSI, KI\n"), 0600))
+	_, err = Verify(altered, public)
+	assert.ErrorContains(t, err, "the file 'b1.csv' is not the one in the manifest")
+
+	added := filepath.Join(dir, "added")
+	_, err = Create(added, Manifest{BatchName: "b1"}, testContents, private, nil, rand.Reader)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(added, "extra.csv"), []byte("x"), 0600))
+	_, err = Verify(added, public)
+	assert.ErrorContains(t, err, "files not in the manifest: extra.csv")
+
+	resigned := filepath.Join(dir, "resigned")
+	_, err = Create(resigned, Manifest{BatchName: "b1"}, testContents, private, nil, rand.Reader)
+	assert.NilError(t, err)
+	manifest, err := ioutil.ReadFile(filepath.Join(resigned, ManifestFileName))
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(resigned, ManifestFileName), append(manifest, ' '), 0600))
+	_, err = Verify(resigned, public)
+	assert.ErrorContains(t, err, "the manifest is not signed by the signer's key")
+}
+
+func TestEncryptedBundle(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+	bundleDir := filepath.Join(dir, "bundle")
+	public, private := newSigningKey(t)
+	recipient, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+
+	created, err := Create(bundleDir, Manifest{BatchName: "b1"}, testContents, private, &recipient.PublicKey, rand.Reader)
+	assert.NilError(t, err)
+	assert.Equal(t, EncryptionAlgorithm, created.Encryption.Algorithm)
+	assert.Equal(t, "b1.csv.enc", created.Files[0].Name)
+	stored, err := ioutil.ReadFile(filepath.Join(bundleDir, "b1.csv.enc"))
+	assert.NilError(t, err)
+	assert.Assert(t, string(stored) != string(testContents[0].Data))
+
+	verified, err := Verify(bundleDir, public)
+	assert.NilError(t, err)
+	_, err = Open(bundleDir, verified, nil)
+	assert.ErrorContains(t, err, "the bundle is encrypted")
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+	_, err = Open(bundleDir, verified, other)
+	assert.ErrorContains(t, err, "couldn't decrypt the bundle key")
+
+	contents, err := Open(bundleDir, verified, recipient)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, testContents, contents)
+}
+
+func TestKeyFiles(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	privatePEM, publicPEM, err := GenerateSigningKey(rand.Reader)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "signing.pem"), privatePEM, 0600))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "signing.pub.pem"), publicPEM, 0600))
+
+	signer, err := ReadSigningKey(filepath.Join(dir, "signing.pem"))
+	assert.NilError(t, err)
+	verifier, err := ReadVerifyingKey(filepath.Join(dir, "signing.pub.pem"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, signer.Public(), verifier)
+
+	_, err = ReadRecipientKey(filepath.Join(dir, "signing.pub.pem"))
+	assert.ErrorContains(t, err, "is not an RSA key")
+
+	recipient, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "recipient.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(recipient)}), 0600))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "recipient.pub.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&recipient.PublicKey)}), 0600))
+
+	recipientPublic, err := ReadRecipientKey(filepath.Join(dir, "recipient.pub.pem"))
+	assert.NilError(t, err)
+	assert.Equal(t, 0, recipientPublic.N.Cmp(recipient.N))
+	recipientPrivate, err := ReadRecipientPrivateKey(filepath.Join(dir, "recipient.pem"))
+	assert.NilError(t, err)
+	assert.Equal(t, 0, recipientPrivate.D.Cmp(recipient.D))
+
+	_, err = ReadSigningKey(filepath.Join(dir, "recipient.pem"))
+	assert.ErrorContains(t, err, "couldn't parse private key")
+}
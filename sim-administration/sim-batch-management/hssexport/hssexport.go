@@ -0,0 +1,357 @@
+// Package hssexport writes the files that HSSes are loaded with.  Different
+// HSSes want different layouts, so there is an exporter per file format, in
+// a registry keyed by the name of the format, and every HSS vendor a batch
+// can be declared with is mapped to the format its HSS is loaded with.
+// Every exporter declares the fields it needs, and the profiles are checked
+// for them before anything is written.
+package hssexport
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/fieldsyntaxchecks"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The fields exporters can need.
+const (
+	FieldIccid  = "ICCID"
+	FieldImsi   = "IMSI"
+	FieldMsisdn = "MSISDN"
+	FieldKi     = "KI"
+	FieldOpc    = "OPC"
+)
+
+// The AMF and algorithm written by the exporters that need them.  All our
+// profiles use Milenage with the default AMF.
+const (
+	DefaultAmf       = "8000"
+	DefaultAlgorithm = "MILENAGE"
+)
+
+// Exporter writes the HSS file for the profiles of a batch.
+type Exporter interface {
+	// RequiredFields are the fields that must be present and valid in
+	// every profile.
+	RequiredFields() []string
+
+	// FileExtension is the extension of the files written, e.g. ".csv".
+	FileExtension() string
+
+	// Write writes the file.  The profiles have been validated.
+	Write(writer io.Writer, batch *model.Batch, entries []model.SimEntry) error
+}
+
+var (
+	formats    = make(map[string]Exporter)
+	hssVendors = make(map[string]string)
+)
+
+// RegisterFormat makes an exporter available for a file format.  Registering
+// two exporters for the same format is a programming error.
+func RegisterFormat(format string, exporter Exporter) {
+	if _, found := formats[format]; found {
+		panic(fmt.Sprintf("an HSS exporter is already registered for format '%s'", format))
+	}
+	formats[format] = exporter
+}
+
+// RegisterHssVendor tells which format the HSS of an HSS vendor is loaded
+// with.  The format must be registered, and an HSS vendor can only be
+// registered once.
+func RegisterHssVendor(hssVendor string, format string) {
+	if _, found := formats[format]; !found {
+		panic(fmt.Sprintf("no HSS exporter for format '%s', for HSS vendor '%s'", format, hssVendor))
+	}
+	if _, found := hssVendors[hssVendor]; found {
+		panic(fmt.Sprintf("HSS vendor '%s' is already registered", hssVendor))
+	}
+	hssVendors[hssVendor] = format
+}
+
+// Formats returns the formats there are exporters for, sorted.
+func Formats() []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HssVendors returns the HSS vendors there are formats for, sorted.
+func HssVendors() []string {
+	var names []string
+	for name := range hssVendors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatOfHssVendor returns the format the HSS of an HSS vendor is loaded with.
+func FormatOfHssVendor(hssVendor string) (string, error) {
+	format, found := hssVendors[hssVendor]
+	if !found {
+		return "", fmt.Errorf("no HSS format for HSS vendor '%s', should be one of %s, or give the format", hssVendor, strings.Join(HssVendors(), ", "))
+	}
+	return format, nil
+}
+
+// ForFormat returns the exporter for a format.
+func ForFormat(format string) (Exporter, error) {
+	exporter, found := formats[format]
+	if !found {
+		return nil, fmt.Errorf("no HSS exporter for format '%s', should be one of %s", format, strings.Join(Formats(), ", "))
+	}
+	return exporter, nil
+}
+
+// ForHssVendor returns the exporter for the format the HSS of an HSS vendor
+// is loaded with.
+func ForHssVendor(hssVendor string) (Exporter, error) {
+	format, err := FormatOfHssVendor(hssVendor)
+	if err != nil {
+		return nil, err
+	}
+	return ForFormat(format)
+}
+
+func init() {
+	RegisterFormat("csv", &csvExporter{fields: []string{FieldIccid, FieldImsi, FieldKi}})
+	RegisterFormat("milenage-csv", &csvExporter{fields: []string{FieldIccid, FieldImsi, FieldKi, FieldOpc}, amfAndAlgorithm: true})
+	RegisterFormat("fixed-width", &fixedWidthExporter{})
+	RegisterFormat("xml", &xmlExporter{})
+
+	RegisterHssVendor("M1", "csv")
+}
+
+// fieldValue returns the value of a field of a profile.  The ICCID is the
+// one with the Luhn checksum.
+func fieldValue(entry *model.SimEntry, field string) string {
+	switch field {
+	case FieldIccid:
+		return entry.IccidWithChecksum
+	case FieldImsi:
+		return entry.Imsi
+	case FieldMsisdn:
+		return entry.Msisdn
+	case FieldKi:
+		return entry.Ki
+	case FieldOpc:
+		return entry.Opc
+	}
+	return ""
+}
+
+func isKey(s string) bool {
+	key, err := hex.DecodeString(s)
+	return err == nil && len(key) == 16
+}
+
+var fieldSyntax = map[string]func(string) bool{
+	FieldIccid:  fieldsyntaxchecks.IsICCID,
+	FieldImsi:   fieldsyntaxchecks.IsIMSI,
+	FieldMsisdn: fieldsyntaxchecks.IsMSISDN,
+	FieldKi:     isKey,
+	FieldOpc:    isKey,
+}
+
+// Validate checks that all the profiles have valid values for the fields the
+// exporter needs.  The error tells about the first few profiles that don't.
+func Validate(exporter Exporter, entries []model.SimEntry) error {
+	const maxReported = 5
+	var problems []string
+	invalid := 0
+	for i := range entries {
+		for _, field := range exporter.RequiredFields() {
+			value := fieldValue(&entries[i], field)
+			problem := ""
+			switch {
+			case value == "":
+				problem = "no " + field
+			case !fieldSyntax[field](value):
+				problem = "invalid " + field
+			default:
+				continue
+			}
+			invalid++
+			if len(problems) < maxReported {
+				problems = append(problems, fmt.Sprintf("Iccid='%s' has %s", entries[i].Iccid, problem))
+			}
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d problems with the profiles: %s", invalid, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// WriteFile validates the profiles, and writes them to a new file.  An
+// existing file is never overwritten.
+func WriteFile(path string, exporter Exporter, batch *model.Batch, entries []model.SimEntry) error {
+	if err := Validate(exporter, entries); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("output file already exists.  '%s'", path)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't create hss file '%s', %v", path, err)
+	}
+	if err := exporter.Write(f, batch, entries); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("couldn't write to hss file '%s', %v", path, err)
+	}
+	return f.Close()
+}
+
+//
+// CSV
+//
+
+// csvExporter writes a line per profile with the fields, comma separated,
+// and optionally the AMF and algorithm.
+type csvExporter struct {
+	fields          []string
+	amfAndAlgorithm bool
+}
+
+func (exporter *csvExporter) RequiredFields() []string {
+	return exporter.fields
+}
+
+func (exporter *csvExporter) FileExtension() string {
+	return ".csv"
+}
+
+func (exporter *csvExporter) Write(writer io.Writer, batch *model.Batch, entries []model.SimEntry) error {
+	header := exporter.fields
+	if exporter.amfAndAlgorithm {
+		header = append(append([]string{}, header...), "AMF", "ALGORITHM")
+	}
+	if _, err := fmt.Fprintf(writer, "%s\n", strings.Join(header, ", ")); err != nil {
+		return err
+	}
+	for i := range entries {
+		var values []string
+		for _, field := range exporter.fields {
+			values = append(values, fieldValue(&entries[i], field))
+		}
+		if exporter.amfAndAlgorithm {
+			values = append(values, DefaultAmf, DefaultAlgorithm)
+		}
+		if _, err := fmt.Fprintf(writer, "%s\n", strings.Join(values, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Fixed width
+//
+
+// fixedWidthExporter writes a line per profile with the ICCID, IMSI, Ki and
+// OPc, each left aligned and padded with spaces to a fixed width.
+type fixedWidthExporter struct{}
+
+var fixedWidthColumns = []struct {
+	field string
+	width int
+}{
+	{FieldIccid, 20},
+	{FieldImsi, 15},
+	{FieldKi, 32},
+	{FieldOpc, 32},
+}
+
+func (exporter *fixedWidthExporter) RequiredFields() []string {
+	var fields []string
+	for _, column := range fixedWidthColumns {
+		fields = append(fields, column.field)
+	}
+	return fields
+}
+
+func (exporter *fixedWidthExporter) FileExtension() string {
+	return ".txt"
+}
+
+func (exporter *fixedWidthExporter) Write(writer io.Writer, batch *model.Batch, entries []model.SimEntry) error {
+	for i := range entries {
+		var line strings.Builder
+		for _, column := range fixedWidthColumns {
+			fmt.Fprintf(&line, "%-*s", column.width, strings.ToUpper(fieldValue(&entries[i], column.field)))
+		}
+		if _, err := fmt.Fprintf(writer, "%s\n", line.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// XML
+//
+
+// xmlExporter writes an XML document with an element per profile.
+type xmlExporter struct{}
+
+type xmlProfile struct {
+	Iccid     string `xml:"iccid"`
+	Imsi      string `xml:"imsi"`
+	Ki        string `xml:"ki"`
+	Opc       string `xml:"opc"`
+	Amf       string `xml:"amf"`
+	Algorithm string `xml:"algorithm"`
+}
+
+type xmlBatch struct {
+	XMLName  xml.Name     `xml:"batch"`
+	Name     string       `xml:"name,attr"`
+	Count    int          `xml:"count,attr"`
+	Profiles []xmlProfile `xml:"profile"`
+}
+
+func (exporter *xmlExporter) RequiredFields() []string {
+	return []string{FieldIccid, FieldImsi, FieldKi, FieldOpc}
+}
+
+func (exporter *xmlExporter) FileExtension() string {
+	return ".xml"
+}
+
+func (exporter *xmlExporter) Write(writer io.Writer, batch *model.Batch, entries []model.SimEntry) error {
+	document := xmlBatch{Name: batch.Name, Count: len(entries)}
+	for i := range entries {
+		entry := &entries[i]
+		document.Profiles = append(document.Profiles, xmlProfile{
+			Iccid:     fieldValue(entry, FieldIccid),
+			Imsi:      entry.Imsi,
+			Ki:        entry.Ki,
+			Opc:       entry.Opc,
+			Amf:       DefaultAmf,
+			Algorithm: DefaultAlgorithm,
+		})
+	}
+
+	if _, err := io.WriteString(writer, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	_, err := io.WriteString(writer, "\n")
+	return err
+}
@@ -0,0 +1,128 @@
+package hssexport
+
+import (
+	"bytes"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testBatch = &model.Batch{Name: "b1"}
+
+func testEntries() []model.SimEntry {
+	return []model.SimEntry{
+		{
+			Iccid:             "8947000000000012140",
+			IccidWithChecksum: "8947000000000012140",
+			Imsi:              "242017100011213",
+			Ki:                "000102030405060708090a0b0c0d0e0f",
+			Opc:               "101112131415161718191a1b1c1d1e1f",
+		},
+		{
+			Iccid:             "8947000000000012157",
+			IccidWithChecksum: "8947000000000012157",
+			Imsi:              "242017100011214",
+			Ki:                "202122232425262728292a2b2c2d2e2f",
+			Opc:               "303132333435363738393a3b3c3d3e3f",
+		},
+	}
+}
+
+func write(t *testing.T, format string) string {
+	exporter, err := ForFormat(format)
+	assert.NilError(t, err)
+	var buffer bytes.Buffer
+	assert.NilError(t, exporter.Write(&buffer, testBatch, testEntries()))
+	return buffer.String()
+}
+
+func TestRegistry(t *testing.T) {
+	assert.DeepEqual(t, []string{"csv", "fixed-width", "milenage-csv", "xml"}, Formats())
+	assert.DeepEqual(t, []string{"M1"}, HssVendors())
+
+	format, err := FormatOfHssVendor("M1")
+	assert.NilError(t, err)
+	assert.Equal(t, "csv", format)
+	m1, err := ForHssVendor("M1")
+	assert.NilError(t, err)
+	csv, err := ForFormat("csv")
+	assert.NilError(t, err)
+	assert.Equal(t, csv, m1)
+
+	_, err = ForHssVendor("LOL")
+	assert.ErrorContains(t, err, "no HSS format for HSS vendor 'LOL'")
+	_, err = ForHssVendor("xml")
+	assert.ErrorContains(t, err, "no HSS format for HSS vendor 'xml'")
+	_, err = ForFormat("LOL")
+	assert.ErrorContains(t, err, "no HSS exporter for format 'LOL'")
+}
+
+func TestFormats(t *testing.T) {
+	assert.Equal(t, "ICCID, IMSI, KI\n"+
+		"8947000000000012140, 242017100011213, 000102030405060708090a0b0c0d0e0f\n"+
+		"8947000000000012157, 242017100011214, 202122232425262728292a2b2c2d2e2f\n", write(t, "csv"))
+
+	assert.Equal(t, "ICCID, IMSI, KI, OPC, AMF, ALGORITHM\n"+
+		"8947000000000012140, 242017100011213, 000102030405060708090a0b0c0d0e0f, 101112131415161718191a1b1c1d1e1f, 8000, MILENAGE\n"+
+		"8947000000000012157, 242017100011214, 202122232425262728292a2b2c2d2e2f, 303132333435363738393a3b3c3d3e3f, 8000, MILENAGE\n", write(t, "milenage-csv"))
+
+	assert.Equal(t, "8947000000000012140 242017100011213000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F\n"+
+		"8947000000000012157 242017100011214202122232425262728292A2B2C2D2E2F303132333435363738393A3B3C3D3E3F\n", write(t, "fixed-width"))
+
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<batch name="b1" count="2">
+  <profile>
+    <iccid>8947000000000012140</iccid>
+    <imsi>242017100011213</imsi>
+    <ki>000102030405060708090a0b0c0d0e0f</ki>
+    <opc>101112131415161718191a1b1c1d1e1f</opc>
+    <amf>8000</amf>
+    <algorithm>MILENAGE</algorithm>
+  </profile>
+  <profile>
+    <iccid>8947000000000012157</iccid>
+    <imsi>242017100011214</imsi>
+    <ki>202122232425262728292a2b2c2d2e2f</ki>
+    <opc>303132333435363738393a3b3c3d3e3f</opc>
+    <amf>8000</amf>
+    <algorithm>MILENAGE</algorithm>
+  </profile>
+</batch>
+`, write(t, "xml"))
+}
+
+func TestValidateChecksRequiredFields(t *testing.T) {
+	entries := testEntries()
+	entries[0].Opc = ""
+	entries[1].Ki = "not hex"
+
+	m1, _ := ForHssVendor("M1")
+	assert.ErrorContains(t, Validate(m1, entries), "1 problems with the profiles: Iccid='8947000000000012157' has invalid KI")
+
+	xmlExporter, _ := ForFormat("xml")
+	assert.ErrorContains(t, Validate(xmlExporter, entries), "2 problems with the profiles: Iccid='8947000000000012140' has no OPC, Iccid='8947000000000012157' has invalid KI")
+}
+
+func TestWriteFileRefusesToOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hssexport")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "b1.csv")
+
+	exporter, _ := ForHssVendor("M1")
+	assert.NilError(t, WriteFile(path, exporter, testBatch, testEntries()))
+	written, err := ioutil.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, write(t, "csv"), string(written))
+
+	assert.ErrorContains(t, WriteFile(path, exporter, testBatch, testEntries()), "output file already exists")
+
+	entries := testEntries()
+	entries[0].Imsi = ""
+	assert.ErrorContains(t, WriteFile(filepath.Join(dir, "invalid.csv"), exporter, testBatch, entries), "has no IMSI")
+	_, err = os.Stat(filepath.Join(dir, "invalid.csv"))
+	assert.Assert(t, os.IsNotExist(err))
+}
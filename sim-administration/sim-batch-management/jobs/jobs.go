@@ -0,0 +1,456 @@
+// Package jobs runs long running bulk operations, such as activating all the
+// profiles in a big batch, in the background.  Jobs are persisted with their
+// state, progress counters and a log of what went wrong, so that they don't
+// depend on the terminal they were submitted from, and a worker resumes the
+// jobs that were interrupted when it, or another worker, stopped.
+//
+// The profiles a job has completed are recorded as it goes, and skipped when
+// an interrupted job is resumed, so that requests that aren't safe to repeat,
+// such as cancelling an order, aren't sent again for them.  The profiles that
+// failed are tried again.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/bulkexecutor"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of jobs.
+const (
+	KindBatchActivate        = "batch-activate"
+	KindBatchRefreshStatuses = "batch-refresh-statuses"
+	KindBatchCancel          = "batch-cancel"
+	KindBatchRecover         = "batch-recover"
+	KindIccidsBulkActivate   = "iccids-bulk-activate"
+)
+
+// Kinds maps the kinds of jobs to the arguments they need.  Lists of ICCIDs
+// are comma separated.
+var Kinds = map[string][]string{
+	KindBatchActivate:        {"batch"},
+	KindBatchRefreshStatuses: {"batch"},
+	KindBatchCancel:          {"batch", "target", "iccids"},
+	KindBatchRecover:         {"batch", "target", "iccids"},
+	KindIccidsBulkActivate:   {"profile-vendor", "iccids"},
+}
+
+// KindNames returns the names of the kinds of jobs, sorted.
+func KindNames() []string {
+	var names []string
+	for kind := range Kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Queue is where jobs are submitted to.
+type Queue interface {
+	CreateJob(job *model.Job) error
+}
+
+// Store is where jobs and their logs are kept.
+type Store interface {
+	Queue
+	GetJobByID(id int64) (*model.Job, error)
+	ClaimNextJob(worker string, timestamp string) (*model.Job, error)
+	UpdateJobProgress(job *model.Job) (bool, error)
+	FinishJob(job *model.Job) error
+	RequeueStaleJobs(before string) (int64, error)
+	CreateJobLogEntry(entry *model.JobLogEntry) error
+	CreateJobCompletedIccid(jobID int64, iccid string, timestamp string) error
+	GetJobCompletedIccids(jobID int64) ([]string, error)
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// Submit queues a job, after checking that it has the arguments its kind needs.
+func Submit(queue Queue, kind string, args map[string]string, submittedBy string) (*model.Job, error) {
+	required, known := Kinds[kind]
+	if !known {
+		return nil, fmt.Errorf("unknown kind of job '%s', should be one of %s", kind, strings.Join(KindNames(), ", "))
+	}
+	for _, name := range required {
+		if strings.TrimSpace(args[name]) == "" {
+			return nil, fmt.Errorf("a %s job needs the argument '%s'", kind, name)
+		}
+	}
+	for name := range args {
+		if !contains(required, name) {
+			return nil, fmt.Errorf("a %s job has no argument '%s'", kind, name)
+		}
+	}
+
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	job := &model.Job{
+		Kind:        kind,
+		Args:        string(encoded),
+		State:       model.JobQueued,
+		Submitted:   now(),
+		SubmittedBy: submittedBy,
+	}
+	if err := queue.CreateJob(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Args returns the arguments of a job.
+func Args(job *model.Job) (map[string]string, error) {
+	args := make(map[string]string)
+	if err := json.Unmarshal([]byte(job.Args), &args); err != nil {
+		return nil, fmt.Errorf("job %d has malformed arguments: %s", job.ID, err)
+	}
+	return args, nil
+}
+
+// IsFinished tells if a job is in a final state.
+func IsFinished(job *model.Job) bool {
+	return job.State == model.JobSucceeded || job.State == model.JobFailed || job.State == model.JobCancelled
+}
+
+// Handler does the work of a kind of job.  It should stop when the context
+// is cancelled, and report its progress to the run.
+type Handler func(ctx context.Context, run *Run) error
+
+// Run is an attempt at running a job.
+type Run struct {
+	store Store
+	args  map[string]string
+
+	// completed are the profiles completed by earlier attempts.
+	completed map[string]bool
+
+	mutex sync.Mutex
+	job   model.Job
+	lost  bool
+}
+
+// ID is the ID of the job being run.
+func (run *Run) ID() int64 {
+	return run.job.ID
+}
+
+// Arg returns an argument of the job, empty if the job doesn't have it.
+func (run *Run) Arg(name string) string {
+	return run.args[name]
+}
+
+// Remaining returns the ICCIDs of the profiles that earlier attempts at
+// running the job haven't completed.
+func (run *Run) Remaining(iccids []string) []string {
+	var remaining []string
+	for _, iccid := range iccids {
+		if !run.completed[iccid] {
+			remaining = append(remaining, iccid)
+		}
+	}
+	return remaining
+}
+
+// SetTotal records the number of profiles this attempt works on.  The
+// profiles completed by earlier attempts are added to it.
+func (run *Run) SetTotal(total int) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.job.Total = total + len(run.completed)
+}
+
+// Report counts the result for a profile, and records it as completed if it
+// succeeded or logs it if it failed.
+func (run *Run) Report(result bulkexecutor.Result) {
+	run.mutex.Lock()
+	if result.Err != nil {
+		run.job.Failed++
+	} else {
+		run.job.Succeeded++
+	}
+	run.mutex.Unlock()
+
+	if result.Err != nil {
+		run.log(model.JobLogError, result.Iccid, result.Err.Error())
+		return
+	}
+	if err := run.store.CreateJobCompletedIccid(run.job.ID, result.Iccid, now()); err != nil {
+		log.Printf("ERROR: Couldn't record that job %d completed Iccid='%s', it will be done again if the job is resumed: %s\n", run.job.ID, result.Iccid, err)
+	}
+}
+
+// Logf adds a line to the log of the job.
+func (run *Run) Logf(format string, args ...interface{}) {
+	run.log(model.JobLogInfo, "", fmt.Sprintf(format, args...))
+}
+
+func (run *Run) log(level string, iccid string, message string) {
+	entry := &model.JobLogEntry{JobID: run.job.ID, Timestamp: now(), Level: level, Iccid: iccid, Message: message}
+	if err := run.store.CreateJobLogEntry(entry); err != nil {
+		log.Printf("ERROR: Couldn't add to the log of job %d: %s\n", run.job.ID, err)
+	}
+}
+
+// snapshot returns the job with the progress so far.
+func (run *Run) snapshot() model.Job {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return run.job
+}
+
+// setLost records that the job has been taken from the worker running it.
+func (run *Run) setLost() {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	run.lost = true
+}
+
+func (run *Run) isLost() bool {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	return run.lost
+}
+
+// Worker runs queued jobs, one at a time.  Any number of workers can share
+// a store.
+type Worker struct {
+	// Name identifies the worker in the jobs it runs.
+	Name string
+
+	Store    Store
+	Handlers map[string]Handler
+
+	// PollInterval is how often the queue is checked when it is empty.
+	PollInterval time.Duration
+
+	// HeartbeatInterval is how often the progress of a running job is
+	// stored, and the job checked for cancellation.
+	HeartbeatInterval time.Duration
+
+	// StaleAfter is how long a running job can go without a heartbeat
+	// before it is assumed that its worker has died, and the job is
+	// requeued to be resumed.
+	StaleAfter time.Duration
+
+	// MaxBackoff is the longest the worker waits before trying again
+	// when the store fails, e.g. because the database is locked.
+	MaxBackoff time.Duration
+}
+
+// Defaults for the intervals of workers.
+const (
+	DefaultPollInterval      = 5 * time.Second
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultStaleAfter        = 1 * time.Minute
+	DefaultMaxBackoff        = 1 * time.Minute
+)
+
+// Run runs jobs until the context is cancelled.  A job running when the
+// context is cancelled is stopped and requeued, to be resumed later.
+// Failures of the store, e.g. because the database is locked by another
+// process, are logged and retried, waiting longer after each failure in
+// a row.
+func (worker *Worker) Run(ctx context.Context) {
+	pollInterval := orDefault(worker.PollInterval, DefaultPollInterval)
+	staleAfter := orDefault(worker.StaleAfter, DefaultStaleAfter)
+	maxBackoff := orDefault(worker.MaxBackoff, DefaultMaxBackoff)
+
+	log.Printf("Job worker %s started\n", worker.Name)
+	var backoff time.Duration
+	for {
+		if ctx.Err() != nil {
+			log.Printf("Job worker %s stopped\n", worker.Name)
+			return
+		}
+
+		wait := pollInterval
+		found, err := worker.runNextJob(ctx, staleAfter)
+		switch {
+		case err != nil:
+			backoff = nextBackoff(backoff, pollInterval, maxBackoff)
+			wait = backoff
+			log.Printf("ERROR: Job worker %s failed, trying again in %s: %s\n", worker.Name, wait, err)
+		case found:
+			backoff = 0
+			continue
+		default:
+			backoff = 0
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runNextJob requeues the jobs of workers that seem to have died, then runs
+// the next queued job, if there is one.
+func (worker *Worker) runNextJob(ctx context.Context, staleAfter time.Duration) (bool, error) {
+	before := time.Now().Add(-staleAfter).UTC().Format(time.RFC3339)
+	requeued, err := worker.Store.RequeueStaleJobs(before)
+	if err != nil {
+		return false, err
+	}
+	if requeued > 0 {
+		log.Printf("Requeued %d jobs whose worker stopped giving heartbeats\n", requeued)
+	}
+
+	job, err := worker.Store.ClaimNextJob(worker.Name, now())
+	if err != nil || job == nil {
+		return false, err
+	}
+	return true, worker.runJob(ctx, job)
+}
+
+// nextBackoff doubles the time to wait after a failure, starting at the
+// poll interval and up to the maximum.
+func nextBackoff(backoff time.Duration, pollInterval time.Duration, maxBackoff time.Duration) time.Duration {
+	if backoff == 0 {
+		backoff = pollInterval
+	} else {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func orDefault(duration time.Duration, defaultDuration time.Duration) time.Duration {
+	if duration <= 0 {
+		return defaultDuration
+	}
+	return duration
+}
+
+// runJob runs a claimed job, and stores the state it ends up in.  If the
+// job is taken from the worker while it runs, because the worker seemed to
+// have died, the run is stopped and the job left to the worker that has it.
+func (worker *Worker) runJob(ctx context.Context, job *model.Job) error {
+	completed, err := worker.Store.GetJobCompletedIccids(job.ID)
+	if err != nil {
+		return err
+	}
+	run := &Run{store: worker.Store, job: *job, completed: make(map[string]bool)}
+	for _, iccid := range completed {
+		run.completed[iccid] = true
+	}
+
+	log.Printf("Running job %d (%s %s), attempt %d\n", job.ID, job.Kind, job.Args, job.Attempts)
+	run.Logf("Attempt %d started by worker %s", job.Attempts, worker.Name)
+
+	jobCtx, cancelJob := context.WithCancel(ctx)
+	defer cancelJob()
+
+	args, argsErr := Args(job)
+	handler, known := worker.Handlers[job.Kind]
+	switch {
+	case argsErr != nil:
+		err = argsErr
+	case !known:
+		err = fmt.Errorf("this worker can't run %s jobs", job.Kind)
+	default:
+		run.args = args
+		heartbeatStopped := make(chan bool)
+		stopHeartbeat := make(chan bool)
+		go func() {
+			worker.heartbeat(run, cancelJob, stopHeartbeat)
+			close(heartbeatStopped)
+		}()
+		err = handler(jobCtx, run)
+		close(stopHeartbeat)
+		<-heartbeatStopped
+	}
+
+	if run.isLost() {
+		log.Printf("Job %d was taken from worker %s, leaving it to the worker that has it\n", job.ID, worker.Name)
+		return nil
+	}
+
+	finished := run.snapshot()
+	finished.Heartbeat = now()
+	latest, getErr := worker.Store.GetJobByID(job.ID)
+	switch {
+	case getErr == nil && latest != nil && latest.CancelRequested:
+		finished.State = model.JobCancelled
+		finished.Finished = finished.Heartbeat
+		run.Logf("Cancelled after %d of %d profiles, %d failed", finished.Succeeded+finished.Failed, finished.Total, finished.Failed)
+	case ctx.Err() != nil:
+		// The worker is stopping, leave the job for the next one.
+		finished.State = model.JobQueued
+		run.Logf("Worker %s stopped after %d of %d profiles, the job will be resumed", worker.Name, finished.Succeeded+finished.Failed, finished.Total)
+	case err != nil:
+		finished.State = model.JobFailed
+		finished.Finished = finished.Heartbeat
+		finished.Error = err.Error()
+		run.log(model.JobLogError, "", err.Error())
+	default:
+		finished.State = model.JobSucceeded
+		finished.Finished = finished.Heartbeat
+		run.Logf("Succeeded, %d of %d profiles", finished.Succeeded, finished.Total)
+	}
+
+	log.Printf("Job %d is %s\n", job.ID, finished.State)
+	return worker.Store.FinishJob(&finished)
+}
+
+// heartbeat stores the progress of a run regularly, logs it when it has
+// changed, and cancels the run if cancellation of the job has been requested,
+// or if the job is no longer run by the worker.
+func (worker *Worker) heartbeat(run *Run, cancelJob context.CancelFunc, stop chan bool) {
+	ticker := time.NewTicker(orDefault(worker.HeartbeatInterval, DefaultHeartbeatInterval))
+	defer ticker.Stop()
+
+	var logged model.Job
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		progress := run.snapshot()
+		progress.Heartbeat = now()
+		owned, err := worker.Store.UpdateJobProgress(&progress)
+		if err != nil {
+			log.Printf("ERROR: Couldn't store the progress of job %d: %s\n", progress.ID, err)
+		} else if !owned {
+			log.Printf("Job %d is no longer run by worker %s, stopping it\n", progress.ID, worker.Name)
+			run.setLost()
+			cancelJob()
+			return
+		}
+		if progress.Succeeded != logged.Succeeded || progress.Failed != logged.Failed || progress.Total != logged.Total {
+			run.Logf("%d of %d profiles done, %d failed", progress.Succeeded+progress.Failed, progress.Total, progress.Failed)
+			logged = progress
+		}
+
+		latest, err := worker.Store.GetJobByID(progress.ID)
+		if err != nil {
+			log.Printf("ERROR: Couldn't check if job %d is cancelled: %s\n", progress.ID, err)
+		} else if latest != nil && latest.CancelRequested {
+			log.Printf("Cancelling job %d\n", progress.ID)
+			cancelJob()
+		}
+	}
+}
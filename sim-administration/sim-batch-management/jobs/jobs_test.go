@@ -0,0 +1,222 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/bulkexecutor"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+// startWorker runs a worker in the background, returns a function stopping it.
+func startWorker(db *store.SimBatchDB, handlers map[string]Handler) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := &Worker{
+		Name:              "test-worker",
+		Store:             db,
+		Handlers:          handlers,
+		PollInterval:      10 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+	}
+	stopped := make(chan bool)
+	go func() {
+		worker.Run(ctx)
+		close(stopped)
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+func waitForState(t *testing.T, db *store.SimBatchDB, id int64, state string) *model.Job {
+	for i := 0; i < 500; i++ {
+		job, err := db.GetJobByID(id)
+		assert.NilError(t, err)
+		if job.State == state {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %d never got to state %s", id, state)
+	return nil
+}
+
+func TestSubmitChecksArguments(t *testing.T) {
+	db, cleanup := store.NewTempDatabase(t)
+	defer cleanup()
+
+	_, err := Submit(db, "batch-explode", map[string]string{"batch": "b1"}, "alice")
+	assert.ErrorContains(t, err, "unknown kind of job 'batch-explode'")
+	_, err = Submit(db, KindBatchCancel, map[string]string{"batch": "b1", "target": "AVAILABLE"}, "alice")
+	assert.ErrorContains(t, err, "needs the argument 'iccids'")
+	_, err = Submit(db, KindBatchActivate, map[string]string{"batch": "b1", "target": "AVAILABLE"}, "alice")
+	assert.ErrorContains(t, err, "has no argument 'target'")
+
+	job, err := Submit(db, KindBatchActivate, map[string]string{"batch": "b1"}, "alice")
+	assert.NilError(t, err)
+	assert.Equal(t, model.JobQueued, job.State)
+	args, err := Args(job)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]string{"batch": "b1"}, args)
+}
+
+func TestWorkerRecordsProgressAndErrors(t *testing.T) {
+	db, cleanup := store.NewTempDatabase(t)
+	defer cleanup()
+
+	job, err := Submit(db, KindBatchActivate, map[string]string{"batch": "b1"}, "alice")
+	assert.NilError(t, err)
+
+	stop := startWorker(db, map[string]Handler{
+		KindBatchActivate: func(ctx context.Context, run *Run) error {
+			assert.Equal(t, "b1", run.Arg("batch"))
+			run.SetTotal(2)
+			run.Report(bulkexecutor.Result{Iccid: "8947000000000012140"})
+			run.Report(bulkexecutor.Result{Iccid: "8947000000000012141", Err: fmt.Errorf("timeout")})
+			return fmt.Errorf("only 1 of 2 profiles succeeded")
+		},
+	})
+	defer stop()
+
+	finished := waitForState(t, db, job.ID, model.JobFailed)
+	assert.Equal(t, 2, finished.Total)
+	assert.Equal(t, 1, finished.Succeeded)
+	assert.Equal(t, 1, finished.Failed)
+	assert.Equal(t, "only 1 of 2 profiles succeeded", finished.Error)
+	assert.Equal(t, "test-worker", finished.Worker)
+	assert.Assert(t, finished.Finished != "")
+
+	errors, err := db.GetJobLog(job.ID, model.JobLogError, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(errors))
+	assert.Equal(t, "8947000000000012141", errors[0].Iccid)
+	assert.Equal(t, "timeout", errors[0].Message)
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	db, cleanup := store.NewTempDatabase(t)
+	defer cleanup()
+
+	job, err := Submit(db, KindBatchActivate, map[string]string{"batch": "b1"}, "alice")
+	assert.NilError(t, err)
+
+	stop := startWorker(db, map[string]Handler{
+		KindBatchActivate: func(ctx context.Context, run *Run) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	defer stop()
+
+	waitForState(t, db, job.ID, model.JobRunning)
+	_, err = db.RequestJobCancel(job.ID, "2026-10-19T10:00:00Z")
+	assert.NilError(t, err)
+	waitForState(t, db, job.ID, model.JobCancelled)
+}
+
+func TestStoppedWorkerLeavesJobToBeResumed(t *testing.T) {
+	db, cleanup := store.NewTempDatabase(t)
+	defer cleanup()
+
+	job, err := Submit(db, KindBatchActivate, map[string]string{"batch": "b1"}, "alice")
+	assert.NilError(t, err)
+
+	iccids := []string{"8947000000000012140", "8947000000000012157", "8947000000000012165"}
+	reported := make(chan bool)
+	stop := startWorker(db, map[string]Handler{
+		KindBatchActivate: func(ctx context.Context, run *Run) error {
+			remaining := run.Remaining(iccids)
+			run.SetTotal(len(remaining))
+			run.Report(bulkexecutor.Result{Iccid: remaining[0]})
+			run.Report(bulkexecutor.Result{Iccid: remaining[1], Err: fmt.Errorf("timeout")})
+			close(reported)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+	<-reported
+	stop()
+	waitForState(t, db, job.ID, model.JobQueued)
+
+	// Only the profiles that weren't completed are done again.
+	var resumed []string
+	stop = startWorker(db, map[string]Handler{
+		KindBatchActivate: func(ctx context.Context, run *Run) error {
+			resumed = run.Remaining(iccids)
+			run.SetTotal(len(resumed))
+			for _, iccid := range resumed {
+				run.Report(bulkexecutor.Result{Iccid: iccid})
+			}
+			return nil
+		},
+	})
+	defer stop()
+
+	finished := waitForState(t, db, job.ID, model.JobSucceeded)
+	assert.DeepEqual(t, []string{"8947000000000012157", "8947000000000012165"}, resumed)
+	assert.Equal(t, 2, finished.Attempts)
+	assert.Equal(t, 3, finished.Total)
+	assert.Equal(t, 3, finished.Succeeded)
+	assert.Equal(t, 0, finished.Failed)
+}
+
+func TestWorkerStopsJobTakenFromIt(t *testing.T) {
+	db, cleanup := store.NewTempDatabase(t)
+	defer cleanup()
+
+	job, err := Submit(db, KindBatchActivate, map[string]string{"batch": "b1"}, "alice")
+	assert.NilError(t, err)
+
+	stopped := make(chan bool)
+	stop := startWorker(db, map[string]Handler{
+		KindBatchActivate: func(ctx context.Context, run *Run) error {
+			<-ctx.Done()
+			close(stopped)
+			return ctx.Err()
+		},
+	})
+	defer stop()
+
+	waitForState(t, db, job.ID, model.JobRunning)
+	// Another worker takes the job, as if this one had stopped giving heartbeats.
+	_, err = db.Db.Exec("UPDATE JOB SET worker = 'other-worker' WHERE id = ?", job.ID)
+	assert.NilError(t, err)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run wasn't stopped")
+	}
+	latest, err := db.GetJobByID(job.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, model.JobRunning, latest.State)
+	assert.Equal(t, "other-worker", latest.Worker)
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := nextBackoff(0, time.Second, 5*time.Second)
+	assert.Equal(t, time.Second, backoff)
+	backoff = nextBackoff(backoff, time.Second, 5*time.Second)
+	assert.Equal(t, 2*time.Second, backoff)
+	backoff = nextBackoff(backoff, time.Second, 5*time.Second)
+	backoff = nextBackoff(backoff, time.Second, 5*time.Second)
+	assert.Equal(t, 5*time.Second, backoff)
+}
+
+func TestJobsOfUnknownKindFail(t *testing.T) {
+	db, cleanup := store.NewTempDatabase(t)
+	defer cleanup()
+
+	job, err := Submit(db, KindBatchRefreshStatuses, map[string]string{"batch": "b1"}, "alice")
+	assert.NilError(t, err)
+
+	stop := startWorker(db, map[string]Handler{})
+	defer stop()
+
+	finished := waitForState(t, db, job.ID, model.JobFailed)
+	assert.Equal(t, "this worker can't run batch-refresh-statuses jobs", finished.Error)
+}
@@ -0,0 +1,230 @@
+// Package milenage implements the 3GPP MILENAGE algorithm set
+// (3GPP TS 35.206) used by the USIM and the HSS to compute
+// authentication vectors.  It is used to check that the Ki/OPc
+// values a SIM profile vendor hands us actually match the
+// vendor's own test vectors before a batch is loaded into an HSS.
+package milenage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+const (
+	// KeyLength is the length in bytes of K, OP and OPc.
+	KeyLength = 16
+
+	// RandLength is the length in bytes of the RAND challenge.
+	RandLength = 16
+
+	// SqnLength is the length in bytes of the sequence number SQN.
+	SqnLength = 6
+
+	// AmfLength is the length in bytes of the authentication management field.
+	AmfLength = 2
+)
+
+// Milenage holds the subscriber specific key K and the derived
+// operator variant constant OPc.
+type Milenage struct {
+	block cipher.Block
+	opc   []byte
+}
+
+// AuthenticationVector holds the result of running all of the
+// MILENAGE functions for a particular RAND/SQN/AMF combination.
+type AuthenticationVector struct {
+	Rand []byte
+	Sqn  []byte
+	Amf  []byte
+	Res  []byte // f2, also known as XRES on the network side.
+	Ck   []byte // f3
+	Ik   []byte // f4
+	Ak   []byte // f5
+	MacA []byte // f1
+	Autn []byte // (SQN xor AK) || AMF || MAC-A
+}
+
+// New creates a MILENAGE instance from the subscriber key K and
+// the operator variant constant OPc.
+func New(k []byte, opc []byte) (*Milenage, error) {
+	if len(k) != KeyLength {
+		return nil, fmt.Errorf("K must be %d bytes, was %d", KeyLength, len(k))
+	}
+	if len(opc) != KeyLength {
+		return nil, fmt.Errorf("OPc must be %d bytes, was %d", KeyLength, len(opc))
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return &Milenage{block: block, opc: append([]byte{}, opc...)}, nil
+}
+
+// NewWithOP creates a MILENAGE instance from the subscriber key K and
+// the operator variant algorithm configuration field OP.  OPc is
+// derived from the two.
+func NewWithOP(k []byte, op []byte) (*Milenage, error) {
+	opc, err := ComputeOPc(k, op)
+	if err != nil {
+		return nil, err
+	}
+	return New(k, opc)
+}
+
+// ComputeOPc derives OPc = OP xor E[OP]K.
+func ComputeOPc(k []byte, op []byte) ([]byte, error) {
+	if len(k) != KeyLength {
+		return nil, fmt.Errorf("K must be %d bytes, was %d", KeyLength, len(k))
+	}
+	if len(op) != KeyLength {
+		return nil, fmt.Errorf("OP must be %d bytes, was %d", KeyLength, len(op))
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	opc := make([]byte, KeyLength)
+	block.Encrypt(opc, op)
+	xorInto(opc, op)
+	return opc, nil
+}
+
+// OPc returns a copy of the operator variant constant in use.
+func (m *Milenage) OPc() []byte {
+	return append([]byte{}, m.opc...)
+}
+
+// F1 computes the network authentication code MAC-A (f1) and the
+// resynchronisation authentication code MAC-S (f1*).
+func (m *Milenage) F1(rand []byte, sqn []byte, amf []byte) (macA []byte, macS []byte, err error) {
+	if err := checkLength("RAND", rand, RandLength); err != nil {
+		return nil, nil, err
+	}
+	if err := checkLength("SQN", sqn, SqnLength); err != nil {
+		return nil, nil, err
+	}
+	if err := checkLength("AMF", amf, AmfLength); err != nil {
+		return nil, nil, err
+	}
+
+	temp := m.temp(rand)
+
+	// IN1 = SQN || AMF || SQN || AMF
+	in1 := make([]byte, 16)
+	copy(in1[0:6], sqn)
+	copy(in1[6:8], amf)
+	copy(in1[8:14], sqn)
+	copy(in1[14:16], amf)
+
+	// OUT1 = E[TEMP xor rot(IN1 xor OPc, r1) xor c1]K xor OPc, with r1 = 64 and c1 = 0.
+	xorInto(in1, m.opc)
+	out1 := rotate(in1, 64)
+	xorInto(out1, temp)
+	m.block.Encrypt(out1, out1)
+	xorInto(out1, m.opc)
+
+	return out1[0:8], out1[8:16], nil
+}
+
+// F2345 computes the response RES (f2), the cipher key CK (f3),
+// the integrity key IK (f4) and the anonymity key AK (f5).
+func (m *Milenage) F2345(rand []byte) (res []byte, ck []byte, ik []byte, ak []byte, err error) {
+	if err := checkLength("RAND", rand, RandLength); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	temp := m.temp(rand)
+
+	out2 := m.out(temp, 0, 1)
+	out3 := m.out(temp, 32, 2)
+	out4 := m.out(temp, 64, 4)
+
+	return out2[8:16], out3, out4, out2[0:6], nil
+}
+
+// F5Star computes the anonymity key used for resynchronisation (f5*).
+func (m *Milenage) F5Star(rand []byte) ([]byte, error) {
+	if err := checkLength("RAND", rand, RandLength); err != nil {
+		return nil, err
+	}
+	out5 := m.out(m.temp(rand), 96, 8)
+	return out5[0:6], nil
+}
+
+// GenerateVector runs f1 through f5 and assembles the resulting
+// authentication vector, including AUTN.
+func (m *Milenage) GenerateVector(rand []byte, sqn []byte, amf []byte) (*AuthenticationVector, error) {
+	macA, _, err := m.F1(rand, sqn, amf)
+	if err != nil {
+		return nil, err
+	}
+	res, ck, ik, ak, err := m.F2345(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	autn := make([]byte, 0, SqnLength+AmfLength+len(macA))
+	sqnXorAk := append([]byte{}, sqn...)
+	xorInto(sqnXorAk, ak)
+	autn = append(autn, sqnXorAk...)
+	autn = append(autn, amf...)
+	autn = append(autn, macA...)
+
+	return &AuthenticationVector{
+		Rand: append([]byte{}, rand...),
+		Sqn:  append([]byte{}, sqn...),
+		Amf:  append([]byte{}, amf...),
+		Res:  res,
+		Ck:   ck,
+		Ik:   ik,
+		Ak:   ak,
+		MacA: macA,
+		Autn: autn,
+	}, nil
+}
+
+// temp computes TEMP = E[RAND xor OPc]K
+func (m *Milenage) temp(rand []byte) []byte {
+	temp := append([]byte{}, rand...)
+	xorInto(temp, m.opc)
+	m.block.Encrypt(temp, temp)
+	return temp
+}
+
+// out computes OUTn = E[rot(TEMP xor OPc, r) xor c]K xor OPc, where
+// the constant c is all zeros except for its last byte.
+func (m *Milenage) out(temp []byte, r uint, lastByteOfC byte) []byte {
+	in := append([]byte{}, temp...)
+	xorInto(in, m.opc)
+	result := rotate(in, r)
+	result[15] ^= lastByteOfC
+	m.block.Encrypt(result, result)
+	xorInto(result, m.opc)
+	return result
+}
+
+// rotate cyclically rotates the 128 bit value x by r bits towards
+// the most significant bit. All rotations used by MILENAGE are
+// whole bytes.
+func rotate(x []byte, r uint) []byte {
+	result := make([]byte, len(x))
+	shift := int(r / 8)
+	for i := range x {
+		result[i] = x[(i+shift)%len(x)]
+	}
+	return result
+}
+
+func xorInto(dst []byte, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func checkLength(name string, value []byte, expected int) error {
+	if len(value) != expected {
+		return fmt.Errorf("%s must be %d bytes, was %d", name, expected, len(value))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package milenage
+
+import (
+	"encoding/hex"
+	"gotest.tools/assert"
+	"testing"
+)
+
+// Test sets from 3GPP TS 35.207 (which are repeated as the first
+// test sets in TS 35.208).
+var testSets = []struct {
+	k, rand, sqn, amf, op, opc, f1, f1star, f2, f5, f3, f4, f5star string
+}{
+	{
+		k:      "465b5ce8b199b49faa5f0a2ee238a6bc",
+		rand:   "23553cbe9637a89d218ae64dae47bf35",
+		sqn:    "ff9bb4d0b607",
+		amf:    "b9b9",
+		op:     "cdc202d5123e20f62b6d676ac72cb318",
+		opc:    "cd63cb71954a9f4e48a5994e37a02baf",
+		f1:     "4a9ffac354dfafb3",
+		f1star: "01cfaf9ec4e871e9",
+		f2:     "a54211d5e3ba50bf",
+		f5:     "aa689c648370",
+		f3:     "b40ba9a3c58b2a05bbf0d987b21bf8cb",
+		f4:     "f769bcd751044604127672711c6d3441",
+		f5star: "451e8beca43b",
+	},
+	{
+		k:      "0396eb317b6d1c36f19c1c84cd6ffd16",
+		rand:   "c00d603103dcee52c4478119494202e8",
+		sqn:    "fd8eef40df7d",
+		amf:    "af17",
+		op:     "ff53bade17df5d4e793073ce9d7579fa",
+		opc:    "53c15671c60a4b731c55b4a441c0bde2",
+		f1:     "5df5b31807e258b0",
+		f1star: "a8c016e51ef4a343",
+		f2:     "d3a628ed988620f0",
+		f5:     "c47783995f72",
+		f3:     "58c433ff7a7082acd424220f2b67c556",
+		f4:     "21a8c1f929702adb3e738488b9f5c5da",
+		f5star: "30f1197061c1",
+	},
+	{
+		k:      "fec86ba6eb707ed08905757b1bb44b8f",
+		rand:   "9f7c8d021accf4db213ccff0c7f71a6a",
+		sqn:    "9d0277595ffc",
+		amf:    "725c",
+		op:     "dbc59adcb6f9a0ef735477b7fadf8374",
+		opc:    "1006020f0a478bf6b699f15c062e42b3",
+		f1:     "9cabc3e99baf7281",
+		f1star: "95814ba2b3044324",
+		f2:     "8011c48c0c214ed2",
+		f5:     "33484dc2136b",
+		f3:     "5dbdbb2954e8f3cde665b046179a5098",
+		f4:     "59a92d3b476a0443487055cf88b2307b",
+		f5star: "deacdd848cc6",
+	},
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	result, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestComputeOPc(t *testing.T) {
+	for _, ts := range testSets {
+		opc, err := ComputeOPc(fromHex(t, ts.k), fromHex(t, ts.op))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ts.opc, hex.EncodeToString(opc))
+	}
+}
+
+func TestMilenageFunctions(t *testing.T) {
+	for _, ts := range testSets {
+		m, err := NewWithOP(fromHex(t, ts.k), fromHex(t, ts.op))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		macA, macS, err := m.F1(fromHex(t, ts.rand), fromHex(t, ts.sqn), fromHex(t, ts.amf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ts.f1, hex.EncodeToString(macA))
+		assert.Equal(t, ts.f1star, hex.EncodeToString(macS))
+
+		res, ck, ik, ak, err := m.F2345(fromHex(t, ts.rand))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ts.f2, hex.EncodeToString(res))
+		assert.Equal(t, ts.f3, hex.EncodeToString(ck))
+		assert.Equal(t, ts.f4, hex.EncodeToString(ik))
+		assert.Equal(t, ts.f5, hex.EncodeToString(ak))
+
+		akStar, err := m.F5Star(fromHex(t, ts.rand))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ts.f5star, hex.EncodeToString(akStar))
+	}
+}
+
+func TestGenerateVector(t *testing.T) {
+	ts := testSets[0]
+	m, err := New(fromHex(t, ts.k), fromHex(t, ts.opc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vector, err := m.GenerateVector(fromHex(t, ts.rand), fromHex(t, ts.sqn), fromHex(t, ts.amf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// AUTN = (SQN xor AK) || AMF || MAC-A
+	sqnXorAk := fromHex(t, ts.sqn)
+	xorInto(sqnXorAk, fromHex(t, ts.f5))
+	expectedAutn := hex.EncodeToString(sqnXorAk) + ts.amf + ts.f1
+
+	assert.Equal(t, expectedAutn, hex.EncodeToString(vector.Autn))
+	assert.Equal(t, ts.f2, hex.EncodeToString(vector.Res))
+}
+
+func TestIllegalParameterLengths(t *testing.T) {
+	_, err := New(make([]byte, 15), make([]byte, 16))
+	assert.Assert(t, err != nil)
+
+	m, err := New(make([]byte, 16), make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.F1(make([]byte, 16), make([]byte, 5), make([]byte, 2))
+	assert.Assert(t, err != nil)
+}
@@ -17,7 +17,25 @@ type SimEntry struct {
 	Imsi                 string `db:"imsi" json:"imsi"`
 	Msisdn               string `db:"msisdn" json:"msisdn"`
 	Ki                   string `db:"ki" json:"ki"`
+	Opc                  string `db:"opc" json:"opc"`
+	Pin1                 string `db:"pin1" json:"pin1"`
+	Pin2                 string `db:"pin2" json:"pin2"`
+	Puk1                 string `db:"puk1" json:"puk1"`
+	Puk2                 string `db:"puk2" json:"puk2"`
+	SecretsHash          string `db:"secretsHash" json:"secretsHash"`
 	ActivationCode       string `db:"activationCode" json:"activationCode"`
+
+	// The state of the profile in the SM-DP+, the EID of the eUICC it was
+	// downloaded to, when (RFC3339) the state was last reported to have
+	// changed, and when it was last checked by polling the SM-DP+.
+	ProfileState        string `db:"profileState" json:"profileState"`
+	ProfileStateUpdated string `db:"profileStateUpdated" json:"profileStateUpdated"`
+	ProfileStateChecked string `db:"profileStateChecked" json:"profileStateChecked"`
+	Eid                 string `db:"eid" json:"eid"`
+
+	// When (RFC3339) the profile was uploaded to prime, so that an upload
+	// that stopped half way can be resumed.
+	UploadedToPrime string `db:"uploadedToPrime" json:"uploadedToPrime"`
 }
 
 // Batch represents batches of sim profiles.  Instances can be
@@ -46,9 +64,95 @@ type Batch struct {
 	ImsiIncrement   int    `db:"imsiIncrement" json:"imsiIncrement"`
 	FirstMsisdn     string `db:"firstMsisdn" json:"firstMsisdn"`
 	ProfileVendor   string `db:"profileVendor" json:"profileVendor"`
+	State           string `db:"state" json:"state"`
+
+	// The vendor of the HSS the batch is loaded into, deciding the format
+	// of the file written for it.
+	HssVendor string `db:"hssVendor" json:"hssVendor"`
+
+	// Timestamps (RFC3339) and operators recording that the HSS has
+	// confirmed loading the batch, and that secret material
+	// (Ki, OPc, PIN/PUK) has subsequently been purged from the database.
+	HssLoaded       string `db:"hssLoaded" json:"hssLoaded"`
+	HssLoadedBy     string `db:"hssLoadedBy" json:"hssLoadedBy"`
+	SecretsPurged   string `db:"secretsPurged" json:"secretsPurged"`
+	SecretsPurgedBy string `db:"secretsPurgedBy" json:"secretsPurgedBy"`
+
+	// Timestamp (RFC3339) and outcome of the last direct upload to prime.
+	PrimeUploaded     string `db:"primeUploaded" json:"primeUploaded"`
+	PrimeUploadStatus string `db:"primeUploadStatus" json:"primeUploadStatus"`
 }
 
 
+// The states a batch goes through during its lifecycle, in the order
+// the steps are expected to be performed.
+const (
+	BatchStateDeclared                   = "DECLARED"
+	BatchStateInputFileSent              = "INPUT_FILE_SENT"
+	BatchStateOutFileRead                = "OUT_FILE_READ"
+	BatchStateHssFileWritten             = "HSS_FILE_WRITTEN"
+	BatchStatePrimeUploaded              = "PRIME_UPLOADED"
+	BatchStateSmdpActivated              = "SMDP_ACTIVATED"
+	BatchStateActivationCodeSQLGenerated = "ACTIVATION_CODE_SQL_GENERATED"
+)
+
+// BatchStates lists all the batch lifecycle states in order.
+var BatchStates = []string{
+	BatchStateDeclared,
+	BatchStateInputFileSent,
+	BatchStateOutFileRead,
+	BatchStateHssFileWritten,
+	BatchStatePrimeUploaded,
+	BatchStateSmdpActivated,
+	BatchStateActivationCodeSQLGenerated,
+}
+
+// BatchStateTransition records a change of lifecycle state for a batch.
+type BatchStateTransition struct {
+	ID        int64  `db:"id" json:"id"`
+	BatchID   int64  `db:"batchID" json:"batchID"`
+	FromState string `db:"fromState" json:"fromState"`
+	ToState   string `db:"toState" json:"toState"`
+	Timestamp string `db:"timestamp" json:"timestamp"`
+	Operator  string `db:"operator" json:"operator"`
+	Note      string `db:"note" json:"note"`
+	Forced    bool   `db:"forced" json:"forced"`
+}
+
+// Es2JournalEntry records a single ES2+ request/response exchange with
+// an SM-DP+.  Secrets in the request and response are redacted before
+// the entry is stored.  Iccids is a comma separated list of the ICCIDs
+// the request was about.
+type Es2JournalEntry struct {
+	ID                     int64  `db:"id" json:"id"`
+	Timestamp              string `db:"timestamp" json:"timestamp"`
+	ProfileVendor          string `db:"profileVendor" json:"profileVendor"`
+	Endpoint               string `db:"endpoint" json:"endpoint"`
+	Es2Function            string `db:"es2Function" json:"es2Function"`
+	FunctionCallIdentifier string `db:"functionCallIdentifier" json:"functionCallIdentifier"`
+	Iccids                 string `db:"iccids" json:"iccids"`
+	HTTPStatus             int    `db:"httpStatus" json:"httpStatus"`
+	LatencyMillis          int64  `db:"latencyMillis" json:"latencyMillis"`
+	Request                string `db:"request" json:"request"`
+	Response               string `db:"response" json:"response"`
+	Error                  string `db:"error" json:"error"`
+}
+
+// PendingEs2Operation is a state changing ES2+ call on a profile whose
+// outcome is not yet known, e.g. because the request timed out.  It is
+// kept so that the call can be retried with the same functionCallIdentifier,
+// also by a later run, after the profile status has been checked.
+type PendingEs2Operation struct {
+	ID                     int64  `db:"id" json:"id"`
+	ProfileVendor          string `db:"profileVendor" json:"profileVendor"`
+	Iccid                  string `db:"iccid" json:"iccid"`
+	Es2Function            string `db:"es2Function" json:"es2Function"`
+	FunctionCallIdentifier string `db:"functionCallIdentifier" json:"functionCallIdentifier"`
+	Created                string `db:"created" json:"created"`
+	Attempts               int    `db:"attempts" json:"attempts"`
+	LastError              string `db:"lastError" json:"lastError"`
+}
+
 // ProfileVendor represents sim profile vendors.  Instances can be
 // subject to JSON serialisation/deserialisation, and can be stored
 // in persistent storage.
@@ -60,4 +164,134 @@ type ProfileVendor struct {
 	Es2PlusHost        string `db:"es2PlusHostPath" json:"es2plusHostPath"`
 	Es2PlusPort        int    `db:"es2PlusPort" json:"es2plusPort"`
 	Es2PlusRequesterID string `db:"es2PlusRequesterId" json:"es2PlusRequesterId"`
+	SmdpAddress        string `db:"smdpAddress" json:"smdpAddress"`
+	StatusListSize     int    `db:"es2PlusStatusListSize" json:"es2PlusStatusListSize"`
+
+	// Transport tuning for the ES2+ client, zero values means "use the defaults".
+	RequestTimeoutMillis      int64 `db:"es2PlusRequestTimeoutMillis" json:"es2PlusRequestTimeoutMillis"`
+	TLSHandshakeTimeoutMillis int64 `db:"es2PlusTlsHandshakeTimeoutMillis" json:"es2PlusTlsHandshakeTimeoutMillis"`
+	MaxIdleConns              int   `db:"es2PlusMaxIdleConns" json:"es2PlusMaxIdleConns"`
+	MaxConnsPerHost           int   `db:"es2PlusMaxConnsPerHost" json:"es2PlusMaxConnsPerHost"`
+	HTTP2                     bool  `db:"es2PlusHttp2" json:"es2PlusHttp2"`
+
+	// Overload protection, zero values means "use the defaults".
+	BreakerThreshold  int   `db:"es2PlusBreakerThreshold" json:"es2PlusBreakerThreshold"`
+	BreakerOpenMillis int64 `db:"es2PlusBreakerOpenMillis" json:"es2PlusBreakerOpenMillis"`
+
+	// The ES2+ dialect spoken by the vendor's SM-DP+, empty values means "use the defaults".
+	// Field names are on the form "ourName=theirName,ourName2=theirName2".
+	ProtocolVersion string `db:"es2PlusProtocolVersion" json:"es2PlusProtocolVersion"`
+	BasePath        string `db:"es2PlusBasePath" json:"es2PlusBasePath"`
+	FieldNames      string `db:"es2PlusFieldNames" json:"es2PlusFieldNames"`
+
+	// Endpoints (host:port) to fail over to, in order, when the primary
+	// endpoint (Es2PlusHost:Es2PlusPort) is unavailable.  Comma separated.
+	FailoverEndpoints string `db:"es2PlusFailoverEndpoints" json:"es2PlusFailoverEndpoints"`
+
+	// URL of the HTTP CONNECT or SOCKS5 proxy the SM-DP+ is reached through,
+	// e.g. "socks5://user:env:PROXY_PASSWORD@proxy:1080", where the password
+	// is read from the environment variable PROXY_PASSWORD.  Empty means
+	// "connect directly".
+	Proxy string `db:"es2PlusProxy" json:"es2PlusProxy"`
+}
+
+// ProxySetting is the proxy used to reach an upload target, such as prime's
+// sim-inventory.  The target is on the form "host:port".  As for profile
+// vendors, a password in the proxy URL refers to an environment variable.
+type ProxySetting struct {
+	ID       int64  `db:"id" json:"id"`
+	Target   string `db:"target" json:"target"`
+	ProxyURL string `db:"proxyUrl" json:"proxyUrl"`
+}
+
+// The states of background jobs.  Jobs are QUEUED until a worker picks
+// them up, and go back to QUEUED if the worker stops before they are done,
+// to be resumed later.
+const (
+	JobQueued    = "QUEUED"
+	JobRunning   = "RUNNING"
+	JobSucceeded = "SUCCEEDED"
+	JobFailed    = "FAILED"
+	JobCancelled = "CANCELLED"
+)
+
+// Job is a long running bulk operation, such as activating all the profiles
+// in a batch, run in the background by a job worker.  Args is a JSON object
+// with the arguments of the job, e.g. the name of the batch.  The progress
+// counters are for the latest attempt at running the job, the failures of
+// all attempts are in the job log.
+type Job struct {
+	ID              int64  `db:"id" json:"id"`
+	Kind            string `db:"kind" json:"kind"`
+	Args            string `db:"args" json:"args"`
+	State           string `db:"state" json:"state"`
+	Submitted       string `db:"submitted" json:"submitted"`
+	SubmittedBy     string `db:"submittedBy" json:"submittedBy"`
+	Started         string `db:"started" json:"started"`
+	Finished        string `db:"finished" json:"finished"`
+	Worker          string `db:"worker" json:"worker"`
+	Heartbeat       string `db:"heartbeat" json:"heartbeat"`
+	Attempts        int    `db:"attempts" json:"attempts"`
+	CancelRequested bool   `db:"cancelRequested" json:"cancelRequested"`
+	Total           int    `db:"total" json:"total"`
+	Succeeded       int    `db:"succeeded" json:"succeeded"`
+	Failed          int    `db:"failed" json:"failed"`
+	Error           string `db:"error" json:"error"`
+}
+
+// The levels of job log entries.
+const (
+	JobLogInfo  = "INFO"
+	JobLogError = "ERROR"
+)
+
+// JobLogEntry is a line in the log of a job.  Errors concerning a single
+// profile have its ICCID.
+type JobLogEntry struct {
+	ID        int64  `db:"id" json:"id"`
+	JobID     int64  `db:"jobID" json:"jobID"`
+	Timestamp string `db:"timestamp" json:"timestamp"`
+	Level     string `db:"level" json:"level"`
+	Iccid     string `db:"iccid" json:"iccid"`
+	Message   string `db:"message" json:"message"`
+}
+
+// Import records a file that was imported into the profiles of a batch, by
+// Kind, the command that read it.  Header is the header parsed from the
+// file, as JSON.  Forced is set if the same file had been imported before.
+type Import struct {
+	ID           int64  `db:"id" json:"id"`
+	Kind         string `db:"kind" json:"kind"`
+	BatchID      int64  `db:"batchID" json:"batchID"`
+	FilePath     string `db:"filePath" json:"filePath"`
+	Sha256       string `db:"sha256" json:"sha256"`
+	Size         int64  `db:"size" json:"size"`
+	Header       string `db:"header" json:"header"`
+	Operator     string `db:"operator" json:"operator"`
+	Timestamp    string `db:"timestamp" json:"timestamp"`
+	RowsAffected int64  `db:"rowsAffected" json:"rowsAffected"`
+	Forced       bool   `db:"forced" json:"forced"`
+}
+
+// SimProfileFieldImport records the import that last set a field (a
+// SIM_PROFILE column) of a profile.
+type SimProfileFieldImport struct {
+	SimID    int64  `db:"simID" json:"simID"`
+	Field    string `db:"field" json:"field"`
+	ImportID int64  `db:"importID" json:"importID"`
+}
+
+// ProfileStateDrift records that the state of a profile in the local
+// database disagreed with the state the SM-DP+ reported for it.  An empty
+// SmdpState means that the SM-DP+ didn't know the profile.  Source is what
+// found the disagreement, e.g. the status synchronisation.
+type ProfileStateDrift struct {
+	ID                int64  `db:"id" json:"id"`
+	Timestamp         string `db:"timestamp" json:"timestamp"`
+	ProfileVendor     string `db:"profileVendor" json:"profileVendor"`
+	Iccid             string `db:"iccid" json:"iccid"`
+	LocalState        string `db:"localState" json:"localState"`
+	LocalStateUpdated string `db:"localStateUpdated" json:"localStateUpdated"`
+	SmdpState         string `db:"smdpState" json:"smdpState"`
+	Source            string `db:"source" json:"source"`
 }
@@ -0,0 +1,228 @@
+// Package proxytest provides local HTTP CONNECT and SOCKS5 proxies for
+// tests, in the spirit of net/http/httptest.
+package proxytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Proxy is a proxy listening on a local port.  It records the addresses
+// of the targets it has connected to.
+type Proxy struct {
+	// URL of the proxy, including the credentials it requires, if any.
+	URL string
+
+	listener net.Listener
+	username string
+	password string
+	mutex    sync.Mutex
+	targets  []string
+	wait     sync.WaitGroup
+}
+
+// NewConnectProxy starts an HTTP proxy supporting the CONNECT method.  If
+// the username is not empty, the proxy requires basic authentication.
+func NewConnectProxy(username string, password string) *Proxy {
+	return start("http", username, password, (*Proxy).serveConnect)
+}
+
+// NewSocks5Proxy starts a SOCKS5 proxy.  If the username is not empty, the
+// proxy requires username/password authentication.
+func NewSocks5Proxy(username string, password string) *Proxy {
+	return start("socks5", username, password, (*Proxy).serveSocks5)
+}
+
+func start(scheme string, username string, password string, serve func(*Proxy, net.Conn)) *Proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("proxytest: failed to listen: %v", err))
+	}
+
+	proxy := &Proxy{listener: listener, username: username, password: password}
+	credentials := ""
+	if username != "" {
+		credentials = username + ":" + password + "@"
+	}
+	proxy.URL = fmt.Sprintf("%s://%s%s", scheme, credentials, listener.Addr().String())
+
+	proxy.wait.Add(1)
+	go func() {
+		defer proxy.wait.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(proxy, conn)
+		}
+	}()
+	return proxy
+}
+
+// Targets returns the addresses the proxy has connected to, in order.
+func (proxy *Proxy) Targets() []string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return append([]string(nil), proxy.targets...)
+}
+
+// Close stops the proxy from accepting new connections.
+func (proxy *Proxy) Close() {
+	proxy.listener.Close()
+	proxy.wait.Wait()
+}
+
+func (proxy *Proxy) tunnel(client net.Conn, target string) (net.Conn, error) {
+	server, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	proxy.mutex.Lock()
+	proxy.targets = append(proxy.targets, target)
+	proxy.mutex.Unlock()
+	return server, nil
+}
+
+func pipe(client io.ReadWriteCloser, server net.Conn) {
+	go func() {
+		io.Copy(server, client)
+		server.Close()
+	}()
+	io.Copy(client, server)
+	client.Close()
+}
+
+func (proxy *Proxy) serveConnect(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if request.Method != "CONNECT" {
+		fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if proxy.username != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.username+":"+proxy.password))
+		if request.Header.Get("Proxy-Authorization") != expected {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			conn.Close()
+			return
+		}
+	}
+
+	server, err := proxy.tunnel(conn, request.Host)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		conn.Close()
+		return
+	}
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(&readerConn{Conn: conn, reader: reader}, server)
+}
+
+type readerConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (proxy *Proxy) serveSocks5(conn net.Conn) {
+	if err := proxy.socks5Handshake(conn); err != nil {
+		conn.Close()
+	}
+}
+
+func (proxy *Proxy) socks5Handshake(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	wanted := byte(0)
+	if proxy.username != "" {
+		wanted = 2
+	}
+	offered := false
+	for _, method := range methods {
+		offered = offered || method == wanted
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return fmt.Errorf("no acceptable method")
+	}
+	conn.Write([]byte{5, wanted})
+
+	if wanted == 2 {
+		version := make([]byte, 2)
+		if _, err := io.ReadFull(conn, version); err != nil {
+			return err
+		}
+		username := make([]byte, version[1])
+		io.ReadFull(conn, username)
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		password := make([]byte, length[0])
+		io.ReadFull(conn, password)
+		if string(username) != proxy.username || string(password) != proxy.password {
+			conn.Write([]byte{1, 1})
+			return fmt.Errorf("authentication failed")
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return err
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	server, err := proxy.tunnel(conn, target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	pipe(conn, server)
+	return nil
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/loltelutils"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
-	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
 
+	"io"
 	"log"
 	"os"
 	"regexp"
@@ -65,7 +65,7 @@ func parseVarOutLine(varOutLine string, result *map[string]int) error {
 
 	slashedFields := strings.Split(varOutSplit[1], "/")
 	for index, columnName := range slashedFields {
-		(*result)[columnName] = index
+		(*result)[strings.TrimSpace(columnName)] = index
 	}
 	return nil
 }
@@ -89,6 +89,13 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 
 	defer file.Close()
 
+	return ParseOutput(filePath, file)
+}
+
+// ParseOutput parses the contents of an output file read from a reader,
+// returning an OutputFileRecord.  The name is what the file is called in the
+// record and in errors.
+func ParseOutput(filePath string, reader io.Reader) (*OutputFileRecord, error) {
 
 	// Implement a state machine that parses an output file.
 
@@ -100,7 +107,7 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 		csvFieldMap:       make(map[string]int),
 	}
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 
 		// Read line, trim spaces in both ends.
@@ -157,6 +164,7 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 			}
 
 			rawIccid, imsi, ki := parseOutputLine(state, line)
+			opc := parseOptionalOutputField(state, line, "OPC")
 
 			iccidWithChecksum := rawIccid
 			if strings.HasSuffix(rawIccid, "F") {
@@ -170,7 +178,12 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 				IccidWithChecksum:    iccidWithChecksum,
 				IccidWithoutChecksum: iccidWithoutChecksum,
 				Imsi:                 imsi,
-				Ki:                   ki}
+				Ki:                   ki,
+				Opc:                  opc,
+				Pin1:                 parseOptionalOutputField(state, line, "PIN1"),
+				Pin2:                 parseOptionalOutputField(state, line, "PIN2"),
+				Puk1:                 parseOptionalOutputField(state, line, "PUK1"),
+				Puk2:                 parseOptionalOutputField(state, line, "PUK2")}
 			state.entries = append(state.entries, entry)
 
 		case unknownHeader:
@@ -182,7 +195,7 @@ func ParseOutputFile(filePath string) (*OutputFileRecord, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("couldn't read file '%s': %s", filePath, err)
 	}
 
 	countedNoOfEntries := len(state.entries)
@@ -233,6 +246,21 @@ func parseOutputLine(state parserState, s string) (string, string, string) {
 	return parsedString[state.csvFieldMap["ICCID"]], parsedString[state.csvFieldMap["IMSI"]], parsedString[state.csvFieldMap["KI"]]
 }
 
+// parseOptionalOutputField returns the value of a column that some, but not
+// all, profile vendors include in their output files.  If the column
+// isn't declared in the var_out line, the empty string is returned.
+func parseOptionalOutputField(state parserState, s string, columnName string) string {
+	index, present := state.csvFieldMap[columnName]
+	if !present {
+		return ""
+	}
+	parsedString := strings.Split(s, " ")
+	if index >= len(parsedString) {
+		return ""
+	}
+	return parsedString[index]
+}
+
 func transitionMode(state *parserState, targetState string) {
 	state.currentState = targetState
 }
@@ -262,50 +290,3 @@ func isComment(s string) bool {
 	match, _ := regexp.MatchString("^\\*+$", s)
 	return match
 }
-
-// fileExists checks if a file exists and is not a directory before we
-// try using it to prevent further errors.
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
-	}
-	return !info.IsDir()
-}
-
-// TODO: Move this into some other package. "hssoutput" or something.
-
-
-// WriteHssCsvFile  will write all sim profile instances associated to a
-// batch object to a file located at filepath.
-func WriteHssCsvFile(filepath string, sdb *store.SimBatchDB, batch *model.Batch) error {
-
-	if fileExists(filepath) {
-		return fmt.Errorf("output file already exists.  '%s'", filepath)
-	}
-
-	f, err := os.Create(filepath)
-	if err != nil {
-		return fmt.Errorf("couldn't create hss csv file '%s', %v", filepath, err)
-	}
-
-	if _, err = f.WriteString("ICCID, IMSI, KI\n"); err != nil {
-		return fmt.Errorf("couldn't header to  hss csv file '%s', %v", filepath, err)
-	}
-
-	entries, err := sdb.GetAllSimEntriesForBatch(batch.BatchID)
-	if err != nil {
-		return err
-	}
-
-	max := 0
-	for i, entry := range entries {
-		s := fmt.Sprintf("%s, %s, %s\n", entry.IccidWithChecksum, entry.Imsi, entry.Ki)
-		if _, err = f.WriteString(s); err != nil {
-			return fmt.Errorf("couldn't write to  hss csv file '%s', %v", filepath, err)
-		}
-		max = i + 1
-	}
-	fmt.Println("Successfully written ", max, " sim card records.")
-	return f.Close()
-}
@@ -3,6 +3,7 @@ package outfileparser
 import (
 	"fmt"
 	"gotest.tools/assert"
+	"strings"
 	"testing"
 )
 
@@ -74,3 +75,28 @@ func TestParseOutputVariablesLine(t *testing.T) {
 	assert.Equal(t, m["ADM3"], 12)
 	assert.Equal(t, m["ADM4"], 13)
 }
+
+func TestParseOutput(t *testing.T) {
+	contents := "*HEADER DESCRIPTION\n" +
+		"***************************************\n" +
+		"Customer        : Footel\n" +
+		"ProfileType     : BAR_FOOTEL_STD\n" +
+		"Quantity        : 2\n" +
+		"***************************************\n" +
+		"*OUTPUT VARIABLES\n" +
+		"***************************************\n" +
+		"var_Out: ICCID/IMSI/KI/OPC\n" +
+		"8947000000000012141 242017100011213 00112233445566778899AABBCCDDEEFF FFEEDDCCBBAA99887766554433221100\n" +
+		"8947000000000012158 242017100011214 102132435465768798A9BACBDCEDFE0F F0EFDECDBCAB9A8978695A4B3C2D1E0F\n"
+
+	record, err := ParseOutput("in-memory.out", strings.NewReader(contents))
+	assert.NilError(t, err)
+	assert.Equal(t, "in-memory.out", record.Filename)
+	assert.Equal(t, 2, record.NoOfEntries)
+	assert.Equal(t, "8947000000000012158", record.Entries[1].IccidWithChecksum)
+	assert.Equal(t, "242017100011214", record.Entries[1].Imsi)
+	assert.Equal(t, "F0EFDECDBCAB9A8978695A4B3C2D1E0F", record.Entries[1].Opc)
+
+	_, err = ParseOutput("in-memory.out", strings.NewReader(strings.Replace(contents, "Quantity        : 2", "Quantity        : 3", 1)))
+	assert.ErrorContains(t, err, "mismatch")
+}
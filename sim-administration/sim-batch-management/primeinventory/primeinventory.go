@@ -0,0 +1,240 @@
+// Package primeinventory is a client for prime's sim-inventory, used to find
+// out what prime holds for the profiles sbm has uploaded to it, and to verify
+// that an uploaded batch landed completely.
+package primeinventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/bulkexecutor"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SimEntry is a profile as prime's sim-inventory returns it.
+type SimEntry struct {
+	ID              int64  `json:"id"`
+	Batch           int64  `json:"batch"`
+	HssID           int64  `json:"hssId"`
+	ProfileVendorID int64  `json:"profileVendorId"`
+	Msisdn          string `json:"msisdn"`
+	Iccid           string `json:"iccid"`
+	Imsi            string `json:"imsi"`
+	Eid             string `json:"eid"`
+	Profile         string `json:"profile"`
+	HssState        string `json:"hssState"`
+	SmdpPlusState   string `json:"smdpPlusState"`
+	ProvisionState  string `json:"provisionState"`
+	MatchingID      string `json:"matchingId"`
+}
+
+// DefaultWorkers is the number of concurrent requests made when listing
+// profiles, unless the client says otherwise.
+const DefaultWorkers = 8
+
+// Client talks to the sim-inventory of a single HSS in prime, about the
+// profiles of a single profile vendor.
+type Client struct {
+	HTTPClient *http.Client
+
+	// BaseURL is the scheme, host and port of prime, e.g. "http://prime:8080".
+	BaseURL string
+
+	// Hss is the name of the HSS the profiles belong to.
+	Hss string
+
+	// ProfileVendor is the name prime knows the profile vendor by.
+	ProfileVendor string
+
+	// BearerToken, if not empty, is sent in an "Authorization: Bearer" header.
+	BearerToken string
+
+	// Workers is the number of concurrent requests made when listing
+	// profiles, zero means DefaultWorkers.
+	Workers int
+}
+
+// The upload URLs are made by DeclareBatch in the store, as
+// "<base>/ostelco/sim-inventory/<hss>/import-batch/profilevendor/<vendor>?initialHssState=<state>".
+var uploadURLSyntax = regexp.MustCompile("^(.*)/ostelco/sim-inventory/([^/]+)/import-batch/profilevendor/([^/?]+)")
+
+// NewClientForBatch creates a client for the sim-inventory a batch is
+// uploaded to, given the upload URL recorded with the batch.
+func NewClientForBatch(httpClient *http.Client, batchURL string, bearerToken string) (*Client, error) {
+	match := uploadURLSyntax.FindStringSubmatch(batchURL)
+	if match == nil {
+		return nil, fmt.Errorf("not a sim-inventory upload URL: '%s'", batchURL)
+	}
+	hss, err := url.PathUnescape(match[2])
+	if err != nil {
+		return nil, fmt.Errorf("not a sim-inventory upload URL: '%s': %s", batchURL, err)
+	}
+	profileVendor, err := url.PathUnescape(match[3])
+	if err != nil {
+		return nil, fmt.Errorf("not a sim-inventory upload URL: '%s': %s", batchURL, err)
+	}
+	return &Client{
+		HTTPClient:    httpClient,
+		BaseURL:       match[1],
+		Hss:           hss,
+		ProfileVendor: profileVendor,
+		BearerToken:   bearerToken,
+	}, nil
+}
+
+func (client *Client) inventoryURL(path ...string) string {
+	var escaped []string
+	for _, element := range path {
+		escaped = append(escaped, url.PathEscape(element))
+	}
+	return fmt.Sprintf("%s/ostelco/sim-inventory/%s/%s", strings.TrimSuffix(client.BaseURL, "/"), url.PathEscape(client.Hss), strings.Join(escaped, "/"))
+}
+
+// GetByIccid gets a profile from prime, nil if prime doesn't have it.
+func (client *Client) GetByIccid(ctx context.Context, iccid string) (*SimEntry, error) {
+	entry := &SimEntry{}
+	found, err := client.get(ctx, client.inventoryURL("iccid", iccid), entry)
+	if err != nil || !found {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// ListProfiles gets the profiles prime has of the given ICCIDs, in the same
+// order, leaving out the ones prime doesn't have.  Prime's sim-inventory
+// can only be asked about one ICCID at a time, so they are asked about
+// concurrently.
+func (client *Client) ListProfiles(ctx context.Context, iccids []string) ([]SimEntry, error) {
+	workers := client.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	found := make(map[string]*SimEntry)
+	summary := bulkexecutor.Run(ctx, workers, iccids, func(ctx context.Context, iccid string) (interface{}, error) {
+		return client.GetByIccid(ctx, iccid)
+	}, func(result bulkexecutor.Result) {
+		if entry, _ := result.Value.(*SimEntry); result.Err == nil && entry != nil {
+			found[result.Iccid] = entry
+		}
+	})
+	if len(summary.Failed) > 0 {
+		return nil, fmt.Errorf("couldn't get %d profiles from prime, the first one: %s", len(summary.Failed), summary.Failed[0].Err)
+	}
+	if len(summary.NotAttempted) > 0 {
+		return nil, fmt.Errorf("stopped getting the profiles from prime: %s", ctx.Err())
+	}
+
+	var entries []SimEntry
+	for _, iccid := range iccids {
+		if entry, ok := found[iccid]; ok {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, nil
+}
+
+// Mismatch is a profile prime has with other values than we have.
+type Mismatch struct {
+	Iccid string
+	Field string
+	Local string
+	Prime string
+}
+
+// Verification is the outcome of verifying that an uploaded batch landed in prime.
+type Verification struct {
+	// Expected is the number of profiles in the batch, and Found the number
+	// of them prime has.
+	Expected int
+	Found    int
+
+	// Missing are the ICCIDs of the profiles prime doesn't have.
+	Missing []string
+
+	// Mismatched are the profiles prime has with another IMSI or MSISDN.
+	Mismatched []Mismatch
+}
+
+// Complete tells if prime has all the profiles, with the right values.
+func (verification *Verification) Complete() bool {
+	return len(verification.Missing) == 0 && len(verification.Mismatched) == 0
+}
+
+// VerifyBatch checks that prime has all the profiles in a batch, with the
+// IMSIs and MSISDNs we have for them.
+func (client *Client) VerifyBatch(ctx context.Context, entries []model.SimEntry) (*Verification, error) {
+	var iccids []string
+	for _, entry := range entries {
+		iccids = append(iccids, entry.Iccid)
+	}
+	profiles, err := client.ListProfiles(ctx, iccids)
+	if err != nil {
+		return nil, err
+	}
+	inPrime := make(map[string]SimEntry)
+	for _, profile := range profiles {
+		inPrime[profile.Iccid] = profile
+	}
+
+	verification := &Verification{Expected: len(entries)}
+	for _, entry := range entries {
+		profile, found := inPrime[entry.Iccid]
+		if !found {
+			verification.Missing = append(verification.Missing, entry.Iccid)
+			continue
+		}
+		verification.Found++
+		if profile.Imsi != entry.Imsi {
+			verification.Mismatched = append(verification.Mismatched, Mismatch{Iccid: entry.Iccid, Field: "IMSI", Local: entry.Imsi, Prime: profile.Imsi})
+		}
+		if profile.Msisdn != entry.Msisdn {
+			verification.Mismatched = append(verification.Mismatched, Mismatch{Iccid: entry.Iccid, Field: "MSISDN", Local: entry.Msisdn, Prime: profile.Msisdn})
+		}
+	}
+	return verification, nil
+}
+
+// get GETs JSON from prime into result.  Returns false if prime responds
+// that there is no such thing.
+func (client *Client) get(ctx context.Context, url string, result interface{}) (bool, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if client.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+client.BearerToken)
+	}
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("prime responded with HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, result); err != nil {
+		return false, fmt.Errorf("couldn't parse response from prime '%s': %v", strings.TrimSpace(string(body)), err)
+	}
+	return true, nil
+}
@@ -0,0 +1,131 @@
+package primeinventory
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePrime is a stand-in for the sim-inventory of the HSS "M1", knowing
+// the profiles of the profile vendor "Idemia".
+type fakePrime struct {
+	profiles []SimEntry
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (prime *fakePrime) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prime.mutex.Lock()
+	prime.requests = append(prime.requests, r.URL.RequestURI())
+	prime.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/ostelco/sim-inventory/M1/iccid/"):
+		iccid := strings.TrimPrefix(r.URL.Path, "/ostelco/sim-inventory/M1/iccid/")
+		for _, profile := range prime.profiles {
+			if profile.Iccid == iccid {
+				json.NewEncoder(w).Encode(profile)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestClient(t *testing.T, profiles []SimEntry) (*Client, *fakePrime, func()) {
+	prime := &fakePrime{profiles: profiles}
+	server := httptest.NewServer(prime)
+	batchURL := server.URL + "/ostelco/sim-inventory/M1/import-batch/profilevendor/Idemia?initialHssState=ACTIVATED"
+	client, err := NewClientForBatch(server.Client(), batchURL, "secret")
+	assert.NilError(t, err)
+	return client, prime, server.Close
+}
+
+func TestNewClientForBatch(t *testing.T) {
+	client, err := NewClientForBatch(nil, "http://prime:8080/ostelco/sim-inventory/M1/import-batch/profilevendor/Idemia?initialHssState=ACTIVATED", "")
+	assert.NilError(t, err)
+	assert.Equal(t, "http://prime:8080", client.BaseURL)
+	assert.Equal(t, "M1", client.Hss)
+	assert.Equal(t, "Idemia", client.ProfileVendor)
+
+	_, err = NewClientForBatch(nil, "http://prime:8080/some/where/else", "")
+	assert.ErrorContains(t, err, "not a sim-inventory upload URL")
+}
+
+func TestGetByIccid(t *testing.T) {
+	client, _, stop := newTestClient(t, []SimEntry{{Iccid: "8947000000000012140", Imsi: "242017100011213", SmdpPlusState: "RELEASED"}})
+	defer stop()
+
+	entry, err := client.GetByIccid(context.Background(), "8947000000000012140")
+	assert.NilError(t, err)
+	assert.Equal(t, "242017100011213", entry.Imsi)
+	assert.Equal(t, "RELEASED", entry.SmdpPlusState)
+
+	entry, err = client.GetByIccid(context.Background(), "8947000000000012157")
+	assert.NilError(t, err)
+	assert.Assert(t, entry == nil)
+
+	client.BearerToken = "wrong"
+	_, err = client.GetByIccid(context.Background(), "8947000000000012140")
+	assert.ErrorContains(t, err, "prime responded with HTTP status 401")
+}
+
+func TestListProfiles(t *testing.T) {
+	var profiles []SimEntry
+	for i := 0; i < 5; i++ {
+		profiles = append(profiles, SimEntry{Iccid: strconv.Itoa(i)})
+	}
+	client, prime, stop := newTestClient(t, profiles)
+	defer stop()
+	client.Workers = 2
+
+	listed, err := client.ListProfiles(context.Background(), []string{"4", "7", "0", "2"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []SimEntry{profiles[4], profiles[0], profiles[2]}, listed)
+	assert.Equal(t, 4, len(prime.requests))
+
+	client.BearerToken = "wrong"
+	_, err = client.ListProfiles(context.Background(), []string{"1", "2"})
+	assert.ErrorContains(t, err, "couldn't get 2 profiles from prime")
+}
+
+func TestVerifyBatch(t *testing.T) {
+	client, _, stop := newTestClient(t, []SimEntry{
+		{Iccid: "1", Imsi: "2420100000001", Msisdn: "4790000001"},
+		{Iccid: "2", Imsi: "2420100000002", Msisdn: "4790000099"},
+		{Iccid: "99", Imsi: "2420100000099"},
+	})
+	defer stop()
+
+	entries := []model.SimEntry{
+		{Iccid: "1", Imsi: "2420100000001", Msisdn: "4790000001"},
+		{Iccid: "2", Imsi: "2420100000002", Msisdn: "4790000002"},
+		{Iccid: "3", Imsi: "2420100000003", Msisdn: "4790000003"},
+	}
+	verification, err := client.VerifyBatch(context.Background(), entries)
+	assert.NilError(t, err)
+	assert.Assert(t, !verification.Complete())
+	assert.Equal(t, 3, verification.Expected)
+	assert.Equal(t, 2, verification.Found)
+	assert.DeepEqual(t, []string{"3"}, verification.Missing)
+	assert.DeepEqual(t, []Mismatch{{Iccid: "2", Field: "MSISDN", Local: "4790000002", Prime: "4790000099"}}, verification.Mismatched)
+
+	verification, err = client.VerifyBatch(context.Background(), entries[:1])
+	assert.NilError(t, err)
+	assert.Assert(t, verification.Complete())
+}
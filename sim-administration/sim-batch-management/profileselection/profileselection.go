@@ -0,0 +1,168 @@
+// Package profileselection picks out the profiles in a batch that a bulk
+// operation, such as cancelling orders or recovering profiles, should be
+// applied to.  Profiles can be selected by ICCID range, by MSISDN, by an
+// explicit list of ICCIDs (e.g. from a CSV file), and by their current state
+// in the SM-DP+.
+package profileselection
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"io"
+	"os"
+	"strings"
+)
+
+// Criteria for selecting profiles.  Empty criteria match all profiles, and
+// a profile must match all the non-empty criteria to be selected.
+type Criteria struct {
+	// FirstIccid and LastIccid give an inclusive range of ICCIDs, either
+	// end can be left open.
+	FirstIccid string
+	LastIccid  string
+
+	// Iccids and Msisdns are explicit lists of profiles.
+	Iccids  []string
+	Msisdns []string
+
+	// States are the states in the SM-DP+ the profiles must be in.
+	States []string
+}
+
+// Skipped is a profile that matched the criteria, but that the operation
+// can't be applied to.
+type Skipped struct {
+	Entry  model.SimEntry
+	State  string
+	Reason string
+}
+
+// Selection is the result of selecting profiles.
+type Selection struct {
+	Selected []model.SimEntry
+	States   map[string]string
+	Skipped  []Skipped
+}
+
+// compareIccids compares two ICCIDs numerically.
+func compareIccids(a string, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[strings.TrimSpace(value)] = true
+	}
+	return set
+}
+
+// SelectByProfile returns the profiles matching all the criteria that don't
+// depend on the state in the SM-DP+, in the order they are given.
+func SelectByProfile(entries []model.SimEntry, criteria Criteria) []model.SimEntry {
+	iccids := toSet(criteria.Iccids)
+	msisdns := toSet(criteria.Msisdns)
+
+	var result []model.SimEntry
+	for _, entry := range entries {
+		if criteria.FirstIccid != "" && compareIccids(entry.Iccid, criteria.FirstIccid) < 0 {
+			continue
+		}
+		if criteria.LastIccid != "" && compareIccids(entry.Iccid, criteria.LastIccid) > 0 {
+			continue
+		}
+		if iccids != nil && !iccids[entry.Iccid] {
+			continue
+		}
+		if msisdns != nil && !msisdns[entry.Msisdn] {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// SelectByState narrows down profiles to those in the states given by the
+// criteria, and that the operation can be applied to, as told by the check
+// function.  Profiles with no known state are skipped.
+func SelectByState(entries []model.SimEntry, states map[string]string, criteria Criteria, check func(state string) error) Selection {
+	wanted := toSet(criteria.States)
+	selection := Selection{States: make(map[string]string)}
+
+	for _, entry := range entries {
+		state, known := states[entry.Iccid]
+		if wanted != nil && !wanted[state] {
+			continue
+		}
+		if !known {
+			selection.Skipped = append(selection.Skipped, Skipped{Entry: entry, Reason: "no status from the SM-DP+"})
+			continue
+		}
+		if err := check(state); err != nil {
+			selection.Skipped = append(selection.Skipped, Skipped{Entry: entry, State: state, Reason: err.Error()})
+			continue
+		}
+		selection.Selected = append(selection.Selected, entry)
+		selection.States[entry.Iccid] = state
+	}
+	return selection
+}
+
+// ReadColumn reads the values of a column from a CSV file.  If the first line
+// has a field named as the column (case insensitive), it is taken to be a
+// header, otherwise the values are taken from the first column of every line.
+func ReadColumn(path string, column string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	index := 0
+	var values []string
+	for lineNo := 1; ; lineNo++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read '%s': %v", path, err)
+		}
+
+		if lineNo == 1 {
+			isHeader := false
+			for i, field := range record {
+				if strings.EqualFold(strings.TrimSpace(field), column) {
+					index = i
+					isHeader = true
+				}
+			}
+			if isHeader {
+				continue
+			}
+		}
+
+		if index >= len(record) {
+			return nil, fmt.Errorf("no %s value on line %d of '%s'", column, lineNo, path)
+		}
+		if value := strings.TrimSpace(record[index]); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,89 @@
+package profileselection
+
+import (
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testEntries = []model.SimEntry{
+	{Iccid: "8947000000000012141", Msisdn: "4790000001"},
+	{Iccid: "8947000000000012158", Msisdn: "4790000002"},
+	{Iccid: "8947000000000012166", Msisdn: "4790000003"},
+	{Iccid: "8947000000000012174", Msisdn: "4790000004"},
+}
+
+func iccidsOf(entries []model.SimEntry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Iccid)
+	}
+	return result
+}
+
+func TestSelectByProfile(t *testing.T) {
+	assert.Equal(t, 4, len(SelectByProfile(testEntries, Criteria{})))
+
+	assert.DeepEqual(t, []string{"8947000000000012158", "8947000000000012166"},
+		iccidsOf(SelectByProfile(testEntries, Criteria{FirstIccid: "8947000000000012150", LastIccid: "8947000000000012166"})))
+
+	assert.DeepEqual(t, []string{"8947000000000012141", "8947000000000012174"},
+		iccidsOf(SelectByProfile(testEntries, Criteria{Msisdns: []string{"4790000001", "4790000004"}})))
+
+	assert.DeepEqual(t, []string{"8947000000000012174"},
+		iccidsOf(SelectByProfile(testEntries, Criteria{Msisdns: []string{"4790000001", "4790000004"}, FirstIccid: "8947000000000012142"})))
+
+	assert.DeepEqual(t, []string{"8947000000000012166"},
+		iccidsOf(SelectByProfile(testEntries, Criteria{Iccids: []string{"8947000000000012166", "8947000000000099999"}})))
+}
+
+func TestSelectByState(t *testing.T) {
+	states := map[string]string{
+		"8947000000000012141": "RELEASED",
+		"8947000000000012158": "AVAILABLE",
+		"8947000000000012166": "ALLOCATED",
+	}
+	check := func(state string) error {
+		if state == "AVAILABLE" {
+			return fmt.Errorf("already available")
+		}
+		return nil
+	}
+
+	selection := SelectByState(testEntries, states, Criteria{}, check)
+	assert.DeepEqual(t, []string{"8947000000000012141", "8947000000000012166"}, iccidsOf(selection.Selected))
+	assert.Equal(t, "ALLOCATED", selection.States["8947000000000012166"])
+	assert.Equal(t, 2, len(selection.Skipped))
+	assert.Equal(t, "already available", selection.Skipped[0].Reason)
+	assert.Equal(t, "no status from the SM-DP+", selection.Skipped[1].Reason)
+
+	selection = SelectByState(testEntries, states, Criteria{States: []string{"RELEASED"}}, check)
+	assert.DeepEqual(t, []string{"8947000000000012141"}, iccidsOf(selection.Selected))
+	assert.Equal(t, 0, len(selection.Skipped))
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "profileselection-*.csv")
+	assert.NilError(t, err)
+	defer file.Close()
+	_, err = file.WriteString(content)
+	assert.NilError(t, err)
+	return file.Name()
+}
+
+func TestReadColumn(t *testing.T) {
+	withHeader := writeTempFile(t, "MSISDN, ICCID\n4790000001, 8947000000000012141\n4790000002, 8947000000000012158\n")
+	defer os.Remove(withHeader)
+	values, err := ReadColumn(withHeader, "iccid")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"8947000000000012141", "8947000000000012158"}, values)
+
+	plainList := writeTempFile(t, "8947000000000012141\n\n8947000000000012158\n")
+	defer os.Remove(plainList)
+	values, err = ReadColumn(plainList, "ICCID")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"8947000000000012141", "8947000000000012158"}, values)
+}
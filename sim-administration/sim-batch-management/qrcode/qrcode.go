@@ -0,0 +1,583 @@
+// Package qrcode is a small, pure Go QR code encoder (ISO/IEC 18004).
+// It only supports what we need for eSIM activation codes: byte mode
+// encoding in versions 1 to 10, which is enough for payloads of up to
+// 271 bytes at the lowest error correction level.
+package qrcode
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// ErrorCorrectionLevel is the amount of redundancy added to the code.
+type ErrorCorrectionLevel int
+
+// The four error correction levels, recovering respectively about
+// 7%, 15%, 25% and 30% of damaged codewords.
+const (
+	Low ErrorCorrectionLevel = iota
+	Medium
+	Quartile
+	High
+)
+
+// MaxVersion is the largest QR code version this package can generate.
+const MaxVersion = 10
+
+// blockSpec describes the error correction block structure of one
+// version/level combination: the number of EC codewords per block, and
+// up to two groups of blocks with a given number of data codewords.
+type blockSpec struct {
+	ecPerBlock int
+	group1     int
+	group1Data int
+	group2     int
+	group2Data int
+}
+
+// blockSpecs is indexed by version-1 and error correction level.
+var blockSpecs = [MaxVersion][4]blockSpec{
+	{{7, 1, 19, 0, 0}, {10, 1, 16, 0, 0}, {13, 1, 13, 0, 0}, {17, 1, 9, 0, 0}},
+	{{10, 1, 34, 0, 0}, {16, 1, 28, 0, 0}, {22, 1, 22, 0, 0}, {28, 1, 16, 0, 0}},
+	{{15, 1, 55, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 17, 0, 0}, {22, 2, 13, 0, 0}},
+	{{20, 1, 80, 0, 0}, {18, 2, 32, 0, 0}, {26, 2, 24, 0, 0}, {16, 4, 9, 0, 0}},
+	{{26, 1, 108, 0, 0}, {24, 2, 43, 0, 0}, {18, 2, 15, 2, 16}, {22, 2, 11, 2, 12}},
+	{{18, 2, 68, 0, 0}, {16, 4, 27, 0, 0}, {24, 4, 19, 0, 0}, {28, 4, 15, 0, 0}},
+	{{20, 2, 78, 0, 0}, {18, 4, 31, 0, 0}, {18, 2, 14, 4, 15}, {26, 4, 13, 1, 14}},
+	{{24, 2, 97, 0, 0}, {22, 2, 38, 2, 39}, {22, 4, 18, 2, 19}, {26, 4, 14, 2, 15}},
+	{{30, 2, 116, 0, 0}, {22, 3, 36, 2, 37}, {20, 4, 16, 4, 17}, {24, 4, 12, 4, 13}},
+	{{18, 2, 68, 2, 69}, {26, 4, 43, 1, 44}, {24, 6, 19, 2, 20}, {28, 6, 15, 2, 16}},
+}
+
+// alignmentPatternPositions is indexed by version-1.
+var alignmentPatternPositions = [MaxVersion][]int{
+	{},
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+}
+
+// formatBits are the two bits identifying the error correction level in
+// the format information.
+var formatBits = [4]int{1, 0, 3, 2}
+
+func (spec blockSpec) dataCodewords() int {
+	return spec.group1*spec.group1Data + spec.group2*spec.group2Data
+}
+
+// Code is an encoded QR code.
+type Code struct {
+	Version int
+	Level   ErrorCorrectionLevel
+	Mask    int
+	Size    int
+
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// Encode encodes the content in byte mode, using the smallest version
+// that can hold it at the given error correction level, and the mask
+// giving the lowest penalty score.
+func Encode(content string, level ErrorCorrectionLevel) (*Code, error) {
+	return EncodeWithMask(content, level, -1)
+}
+
+// EncodeWithMask is like Encode, but uses a fixed mask pattern (0-7). A
+// negative mask means that the best mask is selected automatically.
+func EncodeWithMask(content string, level ErrorCorrectionLevel, mask int) (*Code, error) {
+	if level < Low || level > High {
+		return nil, fmt.Errorf("unknown error correction level %d", level)
+	}
+	if mask > 7 {
+		return nil, fmt.Errorf("mask must be in the range 0-7, was %d", mask)
+	}
+
+	data := []byte(content)
+	version := 0
+	for v := 1; v <= MaxVersion; v++ {
+		if 4+characterCountBits(v)+8*len(data) <= 8*blockSpecs[v-1][level].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("content of %d bytes too long for a version %d QR code", len(data), MaxVersion)
+	}
+
+	codewords := addErrorCorrection(encodeData(data, version, level), blockSpecs[version-1][level])
+
+	code := newCode(version, level)
+	code.drawFunctionPatterns()
+	code.drawCodewords(codewords)
+
+	if mask < 0 {
+		bestPenalty := -1
+		for m := 0; m < 8; m++ {
+			code.applyMask(m)
+			code.drawFormatBits(m)
+			penalty := code.penalty()
+			if bestPenalty < 0 || penalty < bestPenalty {
+				bestPenalty = penalty
+				mask = m
+			}
+			code.applyMask(m) // Masking twice undoes it.
+		}
+	}
+
+	code.applyMask(mask)
+	code.drawFormatBits(mask)
+	code.Mask = mask
+	return code, nil
+}
+
+// Black tells if the module at column x, row y is dark.
+func (c *Code) Black(x int, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+// Image renders the code with each module being moduleSize pixels wide,
+// surrounded by the mandatory four module wide quiet zone.
+func (c *Code) Image(moduleSize int) image.Image {
+	if moduleSize < 1 {
+		moduleSize = 1
+	}
+	const quietZone = 4
+	dimension := (c.Size + 2*quietZone) * moduleSize
+	img := image.NewPaletted(image.Rect(0, 0, dimension, dimension), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < moduleSize; dy++ {
+				for dx := 0; dx < moduleSize; dx++ {
+					img.SetColorIndex((x+quietZone)*moduleSize+dx, (y+quietZone)*moduleSize+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// WritePNG writes the code as a PNG image.
+func (c *Code) WritePNG(w io.Writer, moduleSize int) error {
+	return png.Encode(w, c.Image(moduleSize))
+}
+
+///
+///  Data encoding and error correction
+///
+
+func characterCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+type bitBuffer struct {
+	bytes []byte
+	nbits int
+}
+
+func (b *bitBuffer) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		if b.nbits%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if (value>>uint(i))&1 != 0 {
+			b.bytes[b.nbits/8] |= 0x80 >> uint(b.nbits%8)
+		}
+		b.nbits++
+	}
+}
+
+// encodeData produces the data codewords: mode indicator, character
+// count, the data itself, terminator and padding.
+func encodeData(data []byte, version int, level ErrorCorrectionLevel) []byte {
+	capacityBits := 8 * blockSpecs[version-1][level].dataCodewords()
+
+	buffer := &bitBuffer{}
+	buffer.append(0x4, 4) // Byte mode
+	buffer.append(len(data), characterCountBits(version))
+	for _, b := range data {
+		buffer.append(int(b), 8)
+	}
+
+	terminator := capacityBits - buffer.nbits
+	if terminator > 4 {
+		terminator = 4
+	}
+	buffer.append(0, terminator)
+	buffer.append(0, (8-buffer.nbits%8)%8)
+
+	for pad := 0xEC; buffer.nbits < capacityBits; pad ^= 0xEC ^ 0x11 {
+		buffer.append(pad, 8)
+	}
+	return buffer.bytes
+}
+
+// addErrorCorrection splits the data into blocks, computes the Reed-Solomon
+// error correction codewords for each block, and interleaves the result.
+func addErrorCorrection(data []byte, spec blockSpec) []byte {
+	var dataBlocks [][]byte
+	var ecBlocks [][]byte
+	generator := rsGenerator(spec.ecPerBlock)
+
+	offset := 0
+	for i := 0; i < spec.group1+spec.group2; i++ {
+		length := spec.group1Data
+		if i >= spec.group1 {
+			length = spec.group2Data
+		}
+		block := data[offset : offset+length]
+		offset += length
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, generator))
+	}
+
+	var result []byte
+	maxDataLength := spec.group1Data
+	if spec.group2Data > maxDataLength {
+		maxDataLength = spec.group2Data
+	}
+	for i := 0; i < maxDataLength; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies two elements of GF(2^8) modulo x^8+x^4+x^3+x^2+1.
+func gfMultiply(x byte, y byte) byte {
+	result := 0
+	for i := 7; i >= 0; i-- {
+		result = (result << 1) ^ ((result >> 7) * 0x11D)
+		result ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(result)
+}
+
+// rsGenerator returns the coefficients, highest power first and excluding
+// the leading 1, of the generator polynomial (x - a^0)(x - a^1)...(x - a^(degree-1)).
+func rsGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder computes the error correction codewords for a block of data.
+func rsRemainder(data []byte, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range generator {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+///
+///  Module placement
+///
+
+func newCode(version int, level ErrorCorrectionLevel) *Code {
+	size := 17 + 4*version
+	code := &Code{Version: version, Level: level, Size: size}
+	code.modules = make([][]bool, size)
+	code.isFunction = make([][]bool, size)
+	for i := range code.modules {
+		code.modules[i] = make([]bool, size)
+		code.isFunction[i] = make([]bool, size)
+	}
+	return code
+}
+
+func (c *Code) setFunctionModule(x int, y int, black bool) {
+	c.modules[y][x] = black
+	c.isFunction[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	// Timing patterns
+	for i := 0; i < c.Size; i++ {
+		c.setFunctionModule(6, i, i%2 == 0)
+		c.setFunctionModule(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, including separators, in three corners
+	c.drawFinderPattern(3, 3)
+	c.drawFinderPattern(c.Size-4, 3)
+	c.drawFinderPattern(3, c.Size-4)
+
+	// Alignment patterns, except where they would overlap the finder patterns
+	positions := alignmentPatternPositions[c.Version-1]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignmentPattern(x, y)
+		}
+	}
+
+	// Reserve the format areas, they are drawn for real when the mask is known.
+	c.drawFormatBits(0)
+	c.drawVersion()
+}
+
+func (c *Code) drawFinderPattern(x int, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			distance := abs(dx)
+			if abs(dy) > distance {
+				distance = abs(dy)
+			}
+			c.setFunctionModule(xx, yy, distance != 2 && distance != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignmentPattern(x int, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			distance := abs(dx)
+			if abs(dy) > distance {
+				distance = abs(dy)
+			}
+			c.setFunctionModule(x+dx, y+dy, distance != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information, which
+// encodes the error correction level and the mask, protected by a BCH code.
+func (c *Code) drawFormatBits(mask int) {
+	data := formatBits[c.Level]<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	bits := (data<<10 | remainder) ^ 0x5412
+
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// First copy, around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		c.setFunctionModule(8, i, bit(i))
+	}
+	c.setFunctionModule(8, 7, bit(6))
+	c.setFunctionModule(8, 8, bit(7))
+	c.setFunctionModule(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunctionModule(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the two other finder patterns
+	for i := 0; i < 8; i++ {
+		c.setFunctionModule(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunctionModule(8, c.Size-15+i, bit(i))
+	}
+	c.setFunctionModule(8, c.Size-8, true) // The "dark module"
+}
+
+// drawVersion draws the two copies of the version information, only
+// present in versions 7 and up.
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+	remainder := c.Version
+	for i := 0; i < 12; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+	}
+	bits := c.Version<<12 | remainder
+
+	for i := 0; i < 18; i++ {
+		black := (bits>>uint(i))&1 != 0
+		a := c.Size - 11 + i%3
+		b := i / 3
+		c.setFunctionModule(a, b, black)
+		c.setFunctionModule(b, a, black)
+	}
+}
+
+// drawCodewords places the codewords in the zig-zag pattern, two columns
+// at a time from the bottom right corner, skipping the function patterns.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vertical := 0; vertical < c.Size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				upward := (right+1)&2 == 0
+				y := vertical
+				if upward {
+					y = c.Size - 1 - vertical
+				}
+				if c.isFunction[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = (codewords[i>>3]>>uint(7-i&7))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask pattern.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.isFunction[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty computes the penalty score used to select the mask pattern.
+func (c *Code) penalty() int {
+	result := 0
+
+	// Rule 1 and 3: runs of same colored modules, and finder-like
+	// patterns, in rows and columns.
+	for y := 0; y < c.Size; y++ {
+		result += c.linePenalty(func(i int) bool { return c.modules[y][i] })
+	}
+	for x := 0; x < c.Size; x++ {
+		result += c.linePenalty(func(i int) bool { return c.modules[i][x] })
+	}
+
+	// Rule 2: 2x2 blocks of same colored modules
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size {
+				color := c.modules[y][x]
+				if color == c.modules[y][x+1] && color == c.modules[y+1][x] && color == c.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+
+	// Rule 4: balance between dark and light modules
+	total := c.Size * c.Size
+	deviation := abs(dark*20 - total*10)
+	result += 10 * (deviation / total)
+
+	return result
+}
+
+var finderLikePatterns = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+func (c *Code) linePenalty(module func(int) bool) int {
+	result := 0
+	runLength := 1
+	for i := 1; i <= c.Size; i++ {
+		if i < c.Size && module(i) == module(i-1) {
+			runLength++
+			continue
+		}
+		if runLength >= 5 {
+			result += 3 + runLength - 5
+		}
+		runLength = 1
+	}
+
+	for i := 0; i+11 <= c.Size; i++ {
+		for _, pattern := range finderLikePatterns {
+			matches := true
+			for j, black := range pattern {
+				if module(i+j) != black {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				result += 40
+			}
+		}
+	}
+	return result
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,70 @@
+package qrcode
+
+import (
+	"bytes"
+	"gotest.tools/assert"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomonRemainder(t *testing.T) {
+	// The "HELLO WORLD" 1-M example from thonky.com's QR code tutorial.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	assert.DeepEqual(t, expected, rsRemainder(data, rsGenerator(10)))
+}
+
+func TestVersionSelection(t *testing.T) {
+	code, err := Encode(strings.Repeat("A", 17), Low)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, code.Version)
+	assert.Equal(t, 21, code.Size)
+
+	code, err = Encode(strings.Repeat("A", 18), Low)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, code.Version)
+
+	code, err = Encode(strings.Repeat("A", 271), Low)
+	assert.NilError(t, err)
+	assert.Equal(t, 10, code.Version)
+	assert.Equal(t, 57, code.Size)
+
+	_, err = Encode(strings.Repeat("A", 272), Low)
+	assert.Assert(t, err != nil)
+}
+
+func TestFormatBits(t *testing.T) {
+	// Level L with mask 4 gives the format string 110011000101111, that
+	// is drawn least significant bit first down column 8.
+	code, err := EncodeWithMask("LPA:1$smdp.example.com$ABCD-1234", Low, 4)
+	assert.NilError(t, err)
+	expected := []bool{true, true, true, true, false, true}
+	for i, black := range expected {
+		assert.Equal(t, black, code.Black(8, i), "format bit %d", i)
+	}
+	// The dark module is always dark.
+	assert.Assert(t, code.Black(8, code.Size-8))
+}
+
+func TestFinderPatterns(t *testing.T) {
+	code, err := Encode("LPA:1$smdp.example.com$ABCD-1234", Medium)
+	assert.NilError(t, err)
+	for _, corner := range [][2]int{{0, 0}, {code.Size - 7, 0}, {0, code.Size - 7}} {
+		assert.Assert(t, code.Black(corner[0], corner[1]))
+		assert.Assert(t, code.Black(corner[0]+3, corner[1]+3))
+		assert.Assert(t, !code.Black(corner[0]+1, corner[1]+1))
+	}
+}
+
+func TestWritePNG(t *testing.T) {
+	code, err := Encode("LPA:1$smdp.example.com$ABCD-1234", Medium)
+	assert.NilError(t, err)
+
+	buffer := &bytes.Buffer{}
+	assert.NilError(t, code.WritePNG(buffer, 4))
+
+	img, err := png.Decode(buffer)
+	assert.NilError(t, err)
+	assert.Equal(t, (code.Size+8)*4, img.Bounds().Dx())
+}
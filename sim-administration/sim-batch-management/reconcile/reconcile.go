@@ -0,0 +1,249 @@
+// Package reconcile compares what the three sources of truth about a
+// profile say about it: sbm's own database, the SM-DP+ and prime's
+// sim-inventory, and reports where they disagree.
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/primeinventory"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of disagreement.
+const (
+	MissingInSmdp          = "MISSING_IN_SMDP"
+	MissingInPrime         = "MISSING_IN_PRIME"
+	MsisdnMismatch         = "MSISDN_MISMATCH"
+	ImsiMismatch           = "IMSI_MISMATCH"
+	ActivationCodeMismatch = "ACTIVATION_CODE_MISMATCH"
+	StateConflict          = "STATE_CONFLICT"
+)
+
+// The fix-ups that can be applied to the local database.  Nothing is ever
+// changed in the SM-DP+ or in prime.
+const (
+	// FixLocalStates sets the local state (and EID) of profiles to the SM-DP+'s.
+	FixLocalStates = "local-states"
+
+	// FixLocalActivationCodes sets the local activation code of profiles to
+	// the SM-DP+'s.
+	FixLocalActivationCodes = "local-activation-codes"
+)
+
+// Fixes are the names of the fix-ups.
+var Fixes = []string{FixLocalStates, FixLocalActivationCodes}
+
+// Profile is what the three sources say about a profile.  Smdp and Prime
+// are nil if they don't know the profile.
+type Profile struct {
+	Local model.SimEntry
+	Smdp  *es2plus.ProfileStatus
+	Prime *primeinventory.SimEntry
+}
+
+// Finding is a disagreement about a profile.  Values a source doesn't have
+// an opinion on are empty.
+type Finding struct {
+	Iccid string `json:"iccid"`
+	Kind  string `json:"kind"`
+	Local string `json:"local"`
+	Smdp  string `json:"smdp"`
+	Prime string `json:"prime"`
+
+	// Fix is the fix-up that would resolve the disagreement, if any, and
+	// Fixed tells if it has been applied.
+	Fix   string `json:"fix"`
+	Fixed bool   `json:"fixed"`
+}
+
+// Compare returns the disagreements about the profiles, ordered by ICCID.
+func Compare(profiles []Profile) []Finding {
+	var findings []Finding
+	for _, profile := range profiles {
+		findings = append(findings, compareProfile(profile)...)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Iccid < findings[j].Iccid
+	})
+	return findings
+}
+
+func compareProfile(profile Profile) []Finding {
+	local := profile.Local
+	var findings []Finding
+	add := func(finding Finding) {
+		finding.Iccid = local.Iccid
+		findings = append(findings, finding)
+	}
+
+	if profile.Smdp == nil {
+		add(Finding{Kind: MissingInSmdp, Local: local.ProfileState})
+	}
+	if profile.Prime == nil {
+		add(Finding{Kind: MissingInPrime})
+	} else {
+		if profile.Prime.Msisdn != local.Msisdn {
+			add(Finding{Kind: MsisdnMismatch, Local: local.Msisdn, Prime: profile.Prime.Msisdn})
+		}
+		if profile.Prime.Imsi != local.Imsi {
+			add(Finding{Kind: ImsiMismatch, Local: local.Imsi, Prime: profile.Prime.Imsi})
+		}
+	}
+
+	codes := Finding{Kind: ActivationCodeMismatch, Local: local.ActivationCode}
+	states := Finding{Kind: StateConflict, Local: local.ProfileState}
+	codesDiffer, statesDiffer := false, false
+	if profile.Smdp != nil {
+		codes.Smdp, states.Smdp = profile.Smdp.ACToken, profile.Smdp.State
+		codesDiffer = codes.Smdp != codes.Local
+		statesDiffer = states.Smdp != states.Local
+		if codes.Smdp != "" && codesDiffer {
+			codes.Fix = FixLocalActivationCodes
+		}
+		if states.Smdp != "" && statesDiffer {
+			states.Fix = FixLocalStates
+		}
+	}
+	if profile.Prime != nil {
+		codes.Prime, states.Prime = profile.Prime.MatchingID, profile.Prime.SmdpPlusState
+		codesDiffer = codesDiffer || codes.Prime != codes.Local
+		statesDiffer = statesDiffer || states.Prime != states.Local
+	}
+	if codesDiffer {
+		add(codes)
+	}
+	if statesDiffer {
+		add(states)
+	}
+	return findings
+}
+
+// Store is where fix-ups are applied.
+type Store interface {
+	UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error)
+	UpdateActivationCode(simID int64, activationCode string) error
+}
+
+// Apply applies the given fix-ups to the findings they resolve, and marks
+// them as fixed.  A state the local database already has a newer one than
+// is left alone, and its finding isn't fixed.  Returns the number of
+// findings fixed.
+func Apply(store Store, profiles []Profile, findings []Finding, fixes []string, now time.Time) (int, error) {
+	byIccid := make(map[string]Profile)
+	for _, profile := range profiles {
+		byIccid[profile.Local.Iccid] = profile
+	}
+	timestamp := now.UTC().Format(time.RFC3339)
+
+	fixed := 0
+	for i := range findings {
+		finding := &findings[i]
+		if finding.Fix == "" || !contains(fixes, finding.Fix) {
+			continue
+		}
+		profile := byIccid[finding.Iccid]
+		switch finding.Fix {
+		case FixLocalStates:
+			updated, err := store.UpdateSimProfileState(finding.Iccid, profile.Smdp.State, profile.Smdp.Eid, timestamp)
+			if err != nil {
+				return fixed, err
+			}
+			if !updated {
+				continue
+			}
+		case FixLocalActivationCodes:
+			if err := store.UpdateActivationCode(profile.Local.ID, profile.Smdp.ACToken); err != nil {
+				return fixed, err
+			}
+		default:
+			return fixed, fmt.Errorf("unknown fix-up '%s'", finding.Fix)
+		}
+		finding.Fixed = true
+		fixed++
+	}
+	return fixed, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Report is the outcome of reconciling a batch.
+type Report struct {
+	Batch     string         `json:"batch"`
+	Generated string         `json:"generated"`
+	Profiles  int            `json:"profiles"`
+	Summary   map[string]int `json:"summary"`
+	Findings  []Finding      `json:"findings"`
+}
+
+// NewReport creates the report for a batch.  The activation codes in it
+// are masked, the report is for people to read and pass around, and an
+// activation code is all it takes to download a profile.
+func NewReport(batch string, profiles int, findings []Finding, now time.Time) *Report {
+	summary := make(map[string]int)
+	reported := []Finding{}
+	for _, finding := range findings {
+		summary[finding.Kind]++
+		if finding.Kind == ActivationCodeMismatch {
+			finding.Local = maskActivationCode(finding.Local)
+			finding.Smdp = maskActivationCode(finding.Smdp)
+			finding.Prime = maskActivationCode(finding.Prime)
+		}
+		reported = append(reported, finding)
+	}
+	return &Report{
+		Batch:     batch,
+		Generated: now.UTC().Format(time.RFC3339),
+		Profiles:  profiles,
+		Summary:   summary,
+		Findings:  reported,
+	}
+}
+
+// maskActivationCode hides all but the last four characters of an
+// activation code, enough to tell codes apart.  Short codes are hidden
+// completely.
+func maskActivationCode(code string) string {
+	const shown = 4
+	if len(code) <= 2*shown {
+		return strings.Repeat("*", len(code))
+	}
+	return strings.Repeat("*", len(code)-shown) + code[len(code)-shown:]
+}
+
+// WriteJSON writes the report as indented JSON.
+func (report *Report) WriteJSON(writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// WriteCSV writes the findings of the report as CSV, one line per finding.
+func (report *Report) WriteCSV(writer io.Writer) error {
+	csvWriter := csv.NewWriter(writer)
+	if err := csvWriter.Write([]string{"ICCID", "KIND", "LOCAL", "SMDP", "PRIME", "FIX", "FIXED"}); err != nil {
+		return err
+	}
+	for _, finding := range report.Findings {
+		line := []string{finding.Iccid, finding.Kind, finding.Local, finding.Smdp, finding.Prime, finding.Fix, strconv.FormatBool(finding.Fixed)}
+		if err := csvWriter.Write(line); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
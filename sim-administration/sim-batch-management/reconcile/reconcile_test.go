@@ -0,0 +1,113 @@
+package reconcile
+
+import (
+	"bytes"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/primeinventory"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+func testProfiles() []Profile {
+	return []Profile{
+		{
+			// All three agree.
+			Local: model.SimEntry{ID: 1, Iccid: "1", Imsi: "2420100000001", Msisdn: "4790000001", ActivationCode: "AAAA-1", ProfileState: "RELEASED"},
+			Smdp:  &es2plus.ProfileStatus{Iccid: "1", State: "RELEASED", ACToken: "AAAA-1"},
+			Prime: &primeinventory.SimEntry{Iccid: "1", Imsi: "2420100000001", Msisdn: "4790000001", MatchingID: "AAAA-1", SmdpPlusState: "RELEASED"},
+		},
+		{
+			// Activated behind our back, and uploaded to prime with another MSISDN.
+			Local: model.SimEntry{ID: 2, Iccid: "2", Imsi: "2420100000002", Msisdn: "4790000002", ProfileState: "AVAILABLE"},
+			Smdp:  &es2plus.ProfileStatus{Iccid: "2", State: "RELEASED", ACToken: "BBBB-2"},
+			Prime: &primeinventory.SimEntry{Iccid: "2", Imsi: "2420100000002", Msisdn: "4790000099", SmdpPlusState: "AVAILABLE"},
+		},
+		{
+			// Unknown to both the SM-DP+ and prime.
+			Local: model.SimEntry{ID: 3, Iccid: "3", Imsi: "2420100000003", ProfileState: "AVAILABLE"},
+		},
+	}
+}
+
+type memoryStore struct {
+	states map[string]string
+	codes  map[int64]string
+
+	// newer are the ICCIDs whose local state is newer than any update.
+	newer map[string]bool
+}
+
+func (store *memoryStore) UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error) {
+	if store.newer[iccid] {
+		return false, nil
+	}
+	store.states[iccid] = state
+	return true, nil
+}
+
+func (store *memoryStore) UpdateActivationCode(simID int64, activationCode string) error {
+	store.codes[simID] = activationCode
+	return nil
+}
+
+func TestCompare(t *testing.T) {
+	findings := Compare(testProfiles())
+	assert.DeepEqual(t, []Finding{
+		{Iccid: "2", Kind: MsisdnMismatch, Local: "4790000002", Prime: "4790000099"},
+		{Iccid: "2", Kind: ActivationCodeMismatch, Smdp: "BBBB-2", Fix: FixLocalActivationCodes},
+		{Iccid: "2", Kind: StateConflict, Local: "AVAILABLE", Smdp: "RELEASED", Prime: "AVAILABLE", Fix: FixLocalStates},
+		{Iccid: "3", Kind: MissingInSmdp, Local: "AVAILABLE"},
+		{Iccid: "3", Kind: MissingInPrime},
+	}, findings)
+}
+
+func TestApplyOnlyTheGivenFixes(t *testing.T) {
+	profiles := testProfiles()
+	findings := Compare(profiles)
+	store := &memoryStore{states: map[string]string{}, codes: map[int64]string{}}
+
+	fixed, err := Apply(store, profiles, findings, []string{FixLocalStates}, now)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, fixed)
+	assert.DeepEqual(t, map[string]string{"2": "RELEASED"}, store.states)
+	assert.Equal(t, 0, len(store.codes))
+	assert.Assert(t, findings[2].Fixed)
+	assert.Assert(t, !findings[1].Fixed)
+}
+
+func TestStatesNotUpdatedAreNotFixed(t *testing.T) {
+	profiles := testProfiles()
+	findings := Compare(profiles)
+	store := &memoryStore{states: map[string]string{}, codes: map[int64]string{}, newer: map[string]bool{"2": true}}
+
+	fixed, err := Apply(store, profiles, findings, []string{FixLocalStates}, now)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, fixed)
+	assert.Assert(t, !findings[2].Fixed)
+}
+
+func TestReportFormats(t *testing.T) {
+	report := NewReport("b1", 3, Compare(testProfiles()), now)
+	assert.DeepEqual(t, map[string]int{MsisdnMismatch: 1, ActivationCodeMismatch: 1, StateConflict: 1, MissingInSmdp: 1, MissingInPrime: 1}, report.Summary)
+
+	var csv bytes.Buffer
+	assert.NilError(t, report.WriteCSV(&csv))
+	assert.Equal(t, "ICCID,KIND,LOCAL,SMDP,PRIME,FIX,FIXED\n"+
+		"2,MSISDN_MISMATCH,4790000002,,4790000099,,false\n"+
+		"2,ACTIVATION_CODE_MISMATCH,,******,,local-activation-codes,false\n"+
+		"2,STATE_CONFLICT,AVAILABLE,RELEASED,AVAILABLE,local-states,false\n"+
+		"3,MISSING_IN_SMDP,AVAILABLE,,,,false\n"+
+		"3,MISSING_IN_PRIME,,,,,false\n", csv.String())
+
+	report = NewReport("b1", 1, []Finding{{Iccid: "4", Kind: ActivationCodeMismatch, Local: "K2-1MUP8-AAAA", Smdp: "K2-1MUP8-BBBB"}}, now)
+	assert.Equal(t, "*********AAAA", report.Findings[0].Local)
+	assert.Equal(t, "*********BBBB", report.Findings[0].Smdp)
+
+	var json bytes.Buffer
+	assert.NilError(t, NewReport("b1", 0, nil, now).WriteJSON(&json))
+	assert.Equal(t, "{\n  \"batch\": \"b1\",\n  \"generated\": \"2026-10-19T12:00:00Z\",\n  \"profiles\": 0,\n  \"summary\": {},\n  \"findings\": []\n}\n", json.String())
+}
@@ -0,0 +1,266 @@
+package restapi
+
+// openAPIDocument describes the API.  Keep it in sync with the handlers.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "SIM batch management",
+    "description": "Batches, SIM profiles, profile vendors and background jobs of the sim batch management database.",
+    "version": "1.0.0"
+  },
+  "security": [{"bearerToken": []}],
+  "paths": {
+    "/v1/batches": {
+      "get": {
+        "summary": "List all batches",
+        "responses": {
+          "200": {"description": "The batches", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Batch"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/v1/batches/{name}": {
+      "get": {
+        "summary": "Describe a batch, its lifecycle history and its profiles",
+        "parameters": [{"$ref": "#/components/parameters/BatchName"}],
+        "responses": {
+          "200": {"description": "The batch", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchDescription"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/batches/{name}/activation-jobs": {
+      "post": {
+        "summary": "Queue a job activating the profiles of a batch in the SM-DP+, run in the background by a job worker",
+        "parameters": [{"$ref": "#/components/parameters/BatchName"}],
+        "responses": {
+          "202": {"description": "The job was queued", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"description": "The batch is already being activated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/v1/jobs": {
+      "get": {
+        "summary": "List background jobs, newest first",
+        "parameters": [
+          {"name": "state", "in": "query", "schema": {"$ref": "#/components/schemas/JobState"}},
+          {"name": "limit", "in": "query", "description": "Max number of jobs, 0 means no limit", "schema": {"type": "integer", "default": 100}}
+        ],
+        "responses": {
+          "200": {"description": "The jobs", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}},
+          "400": {"description": "Invalid limit", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/v1/jobs/{id}": {
+      "get": {
+        "summary": "Show the state and progress of a background job",
+        "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "integer"}}],
+        "responses": {
+          "200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/sims": {
+      "get": {
+        "summary": "Look up a SIM by exactly one of ICCID, IMSI or MSISDN",
+        "parameters": [
+          {"name": "iccid", "in": "query", "schema": {"type": "string"}},
+          {"name": "imsi", "in": "query", "schema": {"type": "string"}},
+          {"name": "msisdn", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The SIM", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Sim"}}}},
+          "400": {"description": "Not exactly one of iccid, imsi or msisdn given", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/v1/profile-vendors": {
+      "get": {
+        "summary": "List all profile vendors",
+        "responses": {
+          "200": {"description": "The profile vendors", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ProfileVendor"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/v1/profile-vendors/{name}": {
+      "parameters": [{"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get a profile vendor",
+        "responses": {
+          "200": {"description": "The profile vendor", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ProfileVendor"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "put": {
+        "summary": "Declare a profile vendor, or replace its settings",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ProfileVendor"}}}},
+        "responses": {
+          "200": {"description": "The profile vendor was updated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ProfileVendor"}}}},
+          "201": {"description": "The profile vendor was declared", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ProfileVendor"}}}},
+          "400": {"description": "Invalid settings", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a profile vendor that has no batches",
+        "responses": {
+          "204": {"description": "The profile vendor was deleted"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"description": "The profile vendor has batches", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerToken": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "BatchName": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Unauthorized": {"description": "Missing or invalid bearer token", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "No such resource", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      },
+      "Batch": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"},
+          "filenameBase": {"type": "string"},
+          "customer": {"type": "string"},
+          "profileType": {"type": "string"},
+          "orderDate": {"type": "string"},
+          "batchNo": {"type": "string"},
+          "quantity": {"type": "integer"},
+          "firstIccid": {"type": "string"},
+          "firstImsi": {"type": "string"},
+          "url": {"type": "string"},
+          "msisdnIncrement": {"type": "integer"},
+          "iccidIncrement": {"type": "integer"},
+          "imsiIncrement": {"type": "integer"},
+          "firstMsisdn": {"type": "string"},
+          "profileVendor": {"type": "string"},
+          "state": {"type": "string"},
+          "hssVendor": {"type": "string"},
+          "hssLoaded": {"type": "string"},
+          "hssLoadedBy": {"type": "string"},
+          "secretsPurged": {"type": "string"},
+          "secretsPurgedBy": {"type": "string"},
+          "primeUploaded": {"type": "string"},
+          "primeUploadStatus": {"type": "string"}
+        }
+      },
+      "BatchDescription": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Batch"},
+          {
+            "type": "object",
+            "properties": {
+              "transitions": {"type": "array", "items": {"$ref": "#/components/schemas/BatchStateTransition"}},
+              "profiles": {"type": "integer"},
+              "profilesWithActivationCode": {"type": "integer"},
+              "profileStates": {"type": "object", "additionalProperties": {"type": "integer"}}
+            }
+          }
+        ]
+      },
+      "BatchStateTransition": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "batchID": {"type": "integer"},
+          "fromState": {"type": "string"},
+          "toState": {"type": "string"},
+          "timestamp": {"type": "string"},
+          "operator": {"type": "string"},
+          "note": {"type": "string"},
+          "forced": {"type": "boolean"}
+        }
+      },
+      "Sim": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "batch": {"type": "string"},
+          "iccid": {"type": "string"},
+          "imsi": {"type": "string"},
+          "msisdn": {"type": "string"},
+          "hasActivationCode": {"type": "boolean"},
+          "secretsPurged": {"type": "boolean"},
+          "profileState": {"type": "string"},
+          "profileStateUpdated": {"type": "string"},
+          "eid": {"type": "string"}
+        }
+      },
+      "JobState": {"type": "string", "enum": ["QUEUED", "RUNNING", "SUCCEEDED", "FAILED", "CANCELLED"]},
+      "Job": {
+        "type": "object",
+        "description": "The progress counters are for the latest attempt at running the job.",
+        "properties": {
+          "id": {"type": "integer"},
+          "kind": {"type": "string"},
+          "args": {"type": "object", "additionalProperties": {"type": "string"}},
+          "state": {"$ref": "#/components/schemas/JobState"},
+          "submitted": {"type": "string"},
+          "submittedBy": {"type": "string"},
+          "started": {"type": "string"},
+          "finished": {"type": "string"},
+          "worker": {"type": "string"},
+          "heartbeat": {"type": "string"},
+          "attempts": {"type": "integer"},
+          "cancelRequested": {"type": "boolean"},
+          "total": {"type": "integer"},
+          "succeeded": {"type": "integer"},
+          "failed": {"type": "integer"},
+          "error": {"type": "string"}
+        }
+      },
+      "ProfileVendor": {
+        "type": "object",
+        "description": "Durations are in milliseconds, and zero values mean 'use the default'.  The password of the proxy is redacted.",
+        "properties": {
+          "id": {"type": "integer", "readOnly": true},
+          "name": {"type": "string", "readOnly": true},
+          "es2plusCertPath": {"type": "string"},
+          "es2PlusKeyPath": {"type": "string"},
+          "es2plusHostPath": {"type": "string"},
+          "es2plusPort": {"type": "integer"},
+          "es2PlusRequesterId": {"type": "string"},
+          "smdpAddress": {"type": "string"},
+          "es2PlusStatusListSize": {"type": "integer"},
+          "es2PlusRequestTimeoutMillis": {"type": "integer"},
+          "es2PlusTlsHandshakeTimeoutMillis": {"type": "integer"},
+          "es2PlusMaxIdleConns": {"type": "integer"},
+          "es2PlusMaxConnsPerHost": {"type": "integer"},
+          "es2PlusHttp2": {"type": "boolean"},
+          "es2PlusBreakerThreshold": {"type": "integer"},
+          "es2PlusBreakerOpenMillis": {"type": "integer"},
+          "es2PlusProtocolVersion": {"type": "string"},
+          "es2PlusBasePath": {"type": "string"},
+          "es2PlusFieldNames": {"type": "string"},
+          "es2PlusFailoverEndpoints": {"type": "string"},
+          "es2PlusProxy": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
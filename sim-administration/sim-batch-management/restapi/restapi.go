@@ -0,0 +1,514 @@
+// Package restapi exposes the batches, SIM profiles, profile vendors and
+// background jobs of the sim batch management database as a JSON REST API,
+// for support tools and the admin endpoint.  The API is described by the
+// OpenAPI document served on /openapi.json.
+package restapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/jobs"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/outboundproxy"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store is the part of the store the API uses.
+type Store interface {
+	GetAllBatches() ([]model.Batch, error)
+	GetBatchByName(name string) (*model.Batch, error)
+	GetBatchStateTransitions(batchID int64) ([]model.BatchStateTransition, error)
+	GetAllSimEntriesForBatch(batchID int64) ([]model.SimEntry, error)
+	GetBatchByID(id int64) (*model.Batch, error)
+
+	GetSimProfileByIccid(iccid string) (*model.SimEntry, error)
+	GetSimProfileByImsi(imsi string) (*model.SimEntry, error)
+	GetSimProfileByMsisdn(msisdn string) (*model.SimEntry, error)
+
+	GetAllProfileVendors() ([]model.ProfileVendor, error)
+	GetProfileVendorByName(name string) (*model.ProfileVendor, error)
+	CreateProfileVendor(vendor *model.ProfileVendor) error
+	UpdateProfileVendor(vendor *model.ProfileVendor) error
+	DeleteProfileVendor(name string) error
+
+	CreateJob(job *model.Job) error
+	GetJobByID(id int64) (*model.Job, error)
+	GetJobs(state string, limit int) ([]model.Job, error)
+}
+
+// Config configures the API server.
+type Config struct {
+	Store Store
+
+	// Tokens are the bearer tokens clients can authenticate with.
+	Tokens []string
+
+	// CheckProfileVendor checks a profile vendor before it is stored.
+	CheckProfileVendor func(vendor *model.ProfileVendor) error
+}
+
+// Server is the REST API.  It implements http.Handler.
+type Server struct {
+	config  Config
+	handler http.Handler
+}
+
+// NewServer returns a server.  The jobs it queues are run by job workers.
+func NewServer(config Config) *Server {
+	server := &Server{config: config}
+	server.handler = logRequests(server.route())
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.handler.ServeHTTP(w, r)
+}
+
+// Batch is a batch, with its lifecycle history and a summary of its profiles.
+type Batch struct {
+	model.Batch
+	Transitions []model.BatchStateTransition `json:"transitions"`
+
+	Profiles                   int            `json:"profiles"`
+	ProfilesWithActivationCode int            `json:"profilesWithActivationCode"`
+	ProfileStates              map[string]int `json:"profileStates"`
+}
+
+// Sim is a SIM profile, without its secrets (Ki, OPc, PIN/PUK and activation code).
+type Sim struct {
+	ID                  int64  `json:"id"`
+	Batch               string `json:"batch"`
+	Iccid               string `json:"iccid"`
+	Imsi                string `json:"imsi"`
+	Msisdn              string `json:"msisdn"`
+	HasActivationCode   bool   `json:"hasActivationCode"`
+	SecretsPurged       bool   `json:"secretsPurged"`
+	ProfileState        string `json:"profileState"`
+	ProfileStateUpdated string `json:"profileStateUpdated"`
+	Eid                 string `json:"eid"`
+}
+
+// Job is a background job, with its arguments decoded.
+type Job struct {
+	model.Job
+	Args map[string]string `json:"args"`
+}
+
+// The operator recorded for jobs queued through the API.
+const apiOperator = "api"
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// statusError is an error to be returned to the client, with the HTTP status to return it with.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (err *statusError) Error() string {
+	return err.message
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// handlerFunc handles a request, and returns the status and value to
+// respond with, or an error.
+type handlerFunc func(r *http.Request, path []string) (int, interface{}, error)
+
+func (server *Server) route() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(openAPIDocument))
+	})
+	mux.Handle("/v1/batches", server.authenticated(server.batches))
+	mux.Handle("/v1/batches/", server.authenticated(server.batches))
+	mux.Handle("/v1/sims", server.authenticated(server.sims))
+	mux.Handle("/v1/profile-vendors", server.authenticated(server.profileVendors))
+	mux.Handle("/v1/profile-vendors/", server.authenticated(server.profileVendors))
+	mux.Handle("/v1/jobs", server.authenticated(server.backgroundJobs))
+	mux.Handle("/v1/jobs/", server.authenticated(server.backgroundJobs))
+	return mux
+}
+
+// authenticated checks the bearer token of the request before handing it to
+// the handler, with the path split on '/' after the collection name.
+func (server *Server) authenticated(handler handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !server.validToken(r.Header.Get("Authorization")) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sbm"`)
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "missing or invalid bearer token"})
+			return
+		}
+
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[2:]
+		status, value, err := handler(r, path)
+		if err != nil {
+			status = http.StatusInternalServerError
+			if statusErr, ok := err.(*statusError); ok {
+				status = statusErr.status
+			} else {
+				log.Printf("ERROR: %s %s: %s\n", r.Method, r.URL.Path, err)
+			}
+			value = apiError{Error: err.Error()}
+		}
+		writeJSON(w, status, value)
+	})
+}
+
+func (server *Server) validToken(authorization string) bool {
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+	valid := false
+	for _, candidate := range server.config.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(candidate)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if value != nil {
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return errorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+}
+
+func notFound(r *http.Request) error {
+	return errorf(http.StatusNotFound, "no such resource: %s", r.URL.Path)
+}
+
+// batches handles /v1/batches, /v1/batches/{name} and /v1/batches/{name}/activation-jobs.
+func (server *Server) batches(r *http.Request, path []string) (int, interface{}, error) {
+	switch {
+	case len(path) == 0:
+		if r.Method != http.MethodGet {
+			return 0, nil, methodNotAllowed(r)
+		}
+		batches, err := server.config.Store.GetAllBatches()
+		return http.StatusOK, batches, err
+
+	case len(path) == 1:
+		if r.Method != http.MethodGet {
+			return 0, nil, methodNotAllowed(r)
+		}
+		batch, err := server.describeBatch(path[0])
+		return http.StatusOK, batch, err
+
+	case len(path) == 2 && path[1] == "activation-jobs":
+		if r.Method != http.MethodPost {
+			return 0, nil, methodNotAllowed(r)
+		}
+		job, err := server.startActivationJob(path[0])
+		return http.StatusAccepted, job, err
+	}
+	return 0, nil, notFound(r)
+}
+
+func (server *Server) batch(name string) (*model.Batch, error) {
+	batch, err := server.config.Store.GetBatchByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if batch == nil {
+		return nil, errorf(http.StatusNotFound, "no batch found with name '%s'", name)
+	}
+	return batch, nil
+}
+
+func (server *Server) describeBatch(name string) (*Batch, error) {
+	batch, err := server.batch(name)
+	if err != nil {
+		return nil, err
+	}
+	transitions, err := server.config.Store.GetBatchStateTransitions(batch.BatchID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := server.config.Store.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Batch{Batch: *batch, Transitions: transitions, Profiles: len(entries), ProfileStates: make(map[string]int)}
+	for _, entry := range entries {
+		if entry.ActivationCode != "" {
+			result.ProfilesWithActivationCode++
+		}
+		if entry.ProfileState != "" {
+			result.ProfileStates[entry.ProfileState]++
+		}
+	}
+	return result, nil
+}
+
+// sims handles /v1/sims?iccid=..., ?imsi=... and ?msisdn=...
+func (server *Server) sims(r *http.Request, path []string) (int, interface{}, error) {
+	if len(path) != 0 {
+		return 0, nil, notFound(r)
+	}
+	if r.Method != http.MethodGet {
+		return 0, nil, methodNotAllowed(r)
+	}
+
+	query := r.URL.Query()
+	var entry *model.SimEntry
+	var err error
+	switch {
+	case len(query) != 1:
+		return 0, nil, errorf(http.StatusBadRequest, "look up SIMs by exactly one of iccid, imsi or msisdn")
+	case query.Get("iccid") != "":
+		entry, err = server.config.Store.GetSimProfileByIccid(query.Get("iccid"))
+	case query.Get("imsi") != "":
+		entry, err = server.config.Store.GetSimProfileByImsi(query.Get("imsi"))
+	case query.Get("msisdn") != "":
+		entry, err = server.config.Store.GetSimProfileByMsisdn(query.Get("msisdn"))
+	default:
+		return 0, nil, errorf(http.StatusBadRequest, "look up SIMs by exactly one of iccid, imsi or msisdn")
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if entry == nil {
+		return 0, nil, errorf(http.StatusNotFound, "no SIM found with %s", r.URL.RawQuery)
+	}
+
+	sim := Sim{
+		ID:                  entry.ID,
+		Iccid:               entry.Iccid,
+		Imsi:                entry.Imsi,
+		Msisdn:              entry.Msisdn,
+		HasActivationCode:   entry.ActivationCode != "",
+		SecretsPurged:       entry.SecretsHash != "",
+		ProfileState:        entry.ProfileState,
+		ProfileStateUpdated: entry.ProfileStateUpdated,
+		Eid:                 entry.Eid,
+	}
+	batch, err := server.config.Store.GetBatchByID(entry.BatchID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if batch != nil {
+		sim.Batch = batch.Name
+	}
+	return http.StatusOK, sim, nil
+}
+
+// redactVendor hides the proxy password of a profile vendor.
+func redactVendor(vendor model.ProfileVendor) model.ProfileVendor {
+	vendor.Proxy = outboundproxy.Redacted(vendor.Proxy)
+	return vendor
+}
+
+// profileVendors handles /v1/profile-vendors and /v1/profile-vendors/{name}.
+func (server *Server) profileVendors(r *http.Request, path []string) (int, interface{}, error) {
+	store := server.config.Store
+
+	if len(path) == 0 {
+		if r.Method != http.MethodGet {
+			return 0, nil, methodNotAllowed(r)
+		}
+		vendors, err := store.GetAllProfileVendors()
+		for i := range vendors {
+			vendors[i] = redactVendor(vendors[i])
+		}
+		return http.StatusOK, vendors, err
+	}
+	if len(path) != 1 {
+		return 0, nil, notFound(r)
+	}
+
+	name := path[0]
+	vendor, err := store.GetProfileVendorByName(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if vendor == nil {
+			return 0, nil, errorf(http.StatusNotFound, "unknown profile vendor: '%s'", name)
+		}
+		return http.StatusOK, redactVendor(*vendor), nil
+
+	case http.MethodPut:
+		updated := &model.ProfileVendor{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(updated); err != nil {
+			return 0, nil, errorf(http.StatusBadRequest, "not a valid profile vendor: %s", err)
+		}
+		updated.Name = name
+		if vendor != nil && updated.Proxy == outboundproxy.Redacted(vendor.Proxy) {
+			// The vendor as it was read, with the proxy password redacted.
+			updated.Proxy = vendor.Proxy
+		}
+		if server.config.CheckProfileVendor != nil {
+			if err := server.config.CheckProfileVendor(updated); err != nil {
+				return 0, nil, errorf(http.StatusBadRequest, "%s", err)
+			}
+		}
+		if vendor == nil {
+			if err := store.CreateProfileVendor(updated); err != nil {
+				return 0, nil, err
+			}
+			return http.StatusCreated, redactVendor(*updated), nil
+		}
+		updated.ID = vendor.ID
+		if err := store.UpdateProfileVendor(updated); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, redactVendor(*updated), nil
+
+	case http.MethodDelete:
+		if vendor == nil {
+			return 0, nil, errorf(http.StatusNotFound, "unknown profile vendor: '%s'", name)
+		}
+		if err := store.DeleteProfileVendor(name); err != nil {
+			return 0, nil, errorf(http.StatusConflict, "%s", err)
+		}
+		return http.StatusNoContent, nil, nil
+	}
+	return 0, nil, methodNotAllowed(r)
+}
+
+// backgroundJobs handles /v1/jobs?state=...&limit=... and /v1/jobs/{id}.
+func (server *Server) backgroundJobs(r *http.Request, path []string) (int, interface{}, error) {
+	if r.Method != http.MethodGet {
+		return 0, nil, methodNotAllowed(r)
+	}
+
+	switch len(path) {
+	case 0:
+		limit := 100
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				return 0, nil, errorf(http.StatusBadRequest, "not a valid limit: '%s'", value)
+			}
+		}
+		stored, err := server.config.Store.GetJobs(r.URL.Query().Get("state"), limit)
+		if err != nil {
+			return 0, nil, err
+		}
+		result := []Job{}
+		for i := range stored {
+			job, err := jobView(&stored[i])
+			if err != nil {
+				return 0, nil, err
+			}
+			result = append(result, *job)
+		}
+		return http.StatusOK, result, nil
+
+	case 1:
+		id, err := strconv.ParseInt(path[0], 10, 64)
+		if err != nil {
+			return 0, nil, errorf(http.StatusBadRequest, "not a valid job id: '%s'", path[0])
+		}
+		job, err := server.config.Store.GetJobByID(id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if job == nil {
+			return 0, nil, errorf(http.StatusNotFound, "no job with id %d", id)
+		}
+		result, err := jobView(job)
+		return http.StatusOK, result, err
+	}
+	return 0, nil, notFound(r)
+}
+
+func jobView(job *model.Job) (*Job, error) {
+	args, err := jobs.Args(job)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{Job: *job, Args: args}, nil
+}
+
+// startActivationJob queues a job activating the profiles of a batch,
+// unless one is already queued or running.
+func (server *Server) startActivationJob(batchName string) (*Job, error) {
+	if _, err := server.batch(batchName); err != nil {
+		return nil, err
+	}
+
+	for _, state := range []string{model.JobQueued, model.JobRunning} {
+		pending, err := server.config.Store.GetJobs(state, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i := range pending {
+			job, err := jobView(&pending[i])
+			if err != nil {
+				return nil, err
+			}
+			if job.Kind == jobs.KindBatchActivate && job.Args["batch"] == batchName {
+				return nil, errorf(http.StatusConflict, "batch '%s' is already being activated by job %d", batchName, job.ID)
+			}
+		}
+	}
+
+	job, err := jobs.Submit(server.config.Store, jobs.KindBatchActivate, map[string]string{"batch": batchName}, apiOperator)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Queued activation job %d for batch '%s'\n", job.ID, batchName)
+	return jobView(job)
+}
+
+// statusRecorder remembers the status a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs every request, and the status it was answered with.
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		log.Printf("%s %s %s -> %d (%dms)\n", r.RemoteAddr, r.Method, redactedRequestURI(r.URL), recorder.status, time.Since(start).Milliseconds())
+	})
+}
+
+// redactedRequestURI returns the path and query of a request URL with the
+// values of the query parameters, such as ICCIDs and MSISDNs, left out, so
+// that it can be logged.
+func redactedRequestURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.EscapedPath()
+	}
+	var parameters []string
+	for name := range u.Query() {
+		parameters = append(parameters, url.QueryEscape(name)+"=xxxxx")
+	}
+	sort.Strings(parameters)
+	return u.EscapedPath() + "?" + strings.Join(parameters, "&")
+}
@@ -0,0 +1,283 @@
+// Package statussync keeps the profile states in the local database close
+// to the SM-DP+s' view of them.  A scheduler polls the SM-DP+ of every profile
+// vendor on its own cadence, for the profiles most likely to have changed,
+// records the states that have changed, and reports the profiles whose local
+// state disagreed with the SM-DP+ as drift.
+package statussync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"log"
+	"sync"
+	"time"
+)
+
+// Source is recorded with the drift found by the scheduler.
+const Source = "status-sync"
+
+// TerminalStates are the states profiles are not expected to leave, they
+// are polled less often than the others.
+var TerminalStates = []string{es2plus.StateInstalled, es2plus.StateUnavailable, es2plus.StateDeleted}
+
+// Store is where the profile states and drift are kept.
+type Store interface {
+	GetSimProfilesToPoll(profileVendor string, terminalStates []string, changedSince string, terminalCheckedBefore string, limit int) ([]model.SimEntry, error)
+	UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error)
+	MarkSimProfileStatesChecked(iccids []string, timestamp string) error
+	CreateProfileStateDrift(drift *model.ProfileStateDrift) error
+	GetLatestProfileStateDrift(iccid string) (*model.ProfileStateDrift, error)
+}
+
+// StatusClient gets the statuses of profiles from an SM-DP+, in bulk.
+type StatusClient interface {
+	GetStatuses(ctx context.Context, iccids []string) (map[string]*es2plus.ProfileStatus, error)
+}
+
+// Policy decides which profiles are polled.
+type Policy struct {
+	// MaxProfiles is the max number of profiles polled at a time.
+	MaxProfiles int
+
+	// RecentlyChanged is how long after a state change a profile is
+	// polled before the other non-terminal ones.
+	RecentlyChanged time.Duration
+
+	// TerminalInterval is how often profiles in terminal states are polled.
+	TerminalInterval time.Duration
+}
+
+// Defaults for policies.
+const (
+	DefaultMaxProfiles      = 5000
+	DefaultRecentlyChanged  = 24 * time.Hour
+	DefaultTerminalInterval = 7 * 24 * time.Hour
+)
+
+// WithDefaults returns the policy with zero values replaced by the defaults.
+func (policy Policy) WithDefaults() Policy {
+	if policy.MaxProfiles <= 0 {
+		policy.MaxProfiles = DefaultMaxProfiles
+	}
+	if policy.RecentlyChanged <= 0 {
+		policy.RecentlyChanged = DefaultRecentlyChanged
+	}
+	if policy.TerminalInterval <= 0 {
+		policy.TerminalInterval = DefaultTerminalInterval
+	}
+	return policy
+}
+
+// selectForPolling gets the profiles of a profile vendor to poll, at most
+// MaxProfiles of them.  First come the non-terminal profiles that have
+// changed recently, then the other non-terminal ones, and last the terminal
+// ones that haven't been checked within the TerminalInterval.  Within each
+// group the profiles that were checked longest ago come first.
+func selectForPolling(store Store, profileVendor string, policy Policy, now time.Time) ([]model.SimEntry, error) {
+	policy = policy.WithDefaults()
+	changedSince := now.Add(-policy.RecentlyChanged).UTC().Format(time.RFC3339)
+	terminalCheckedBefore := now.Add(-policy.TerminalInterval).UTC().Format(time.RFC3339)
+	return store.GetSimProfilesToPoll(profileVendor, TerminalStates, changedSince, terminalCheckedBefore, policy.MaxProfiles)
+}
+
+// Result is the outcome of recording the statuses of a set of profiles.
+type Result struct {
+	Checked int
+	Changed int
+	Missing []string
+	Drift   []model.ProfileStateDrift
+}
+
+// Record writes the statuses the SM-DP+ of a profile vendor reported for
+// the profiles to the store, and the profiles' local state disagreeing with
+// them as drift.  Profiles with a known local state that the SM-DP+ didn't
+// report on are drift too, recorded with an empty SM-DP+ state.  The same
+// disagreement is only recorded once.
+func Record(store Store, profileVendor string, source string, entries []model.SimEntry, statuses map[string]*es2plus.ProfileStatus, now time.Time) (Result, error) {
+	timestamp := now.UTC().Format(time.RFC3339)
+	result := Result{}
+
+	checked := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		checked = append(checked, entry.Iccid)
+		status, found := statuses[entry.Iccid]
+		smdpState := ""
+		if found {
+			smdpState = status.State
+		} else {
+			result.Missing = append(result.Missing, entry.Iccid)
+		}
+
+		if found && (smdpState != entry.ProfileState || (status.Eid != "" && status.Eid != entry.Eid)) {
+			// The SM-DP+'s own timestamp for the change is more accurate than
+			// ours, if it gives one.
+			changed := timestamp
+			if reported, err := time.Parse(time.RFC3339, status.StatusLastUpdateTimestamp); err == nil {
+				changed = reported.UTC().Format(time.RFC3339)
+			}
+			updated, err := store.UpdateSimProfileState(entry.Iccid, smdpState, status.Eid, changed)
+			if err != nil {
+				return result, err
+			}
+			if updated && smdpState != entry.ProfileState {
+				result.Changed++
+			}
+		}
+
+		if smdpState == entry.ProfileState || (found && entry.ProfileState == "") {
+			// Agreeing, or the first time the state is learned.
+			continue
+		}
+		drift, err := recordDrift(store, &model.ProfileStateDrift{
+			Timestamp:         timestamp,
+			ProfileVendor:     profileVendor,
+			Iccid:             entry.Iccid,
+			LocalState:        entry.ProfileState,
+			LocalStateUpdated: entry.ProfileStateUpdated,
+			SmdpState:         smdpState,
+			Source:            source,
+		})
+		if err != nil {
+			return result, err
+		}
+		if drift != nil {
+			result.Drift = append(result.Drift, *drift)
+		}
+	}
+
+	if err := store.MarkSimProfileStatesChecked(checked, timestamp); err != nil {
+		return result, err
+	}
+	result.Checked = len(checked) - len(result.Missing)
+	return result, nil
+}
+
+// recordDrift stores drift, unless it is the same as the latest drift
+// recorded for the profile.  Returns the drift if it was stored.
+func recordDrift(store Store, drift *model.ProfileStateDrift) (*model.ProfileStateDrift, error) {
+	latest, err := store.GetLatestProfileStateDrift(drift.Iccid)
+	if err != nil {
+		return nil, err
+	}
+	if latest != nil && latest.LocalState == drift.LocalState && latest.LocalStateUpdated == drift.LocalStateUpdated && latest.SmdpState == drift.SmdpState {
+		return nil, nil
+	}
+	if err := store.CreateProfileStateDrift(drift); err != nil {
+		return nil, err
+	}
+	return drift, nil
+}
+
+// DescribeDrift describes a disagreement about the state of a profile.
+func DescribeDrift(drift model.ProfileStateDrift) string {
+	smdpState := "unknown to the SM-DP+"
+	if drift.SmdpState != "" {
+		smdpState = drift.SmdpState + " in the SM-DP+"
+	}
+	return fmt.Sprintf("Iccid='%s' (%s) is %s, locally %s since %s", drift.Iccid, drift.ProfileVendor, smdpState, drift.LocalState, drift.LocalStateUpdated)
+}
+
+// Scheduler polls the SM-DP+s of profile vendors for the states of their profiles.
+type Scheduler struct {
+	Store Store
+
+	// Client returns the client for the SM-DP+ of a profile vendor.
+	Client func(profileVendor string) (StatusClient, error)
+
+	// Intervals maps the profile vendors to poll to how often to poll them.
+	Intervals map[string]time.Duration
+
+	Policy Policy
+
+	// OnDrift, if set, is called for every new disagreement found.
+	OnDrift func(drift model.ProfileStateDrift)
+
+	now func() time.Time
+}
+
+// Run polls every profile vendor right away, and then at its interval,
+// until the context is cancelled.  Failed polls are logged and retried at
+// the next interval.
+func (scheduler *Scheduler) Run(ctx context.Context) {
+	var waitgroup sync.WaitGroup
+	for profileVendor, interval := range scheduler.Intervals {
+		waitgroup.Add(1)
+		go func(profileVendor string, interval time.Duration) {
+			defer waitgroup.Done()
+			log.Printf("Polling the SM-DP+ of %s for profile states every %s\n", profileVendor, interval)
+			for {
+				if _, err := scheduler.Poll(ctx, profileVendor); err != nil && ctx.Err() == nil {
+					log.Printf("ERROR: Couldn't poll the SM-DP+ of %s for profile states: %s\n", profileVendor, err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}(profileVendor, interval)
+	}
+	waitgroup.Wait()
+}
+
+// Poll gets the states of the highest priority profiles of a profile vendor
+// from its SM-DP+, with bulk status queries, and records them.  If some of
+// the queries fail, the states from the others are still recorded, and the
+// error is returned with the result.
+func (scheduler *Scheduler) Poll(ctx context.Context, profileVendor string) (Result, error) {
+	now := time.Now
+	if scheduler.now != nil {
+		now = scheduler.now
+	}
+
+	selected, err := selectForPolling(scheduler.Store, profileVendor, scheduler.Policy, now())
+	if err != nil {
+		return Result{}, err
+	}
+	if len(selected) == 0 {
+		return Result{}, nil
+	}
+
+	client, err := scheduler.Client(profileVendor)
+	if err != nil {
+		return Result{}, err
+	}
+	iccids := make([]string, 0, len(selected))
+	for _, entry := range selected {
+		iccids = append(iccids, entry.Iccid)
+	}
+	statuses, statusesErr := client.GetStatuses(ctx, iccids)
+	var partial *es2plus.StatusesError
+	if statusesErr != nil && !errors.As(statusesErr, &partial) {
+		return Result{}, statusesErr
+	}
+	if partial != nil {
+		notGot := make(map[string]bool)
+		for _, iccid := range partial.Iccids() {
+			notGot[iccid] = true
+		}
+		var got []model.SimEntry
+		for _, entry := range selected {
+			if !notGot[entry.Iccid] {
+				got = append(got, entry)
+			}
+		}
+		selected = got
+	}
+
+	result, err := Record(scheduler.Store, profileVendor, Source, selected, statuses, now())
+	if err != nil {
+		return result, err
+	}
+	for _, drift := range result.Drift {
+		if scheduler.OnDrift != nil {
+			scheduler.OnDrift(drift)
+		}
+	}
+	log.Printf("Polled %d profiles of %s: %d changed state, %d unknown to the SM-DP+, %d new drift\n",
+		len(selected), profileVendor, result.Changed, len(result.Missing), len(result.Drift))
+	return result, statusesErr
+}
@@ -0,0 +1,199 @@
+package statussync
+
+import (
+	"context"
+	"errors"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/es2plus"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"gotest.tools/assert"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+type memoryStore struct {
+	entries []model.SimEntry
+	drift   []model.ProfileStateDrift
+
+	// polled are the arguments of the last GetSimProfilesToPoll.
+	polled []interface{}
+}
+
+// GetSimProfilesToPoll returns the first limit entries, the ordering is left
+// to the real store.
+func (store *memoryStore) GetSimProfilesToPoll(profileVendor string, terminalStates []string, changedSince string, terminalCheckedBefore string, limit int) ([]model.SimEntry, error) {
+	store.polled = []interface{}{profileVendor, terminalStates, changedSince, terminalCheckedBefore, limit}
+	entries := append([]model.SimEntry{}, store.entries...)
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (store *memoryStore) entry(iccid string) *model.SimEntry {
+	for i := range store.entries {
+		if store.entries[i].Iccid == iccid {
+			return &store.entries[i]
+		}
+	}
+	return nil
+}
+
+func (store *memoryStore) UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error) {
+	entry := store.entry(iccid)
+	if entry == nil || entry.ProfileStateUpdated > timestamp {
+		return false, nil
+	}
+	entry.ProfileState = state
+	entry.ProfileStateUpdated = timestamp
+	if eid != "" {
+		entry.Eid = eid
+	}
+	return true, nil
+}
+
+func (store *memoryStore) MarkSimProfileStatesChecked(iccids []string, timestamp string) error {
+	for _, iccid := range iccids {
+		store.entry(iccid).ProfileStateChecked = timestamp
+	}
+	return nil
+}
+
+func (store *memoryStore) CreateProfileStateDrift(drift *model.ProfileStateDrift) error {
+	store.drift = append(store.drift, *drift)
+	return nil
+}
+
+func (store *memoryStore) GetLatestProfileStateDrift(iccid string) (*model.ProfileStateDrift, error) {
+	for i := len(store.drift) - 1; i >= 0; i-- {
+		if store.drift[i].Iccid == iccid {
+			return &store.drift[i], nil
+		}
+	}
+	return nil, nil
+}
+
+type fakeSmdp struct {
+	states  map[string]string
+	queries [][]string
+
+	// failing are ICCIDs whose statuses can't be got.
+	failing []string
+}
+
+func (smdp *fakeSmdp) GetStatuses(ctx context.Context, iccids []string) (map[string]*es2plus.ProfileStatus, error) {
+	smdp.queries = append(smdp.queries, iccids)
+	statuses := make(map[string]*es2plus.ProfileStatus)
+	for _, iccid := range iccids {
+		if state, found := smdp.states[iccid]; found {
+			statuses[iccid] = &es2plus.ProfileStatus{Iccid: iccid, State: state}
+		}
+	}
+	if len(smdp.failing) > 0 {
+		for _, iccid := range smdp.failing {
+			delete(statuses, iccid)
+		}
+		return statuses, &es2plus.StatusesError{Chunks: []es2plus.ChunkError{{Iccids: smdp.failing, Err: errors.New("SM-DP+ says no")}}}
+	}
+	return statuses, nil
+}
+
+func iccids(entries []model.SimEntry) []string {
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.Iccid)
+	}
+	return result
+}
+
+func TestSelectForPolling(t *testing.T) {
+	store := &memoryStore{entries: []model.SimEntry{{Iccid: "1"}, {Iccid: "2"}, {Iccid: "3"}}}
+
+	selected, err := selectForPolling(store, "Durian", Policy{MaxProfiles: 2, TerminalInterval: time.Hour}, now)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"1", "2"}, iccids(selected))
+	assert.DeepEqual(t, []interface{}{"Durian", TerminalStates, "2026-10-18T12:00:00Z", "2026-10-19T11:00:00Z", 2}, store.polled)
+}
+
+func TestPollRecordsChangesAndDrift(t *testing.T) {
+	store := &memoryStore{entries: []model.SimEntry{
+		{Iccid: "1", ProfileState: "RELEASED", ProfileStateUpdated: "2026-10-19T09:00:00Z"},
+		{Iccid: "2", ProfileState: "AVAILABLE", ProfileStateUpdated: "2026-10-19T09:00:00Z"},
+		{Iccid: "3"},
+		{Iccid: "4", ProfileState: "RELEASED", ProfileStateUpdated: "2026-10-19T09:00:00Z"},
+	}}
+	smdp := &fakeSmdp{states: map[string]string{"1": "INSTALLED", "2": "AVAILABLE", "3": "RELEASED"}}
+
+	var reported []model.ProfileStateDrift
+	scheduler := &Scheduler{
+		Store: store,
+		Client: func(profileVendor string) (StatusClient, error) {
+			return smdp, nil
+		},
+		OnDrift: func(drift model.ProfileStateDrift) {
+			reported = append(reported, drift)
+		},
+		now: func() time.Time { return now },
+	}
+
+	result, err := scheduler.Poll(context.Background(), "Durian")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(smdp.queries))
+	assert.Equal(t, 3, result.Checked)
+	assert.Equal(t, 2, result.Changed)
+	assert.DeepEqual(t, []string{"4"}, result.Missing)
+
+	assert.Equal(t, "INSTALLED", store.entry("1").ProfileState)
+	assert.Equal(t, "2026-10-19T12:00:00Z", store.entry("1").ProfileStateUpdated)
+	assert.Equal(t, "RELEASED", store.entry("3").ProfileState)
+	assert.Equal(t, "2026-10-19T12:00:00Z", store.entry("4").ProfileStateChecked)
+
+	// Profiles whose state was changed behind our back, and profiles the
+	// SM-DP+ doesn't know, are drift.  Learning the state of a profile isn't.
+	assert.Equal(t, 2, len(reported))
+	assert.Equal(t, model.ProfileStateDrift{
+		Timestamp:         "2026-10-19T12:00:00Z",
+		ProfileVendor:     "Durian",
+		Iccid:             "1",
+		LocalState:        "RELEASED",
+		LocalStateUpdated: "2026-10-19T09:00:00Z",
+		SmdpState:         "INSTALLED",
+		Source:            Source,
+	}, reported[0])
+	assert.Equal(t, "4", reported[1].Iccid)
+	assert.Equal(t, "", reported[1].SmdpState)
+	assert.Equal(t, "Iccid='4' (Durian) is unknown to the SM-DP+, locally RELEASED since 2026-10-19T09:00:00Z", DescribeDrift(reported[1]))
+
+	// The same disagreement is only reported once.
+	reported = nil
+	result, err = scheduler.Poll(context.Background(), "Durian")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, result.Changed)
+	assert.Equal(t, 0, len(reported))
+	assert.Equal(t, 2, len(store.drift))
+}
+
+func TestPollRecordsTheStatusesItGot(t *testing.T) {
+	store := &memoryStore{entries: []model.SimEntry{
+		{Iccid: "1", ProfileState: "RELEASED", ProfileStateUpdated: "2026-10-19T09:00:00Z"},
+		{Iccid: "2", ProfileState: "RELEASED", ProfileStateUpdated: "2026-10-19T09:00:00Z"},
+	}}
+	smdp := &fakeSmdp{states: map[string]string{"1": "INSTALLED", "2": "INSTALLED"}, failing: []string{"2"}}
+	scheduler := &Scheduler{
+		Store: store,
+		Client: func(profileVendor string) (StatusClient, error) {
+			return smdp, nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	result, err := scheduler.Poll(context.Background(), "Durian")
+	assert.ErrorContains(t, err, "SM-DP+ says no")
+	assert.Equal(t, 1, result.Checked)
+	assert.Equal(t, 0, len(result.Missing))
+	assert.Equal(t, "INSTALLED", store.entry("1").ProfileState)
+	assert.Equal(t, "RELEASED", store.entry("2").ProfileState)
+	assert.Equal(t, "", store.entry("2").ProfileStateChecked)
+	assert.Equal(t, 1, len(store.drift))
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -30,17 +31,73 @@ type Store interface {
 	GetAllBatches(id string) ([]model.Batch, error)
 	GetBatchByID(id int64) (*model.Batch, error)
 	GetBatchByName(id string) (*model.Batch, error)
+	ConfirmHssLoaded(batchID int64, timestamp string, operator string) error
+	PurgeSecretsForBatch(batchID int64, timestamp string, operator string) (int, error)
+	RecordPrimeUpload(batchID int64, timestamp string, status string) error
+	MarkSimProfilesUploadedToPrime(simIDs []int64, timestamp string) error
+	ClearPrimeUploadProgress(batchID int64) error
+	TransitionBatchState(batch *model.Batch, toState string, timestamp string, operator string, note string, forced bool) error
+	CreateBatchStateTransition(transition *model.BatchStateTransition) error
+	GetBatchStateTransitions(batchID int64) ([]model.BatchStateTransition, error)
+
+	CreateEs2JournalEntry(entry *model.Es2JournalEntry) error
+	GetEs2JournalEntries(iccid string, batchID int64, from string, to string, limit int) ([]model.Es2JournalEntry, error)
+
+	CreatePendingEs2Operation(op *model.PendingEs2Operation) error
+	GetPendingEs2Operation(profileVendor string, iccid string, es2Function string) (*model.PendingEs2Operation, error)
+	GetAllPendingEs2Operations() ([]model.PendingEs2Operation, error)
+	UpdatePendingEs2Operation(op *model.PendingEs2Operation) error
+	DeletePendingEs2Operation(id int64) error
 
 	CreateSimEntry(simEntry *model.SimEntry) error
 	UpdateSimEntryMsisdn(simID int64, msisdn string)
 	UpdateActivationCode(simID int64, activationCode string) error
 	UpdateSimEntryKi(simID int64, ki string) error
+	UpdateSimEntryOpc(simID int64, opc string) error
+	UpdateSimEntryPinsAndPuks(simID int64, pin1 string, pin2 string, puk1 string, puk2 string) error
 	GetAllSimEntriesForBatch(batchID int64) ([]model.SimEntry, error)
 	GetSimProfileByIccid(msisdn string) (*model.SimEntry, error)
+	GetSimProfileByImsi(imsi string) (*model.SimEntry, error)
+	GetSimProfileByMsisdn(msisdn string) (*model.SimEntry, error)
+	UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error)
+	GetSimProfilesToPoll(profileVendor string, terminalStates []string, changedSince string, terminalCheckedBefore string, limit int) ([]model.SimEntry, error)
+	MarkSimProfileStatesChecked(iccids []string, timestamp string) error
+
+	CreateImport(imp *model.Import, fieldsBySimID map[int64][]string) error
+	ImportSimEntriesSecrets(imp *model.Import, entries []model.SimEntry, fieldsBySimID map[int64][]string) error
+	ImportSimEntriesMsisdns(imp *model.Import, msisdnsBySimID map[int64]string) error
+	GetImportByID(id int64) (*model.Import, error)
+	GetImportsBySha256(sha256 string) ([]model.Import, error)
+	GetSimProfileFieldImports(simID int64) ([]model.SimProfileFieldImport, error)
+
+	CreateProfileStateDrift(drift *model.ProfileStateDrift) error
+	GetLatestProfileStateDrift(iccid string) (*model.ProfileStateDrift, error)
+	GetProfileStateDrifts(iccid string, batchID int64, from string, limit int) ([]model.ProfileStateDrift, error)
 
 	CreateProfileVendor(*model.ProfileVendor) error
+	UpdateProfileVendor(*model.ProfileVendor) error
 	GetProfileVendorByID(id int64) (*model.ProfileVendor, error)
 	GetProfileVendorByName(name string) (*model.ProfileVendor, error)
+	GetAllProfileVendors() ([]model.ProfileVendor, error)
+	DeleteProfileVendor(name string) error
+
+	CreateJob(job *model.Job) error
+	GetJobByID(id int64) (*model.Job, error)
+	GetJobs(state string, limit int) ([]model.Job, error)
+	ClaimNextJob(worker string, timestamp string) (*model.Job, error)
+	UpdateJobProgress(job *model.Job) (bool, error)
+	FinishJob(job *model.Job) error
+	RequestJobCancel(id int64, timestamp string) (*model.Job, error)
+	RequeueStaleJobs(before string) (int64, error)
+	CreateJobLogEntry(entry *model.JobLogEntry) error
+	GetJobLog(jobID int64, level string, afterID int64) ([]model.JobLogEntry, error)
+	CreateJobCompletedIccid(jobID int64, iccid string, timestamp string) error
+	GetJobCompletedIccids(jobID int64) ([]string, error)
+
+	SetProxyForTarget(target string, proxyURL string) error
+	GetProxyForTarget(target string) (*model.ProxySetting, error)
+	DeleteProxyForTarget(target string) error
+	GetAllProxySettings() ([]model.ProxySetting, error)
 
 	Begin()
 }
@@ -148,7 +205,11 @@ func (sdb SimBatchDB) GetBatchByName(name string) (*model.Batch, error) {
 func (sdb SimBatchDB) CreateBatch(theBatch *model.Batch) error {
 	// TODO: mutex?
 
-	res, err := sdb.Db.NamedExec("INSERT INTO BATCH (name, filenameBase, orderDate, customer, profileType, batchNo, quantity, profileVendor) values (:name, :filenameBase, :orderDate, :customer, :profileType, :batchNo, :quantity, :profileVendor)",
+	if theBatch.State == "" {
+		theBatch.State = model.BatchStateDeclared
+	}
+
+	res, err := sdb.Db.NamedExec("INSERT INTO BATCH (name, filenameBase, orderDate, customer, profileType, batchNo, quantity, profileVendor, state, hssVendor) values (:name, :filenameBase, :orderDate, :customer, :profileType, :batchNo, :quantity, :profileVendor, :state, :hssVendor)",
 		theBatch,
 	)
 
@@ -187,7 +248,15 @@ func (sdb *SimBatchDB) GenerateTables() error {
 	 msisdnIncrement INTEGER,
 	 imsiIncrement INTEGER,
 	 iccidIncrement INTEGER,
-	 url VARCHAR)`
+	 url VARCHAR,
+	 state VARCHAR NOT NULL DEFAULT 'DECLARED',
+	 hssLoaded VARCHAR NOT NULL DEFAULT '',
+	 hssLoadedBy VARCHAR NOT NULL DEFAULT '',
+	 secretsPurged VARCHAR NOT NULL DEFAULT '',
+	 secretsPurgedBy VARCHAR NOT NULL DEFAULT '',
+	 primeUploaded VARCHAR NOT NULL DEFAULT '',
+	 primeUploadStatus VARCHAR NOT NULL DEFAULT '',
+	 hssVendor VARCHAR NOT NULL DEFAULT '')`
 	_, err := sdb.Db.Exec(s)
 	if err != nil {
 		return err
@@ -203,12 +272,203 @@ func (sdb *SimBatchDB) GenerateTables() error {
          iccidWithoutChecksum VARCHAR NOT NULL,
          iccid VARCHAR NOT NULL,
          ki VARCHAR NOT NULL,
+         opc VARCHAR NOT NULL DEFAULT '',
+         pin1 VARCHAR NOT NULL DEFAULT '',
+         pin2 VARCHAR NOT NULL DEFAULT '',
+         puk1 VARCHAR NOT NULL DEFAULT '',
+         puk2 VARCHAR NOT NULL DEFAULT '',
+         secretsHash VARCHAR NOT NULL DEFAULT '',
+         profileState VARCHAR NOT NULL DEFAULT '',
+         profileStateUpdated VARCHAR NOT NULL DEFAULT '',
+         profileStateChecked VARCHAR NOT NULL DEFAULT '',
+         eid VARCHAR NOT NULL DEFAULT '',
+         uploadedToPrime VARCHAR NOT NULL DEFAULT '',
          msisdn VARCHAR NOT NULL)`
 	_, err = sdb.Db.Exec(s)
 	if err != nil {
 		return err
 	}
 
+	s = `CREATE TABLE IF NOT EXISTS BATCH_STATE_TRANSITION (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         batchID INTEGER NOT NULL,
+         fromState VARCHAR NOT NULL,
+         toState VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL,
+         operator VARCHAR NOT NULL,
+         note VARCHAR NOT NULL,
+         forced BOOLEAN NOT NULL)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS ES2_JOURNAL (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         timestamp VARCHAR NOT NULL,
+         profileVendor VARCHAR NOT NULL,
+         endpoint VARCHAR NOT NULL DEFAULT '',
+         es2Function VARCHAR NOT NULL,
+         functionCallIdentifier VARCHAR NOT NULL,
+         iccids VARCHAR NOT NULL,
+         httpStatus INTEGER NOT NULL,
+         latencyMillis INTEGER NOT NULL,
+         request VARCHAR NOT NULL,
+         response VARCHAR NOT NULL,
+         error VARCHAR NOT NULL)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE INDEX IF NOT EXISTS ES2_JOURNAL_TIMESTAMP ON ES2_JOURNAL (timestamp)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS ES2_JOURNAL_ICCID (
+         journalID INTEGER NOT NULL,
+         iccid VARCHAR NOT NULL,
+         PRIMARY KEY (journalID, iccid))`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE INDEX IF NOT EXISTS ES2_JOURNAL_ICCID_ICCID ON ES2_JOURNAL_ICCID (iccid)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS PENDING_ES2_OPERATION (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         profileVendor VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL,
+         es2Function VARCHAR NOT NULL,
+         functionCallIdentifier VARCHAR NOT NULL,
+         created VARCHAR NOT NULL,
+         attempts INTEGER NOT NULL,
+         lastError VARCHAR NOT NULL,
+         UNIQUE (profileVendor, iccid, es2Function))`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS PROXY_SETTING (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         target VARCHAR NOT NULL UNIQUE,
+         proxyUrl VARCHAR NOT NULL)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS PROFILE_STATE_DRIFT (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         timestamp VARCHAR NOT NULL,
+         profileVendor VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL,
+         localState VARCHAR NOT NULL,
+         localStateUpdated VARCHAR NOT NULL,
+         smdpState VARCHAR NOT NULL,
+         source VARCHAR NOT NULL)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE INDEX IF NOT EXISTS PROFILE_STATE_DRIFT_ICCID ON PROFILE_STATE_DRIFT (iccid)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS IMPORT (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         kind VARCHAR NOT NULL,
+         batchID INTEGER NOT NULL,
+         filePath VARCHAR NOT NULL,
+         sha256 VARCHAR NOT NULL,
+         size INTEGER NOT NULL,
+         header VARCHAR NOT NULL,
+         operator VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL,
+         rowsAffected INTEGER NOT NULL,
+         forced BOOLEAN NOT NULL)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE INDEX IF NOT EXISTS IMPORT_SHA256 ON IMPORT (sha256)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS SIM_PROFILE_FIELD_IMPORT (
+         simID INTEGER NOT NULL,
+         field VARCHAR NOT NULL,
+         importID INTEGER NOT NULL,
+         PRIMARY KEY (simID, field))`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS JOB (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         kind VARCHAR NOT NULL,
+         args VARCHAR NOT NULL,
+         state VARCHAR NOT NULL,
+         submitted VARCHAR NOT NULL,
+         submittedBy VARCHAR NOT NULL DEFAULT '',
+         started VARCHAR NOT NULL DEFAULT '',
+         finished VARCHAR NOT NULL DEFAULT '',
+         worker VARCHAR NOT NULL DEFAULT '',
+         heartbeat VARCHAR NOT NULL DEFAULT '',
+         attempts INTEGER NOT NULL DEFAULT 0,
+         cancelRequested BOOLEAN NOT NULL DEFAULT 0,
+         total INTEGER NOT NULL DEFAULT 0,
+         succeeded INTEGER NOT NULL DEFAULT 0,
+         failed INTEGER NOT NULL DEFAULT 0,
+         error VARCHAR NOT NULL DEFAULT '')`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS JOB_LOG (
+         id INTEGER PRIMARY KEY AUTOINCREMENT,
+         jobID INTEGER NOT NULL,
+         timestamp VARCHAR NOT NULL,
+         level VARCHAR NOT NULL,
+         iccid VARCHAR NOT NULL DEFAULT '',
+         message VARCHAR NOT NULL)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE INDEX IF NOT EXISTS JOB_LOG_JOB ON JOB_LOG (jobID)`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
+	s = `CREATE TABLE IF NOT EXISTS JOB_COMPLETED_ICCID (
+         jobID INTEGER NOT NULL,
+         iccid VARCHAR NOT NULL,
+         timestamp VARCHAR NOT NULL,
+         PRIMARY KEY (jobID, iccid))`
+	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
+
 	s = `CREATE TABLE IF NOT EXISTS PROFILE_VENDOR (
          id INTEGER PRIMARY KEY AUTOINCREMENT,
          name VARCHAR NOT NULL UNIQUE,
@@ -216,10 +476,136 @@ func (sdb *SimBatchDB) GenerateTables() error {
          es2PlusKeyPath VARCHAR,
          es2PlusHostPath VARCHAR,
          es2PlusPort VARCHAR,
-         es2PlusRequesterId VARCHAR)`
+         es2PlusRequesterId VARCHAR,
+         smdpAddress VARCHAR NOT NULL DEFAULT '',
+         es2PlusStatusListSize INTEGER NOT NULL DEFAULT 0,
+         es2PlusRequestTimeoutMillis INTEGER NOT NULL DEFAULT 0,
+         es2PlusTlsHandshakeTimeoutMillis INTEGER NOT NULL DEFAULT 0,
+         es2PlusMaxIdleConns INTEGER NOT NULL DEFAULT 0,
+         es2PlusMaxConnsPerHost INTEGER NOT NULL DEFAULT 0,
+         es2PlusHttp2 BOOLEAN NOT NULL DEFAULT 1,
+         es2PlusBreakerThreshold INTEGER NOT NULL DEFAULT 0,
+         es2PlusBreakerOpenMillis INTEGER NOT NULL DEFAULT 0,
+         es2PlusProtocolVersion VARCHAR NOT NULL DEFAULT '',
+         es2PlusBasePath VARCHAR NOT NULL DEFAULT '',
+         es2PlusFieldNames VARCHAR NOT NULL DEFAULT '',
+         es2PlusFailoverEndpoints VARCHAR NOT NULL DEFAULT '',
+         es2PlusProxy VARCHAR NOT NULL DEFAULT '')`
 	_, err = sdb.Db.Exec(s)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err := sdb.addMissingColumns(); err != nil {
+		return err
+	}
+	return sdb.indexEs2JournalIccids()
+}
+
+// indexEs2JournalIccids adds the ICCIDs of the journal entries made before
+// ES2_JOURNAL_ICCID existed to it.  Running it again changes nothing.
+func (sdb *SimBatchDB) indexEs2JournalIccids() error {
+	_, err := sdb.Db.Exec(`INSERT OR IGNORE INTO ES2_JOURNAL_ICCID (journalID, iccid)
+         WITH RECURSIVE split(journalID, iccid, rest) AS (
+             SELECT j.id, '', j.iccids || ',' FROM ES2_JOURNAL j
+              WHERE j.iccids <> '' AND NOT EXISTS (SELECT 1 FROM ES2_JOURNAL_ICCID ji WHERE ji.journalID = j.id)
+             UNION ALL
+             SELECT journalID, substr(rest, 1, instr(rest, ',') - 1), substr(rest, instr(rest, ',') + 1)
+               FROM split WHERE rest <> '')
+         SELECT journalID, iccid FROM split WHERE iccid <> ''`)
+	if err != nil {
+		return fmt.Errorf("couldn't index the ICCIDs of the ES2+ journal: %v", err)
+	}
+	return nil
+}
+
+// addedColumns are the columns that were added to tables after they were
+// first created.  CREATE TABLE IF NOT EXISTS leaves tables in existing
+// databases as they are, so these columns are added to them by GenerateTables.
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"BATCH", "state", "VARCHAR NOT NULL DEFAULT 'DECLARED'"},
+	{"BATCH", "hssLoaded", "VARCHAR NOT NULL DEFAULT ''"},
+	{"BATCH", "hssLoadedBy", "VARCHAR NOT NULL DEFAULT ''"},
+	{"BATCH", "secretsPurged", "VARCHAR NOT NULL DEFAULT ''"},
+	{"BATCH", "secretsPurgedBy", "VARCHAR NOT NULL DEFAULT ''"},
+	{"BATCH", "primeUploaded", "VARCHAR NOT NULL DEFAULT ''"},
+	{"BATCH", "primeUploadStatus", "VARCHAR NOT NULL DEFAULT ''"},
+	{"BATCH", "hssVendor", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "opc", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "pin1", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "pin2", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "puk1", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "puk2", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "secretsHash", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "profileState", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "profileStateUpdated", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "profileStateChecked", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "eid", "VARCHAR NOT NULL DEFAULT ''"},
+	{"SIM_PROFILE", "uploadedToPrime", "VARCHAR NOT NULL DEFAULT ''"},
+	{"PROFILE_VENDOR", "smdpAddress", "VARCHAR NOT NULL DEFAULT ''"},
+	{"PROFILE_VENDOR", "es2PlusStatusListSize", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusRequestTimeoutMillis", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusTlsHandshakeTimeoutMillis", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusMaxIdleConns", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusMaxConnsPerHost", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusHttp2", "BOOLEAN NOT NULL DEFAULT 1"},
+	{"PROFILE_VENDOR", "es2PlusBreakerThreshold", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusBreakerOpenMillis", "INTEGER NOT NULL DEFAULT 0"},
+	{"PROFILE_VENDOR", "es2PlusProtocolVersion", "VARCHAR NOT NULL DEFAULT ''"},
+	{"PROFILE_VENDOR", "es2PlusBasePath", "VARCHAR NOT NULL DEFAULT ''"},
+	{"PROFILE_VENDOR", "es2PlusFieldNames", "VARCHAR NOT NULL DEFAULT ''"},
+	{"PROFILE_VENDOR", "es2PlusFailoverEndpoints", "VARCHAR NOT NULL DEFAULT ''"},
+	{"PROFILE_VENDOR", "es2PlusProxy", "VARCHAR NOT NULL DEFAULT ''"},
+	{"ES2_JOURNAL", "endpoint", "VARCHAR NOT NULL DEFAULT ''"},
+}
+
+// addMissingColumns adds the added columns that are missing from the tables.
+// Running it again changes nothing.
+func (sdb *SimBatchDB) addMissingColumns() error {
+	existing := make(map[string]map[string]bool)
+	for _, added := range addedColumns {
+		if existing[added.table] == nil {
+			columns, err := sdb.columnNames(added.table)
+			if err != nil {
+				return err
+			}
+			existing[added.table] = columns
+		}
+		if existing[added.table][added.column] {
+			continue
+		}
+		_, err := sdb.Db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", added.table, added.column, added.definition))
+		if err != nil {
+			return fmt.Errorf("couldn't add column %s to %s: %v", added.column, added.table, err)
+		}
+		existing[added.table][added.column] = true
+	}
+	return nil
+}
+
+// columnNames returns the names of the columns of a table.
+func (sdb *SimBatchDB) columnNames(table string) (map[string]bool, error) {
+	rows, err := sdb.Db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
 }
 
 //CreateProfileVendor inject a new profile vendor instance into the database.
@@ -232,8 +618,14 @@ func (sdb SimBatchDB) CreateProfileVendor(theEntry *model.ProfileVendor) error {
 	}
 
 	res, err := sdb.Db.NamedExec(`
-       INSERT INTO PROFILE_VENDOR (name,   es2PlusCertPath,  es2PlusKeyPath,  es2PlusHostPath,  es2PlusPort, es2PlusRequesterId)
-                           VALUES (:name, :es2PlusCertPath, :es2PlusKeyPath, :es2PlusHostPath, :es2PlusPort, :es2PlusRequesterId)`,
+       INSERT INTO PROFILE_VENDOR (name,   es2PlusCertPath,  es2PlusKeyPath,  es2PlusHostPath,  es2PlusPort, es2PlusRequesterId, smdpAddress, es2PlusStatusListSize,
+                                    es2PlusRequestTimeoutMillis, es2PlusTlsHandshakeTimeoutMillis, es2PlusMaxIdleConns, es2PlusMaxConnsPerHost, es2PlusHttp2,
+                                    es2PlusBreakerThreshold, es2PlusBreakerOpenMillis,
+                                    es2PlusProtocolVersion, es2PlusBasePath, es2PlusFieldNames, es2PlusFailoverEndpoints, es2PlusProxy)
+                           VALUES (:name, :es2PlusCertPath, :es2PlusKeyPath, :es2PlusHostPath, :es2PlusPort, :es2PlusRequesterId, :smdpAddress, :es2PlusStatusListSize,
+                                   :es2PlusRequestTimeoutMillis, :es2PlusTlsHandshakeTimeoutMillis, :es2PlusMaxIdleConns, :es2PlusMaxConnsPerHost, :es2PlusHttp2,
+                                   :es2PlusBreakerThreshold, :es2PlusBreakerOpenMillis,
+                                   :es2PlusProtocolVersion, :es2PlusBasePath, :es2PlusFieldNames, :es2PlusFailoverEndpoints, :es2PlusProxy)`,
 		theEntry)
 	if err != nil {
 		return err
@@ -247,6 +639,31 @@ func (sdb SimBatchDB) CreateProfileVendor(theEntry *model.ProfileVendor) error {
 	return nil
 }
 
+// UpdateProfileVendor writes all the fields of a profile vendor, except its
+// name, back to the database.
+func (sdb SimBatchDB) UpdateProfileVendor(theEntry *model.ProfileVendor) error {
+	_, err := sdb.Db.NamedExec(`
+       UPDATE PROFILE_VENDOR SET es2PlusCertPath = :es2PlusCertPath, es2PlusKeyPath = :es2PlusKeyPath,
+                                 es2PlusHostPath = :es2PlusHostPath, es2PlusPort = :es2PlusPort,
+                                 es2PlusRequesterId = :es2PlusRequesterId, smdpAddress = :smdpAddress,
+                                 es2PlusStatusListSize = :es2PlusStatusListSize,
+                                 es2PlusRequestTimeoutMillis = :es2PlusRequestTimeoutMillis,
+                                 es2PlusTlsHandshakeTimeoutMillis = :es2PlusTlsHandshakeTimeoutMillis,
+                                 es2PlusMaxIdleConns = :es2PlusMaxIdleConns,
+                                 es2PlusMaxConnsPerHost = :es2PlusMaxConnsPerHost,
+                                 es2PlusHttp2 = :es2PlusHttp2,
+                                 es2PlusBreakerThreshold = :es2PlusBreakerThreshold,
+                                 es2PlusBreakerOpenMillis = :es2PlusBreakerOpenMillis,
+                                 es2PlusProtocolVersion = :es2PlusProtocolVersion,
+                                 es2PlusBasePath = :es2PlusBasePath,
+                                 es2PlusFieldNames = :es2PlusFieldNames,
+                                 es2PlusFailoverEndpoints = :es2PlusFailoverEndpoints,
+                                 es2PlusProxy = :es2PlusProxy
+       WHERE id = :id`,
+		theEntry)
+	return err
+}
+
 // GetProfileVendorByID find a profile vendor in the database by looking it up by name.
 func (sdb SimBatchDB) GetProfileVendorByID(id int64) (*model.ProfileVendor, error) {
 	//noinspection GoPreferNilSlice
@@ -276,10 +693,39 @@ func (sdb SimBatchDB) GetProfileVendorByName(name string) (*model.ProfileVendor,
 	return &result[0], nil
 }
 
+// GetAllProfileVendors gets all the profile vendors, ordered by name.
+func (sdb SimBatchDB) GetAllProfileVendors() ([]model.ProfileVendor, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.ProfileVendor{}
+	return result, sdb.Db.Select(&result, "SELECT * FROM PROFILE_VENDOR ORDER BY name")
+}
+
+// DeleteProfileVendor deletes a profile vendor.  Vendors of declared batches
+// can't be deleted.
+func (sdb SimBatchDB) DeleteProfileVendor(name string) error {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var batches int
+	if err := tx.Get(&batches, "SELECT COUNT(*) FROM BATCH WHERE profileVendor = ?", name); err != nil {
+		return err
+	}
+	if batches > 0 {
+		return fmt.Errorf("profile vendor '%s' is the vendor of %d batch(es), can't delete it", name, batches)
+	}
+	if _, err := tx.Exec("DELETE FROM PROFILE_VENDOR WHERE name = ?", name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // CreateSimEntry persists a SimEntry instance in the database.
 func (sdb SimBatchDB) CreateSimEntry(theEntry *model.SimEntry) error {
 
-	res := sdb.Db.MustExec("INSERT INTO SIM_PROFILE (batchID, activationCode, rawIccid, iccidWithChecksum, iccidWithoutChecksum, iccid, imsi, msisdn, ki) values (?,?,?,?,?,?,?,?,?)",
+	res := sdb.Db.MustExec("INSERT INTO SIM_PROFILE (batchID, activationCode, rawIccid, iccidWithChecksum, iccidWithoutChecksum, iccid, imsi, msisdn, ki, opc, pin1, pin2, puk1, puk2, secretsHash) values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
 		theEntry.BatchID,
 		theEntry.ActivationCode,
 		theEntry.RawIccid,
@@ -289,6 +735,12 @@ func (sdb SimBatchDB) CreateSimEntry(theEntry *model.SimEntry) error {
 		theEntry.Imsi,
 		theEntry.Msisdn,
 		theEntry.Ki,
+		theEntry.Opc,
+		theEntry.Pin1,
+		theEntry.Pin2,
+		theEntry.Puk1,
+		theEntry.Puk2,
+		theEntry.SecretsHash,
 	)
 
 	id, err := res.LastInsertId()
@@ -361,6 +813,21 @@ func (sdb SimBatchDB) GetSimProfileByImsi(imsi string) (*model.SimEntry, error)
 	return &result[0], nil
 }
 
+// GetSimProfileByMsisdn gets a sim profile from the database, return nil of one
+// can't be found.
+func (sdb SimBatchDB) GetSimProfileByMsisdn(msisdn string) (*model.SimEntry, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.SimEntry{}
+	if err := sdb.Db.Select(&result, "select * from SIM_PROFILE where msisdn = ?", msisdn); err != nil {
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
 // UpdateSimEntryMsisdn Sets the MSISDN field of a persisted instance of a sim entry.
 func (sdb SimBatchDB) UpdateSimEntryMsisdn(simID int64, msisdn string) error {
 	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET msisdn=:msisdn WHERE id = :simID",
@@ -381,6 +848,80 @@ func (sdb SimBatchDB) UpdateSimEntryKi(simID int64, ki string) error {
 	return err
 }
 
+// UpdateSimEntryOpc Sets the OPc field of a persisted instance of a sim entry.
+func (sdb SimBatchDB) UpdateSimEntryOpc(simID int64, opc string) error {
+	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET opc=:opc WHERE id = :simID",
+		map[string]interface{}{
+			"simID": simID,
+			"opc":   opc,
+		})
+	return err
+}
+
+// UpdateSimEntryPinsAndPuks Sets the PIN and PUK fields of a persisted instance of a sim entry.
+func (sdb SimBatchDB) UpdateSimEntryPinsAndPuks(simID int64, pin1 string, pin2 string, puk1 string, puk2 string) error {
+	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET pin1=:pin1, pin2=:pin2, puk1=:puk1, puk2=:puk2 WHERE id = :simID",
+		map[string]interface{}{
+			"simID": simID,
+			"pin1":  pin1,
+			"pin2":  pin2,
+			"puk1":  puk1,
+			"puk2":  puk2,
+		})
+	return err
+}
+
+// updateSimEntrySecrets sets the Ki, and the OPc, PINs and PUKs where
+// given, of a persisted sim entry, found by its ID.
+func updateSimEntrySecrets(tx *sqlx.Tx, entry model.SimEntry) error {
+	res, err := tx.NamedExec(`UPDATE SIM_PROFILE SET
+		  ki = :ki,
+		  opc = CASE WHEN :opc = '' THEN opc ELSE :opc END,
+		  pin1 = CASE WHEN :hasPins THEN :pin1 ELSE pin1 END,
+		  pin2 = CASE WHEN :hasPins THEN :pin2 ELSE pin2 END,
+		  puk1 = CASE WHEN :hasPins THEN :puk1 ELSE puk1 END,
+		  puk2 = CASE WHEN :hasPins THEN :puk2 ELSE puk2 END
+		WHERE id = :simID`,
+		map[string]interface{}{
+			"simID":   entry.ID,
+			"ki":      entry.Ki,
+			"opc":     entry.Opc,
+			"hasPins": entry.Pin1 != "" || entry.Pin2 != "" || entry.Puk1 != "" || entry.Puk2 != "",
+			"pin1":    entry.Pin1,
+			"pin2":    entry.Pin2,
+			"puk1":    entry.Puk1,
+			"puk2":    entry.Puk2,
+		})
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("no sim profile with id %d", entry.ID)
+	}
+	return nil
+}
+
+// updateSimEntryMsisdn sets the MSISDN of a persisted sim entry, found by
+// its ID, that has none yet.
+func updateSimEntryMsisdn(tx *sqlx.Tx, simID int64, msisdn string) error {
+	res, err := tx.Exec("UPDATE SIM_PROFILE SET msisdn = ? WHERE id = ? AND (msisdn IS NULL OR msisdn = '')", msisdn, simID)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("no sim profile with id %d and without an MSISDN", simID)
+	}
+	return nil
+}
+
 // UpdateActivationCode Sets the activation code field of a persisted instance of a sim entry.
 func (sdb SimBatchDB) UpdateActivationCode(simID int64, activationCode string) error {
 	_, err := sdb.Db.NamedExec("UPDATE SIM_PROFILE SET activationCode=:activationCode WHERE id = :simID",
@@ -391,14 +932,908 @@ func (sdb SimBatchDB) UpdateActivationCode(simID int64, activationCode string) e
 	return err
 }
 
-// DropTables Drop all tables used by the store package.
-func (sdb *SimBatchDB) DropTables() error {
-	foo := `DROP  TABLE BATCH`
-	_, err := sdb.Db.Exec(foo)
+// UpdateSimProfileState records the state of a profile in the SM-DP+, and/or the
+// EID of the eUICC it was downloaded to, as reported at the given time (RFC3339,
+// UTC).  Empty values are left unchanged.  Reports older than the last recorded
+// one are ignored, and false is returned.
+func (sdb SimBatchDB) UpdateSimProfileState(iccid string, state string, eid string, timestamp string) (bool, error) {
+	res, err := sdb.Db.NamedExec(`UPDATE SIM_PROFILE SET
+		  profileState = CASE WHEN :state = '' THEN profileState ELSE :state END,
+		  profileStateUpdated = CASE WHEN :state = '' THEN profileStateUpdated ELSE :timestamp END,
+		  eid = CASE WHEN :eid = '' THEN eid ELSE :eid END
+		WHERE iccid = :iccid AND profileStateUpdated <= :timestamp`,
+		map[string]interface{}{
+			"iccid":     iccid,
+			"state":     state,
+			"eid":       eid,
+			"timestamp": timestamp,
+		})
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// GetSimProfilesToPoll returns the profiles of a profile vendor whose state
+// should be polled from the SM-DP+, at most limit of them, most urgent first.
+// First come the profiles not in a terminal state that have changed since
+// changedSince, then the other ones not in a terminal state, and last the
+// ones in a terminal state not checked since terminalCheckedBefore.  Within
+// each group, the ones checked longest ago come first.  Timestamps are
+// RFC3339 in UTC.  Only the ID, ICCID, EID and the state and its timestamps
+// are returned, not the secrets.
+func (sdb SimBatchDB) GetSimProfilesToPoll(profileVendor string, terminalStates []string, changedSince string, terminalCheckedBefore string, limit int) ([]model.SimEntry, error) {
+	isTerminal := "0"
+	if len(terminalStates) > 0 {
+		isTerminal = "s.profileState IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(terminalStates)), ", ") + ")"
+	}
+	query := fmt.Sprintf(`SELECT s.id, s.iccid, s.eid, s.profileState, s.profileStateUpdated, s.profileStateChecked
+                FROM SIM_PROFILE s JOIN BATCH b ON s.batchID = b.id
+               WHERE b.profileVendor = ?
+                 AND (NOT %[1]s OR s.profileStateChecked < ?)
+               ORDER BY CASE WHEN %[1]s THEN 2 WHEN s.profileStateUpdated >= ? THEN 0 ELSE 1 END,
+                        s.profileStateChecked, s.id
+               LIMIT ?`, isTerminal)
+
+	args := []interface{}{profileVendor}
+	for _, state := range terminalStates {
+		args = append(args, state)
+	}
+	args = append(args, terminalCheckedBefore)
+	for _, state := range terminalStates {
+		args = append(args, state)
+	}
+	args = append(args, changedSince, limit)
+
+	//noinspection GoPreferNilSlice
+	result := []model.SimEntry{}
+	return result, sdb.Db.Select(&result, query, args...)
+}
+
+// MarkSimProfileStatesChecked records when the state of profiles was last
+// checked with the SM-DP+.
+func (sdb SimBatchDB) MarkSimProfileStatesChecked(iccids []string, timestamp string) error {
+	tx, err := sdb.Db.Beginx()
 	if err != nil {
 		return err
 	}
-	foo = `DROP  TABLE SIM_PROFILE`
+	defer tx.Rollback()
+
+	for _, iccid := range iccids {
+		if _, err := tx.Exec("UPDATE SIM_PROFILE SET profileStateChecked = ? WHERE iccid = ?", timestamp, iccid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CreateImport stores an import, and records it as the import that set the
+// given fields of the profiles, all in one transaction.
+func (sdb SimBatchDB) CreateImport(imp *model.Import, fieldsBySimID map[int64][]string) error {
+	return sdb.importFields(imp, fieldsBySimID, func(tx *sqlx.Tx) error { return nil })
+}
+
+// ImportSimEntriesSecrets sets the Ki, and the OPc, PINs and PUKs where
+// given, of persisted sim entries, found by their IDs, stores the import
+// they were read in, and records it as the import that set the given fields
+// of the profiles.  Either all of it is stored, or none of it.
+func (sdb SimBatchDB) ImportSimEntriesSecrets(imp *model.Import, entries []model.SimEntry, fieldsBySimID map[int64][]string) error {
+	return sdb.importFields(imp, fieldsBySimID, func(tx *sqlx.Tx) error {
+		for _, entry := range entries {
+			if err := updateSimEntrySecrets(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportSimEntriesMsisdns sets the MSISDNs of persisted sim entries that
+// have none yet, found by their IDs, stores the import they were read in,
+// and records it as the import that set their MSISDNs.  Either all of it is
+// stored, or none of it.
+func (sdb SimBatchDB) ImportSimEntriesMsisdns(imp *model.Import, msisdnsBySimID map[int64]string) error {
+	fieldsBySimID := make(map[int64][]string)
+	for simID := range msisdnsBySimID {
+		fieldsBySimID[simID] = []string{"msisdn"}
+	}
+	return sdb.importFields(imp, fieldsBySimID, func(tx *sqlx.Tx) error {
+		for simID, msisdn := range msisdnsBySimID {
+			if err := updateSimEntryMsisdn(tx, simID, msisdn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// importFields runs the update of the imported fields, stores the import
+// and records it as the import that set the fields, in one transaction.
+func (sdb SimBatchDB) importFields(imp *model.Import, fieldsBySimID map[int64][]string, update func(tx *sqlx.Tx) error) error {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := update(tx); err != nil {
+		return err
+	}
+
+	res, err := tx.NamedExec(`INSERT INTO IMPORT (kind, batchID, filePath, sha256, size, header, operator, timestamp, rowsAffected, forced)
+                               VALUES (:kind, :batchID, :filePath, :sha256, :size, :header, :operator, :timestamp, :rowsAffected, :forced)`, imp)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+
+	for simID, fields := range fieldsBySimID {
+		for _, field := range fields {
+			_, err := tx.Exec("INSERT OR REPLACE INTO SIM_PROFILE_FIELD_IMPORT (simID, field, importID) VALUES (?, ?, ?)", simID, field, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	imp.ID = id
+	return nil
+}
+
+// GetImportByID finds an import, returns nil if there is none with the ID.
+func (sdb SimBatchDB) GetImportByID(id int64) (*model.Import, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.Import{}
+	if err := sdb.Db.Select(&result, "SELECT * FROM IMPORT WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// GetImportsBySha256 finds the imports of files with a SHA-256, oldest first.
+func (sdb SimBatchDB) GetImportsBySha256(sha256 string) ([]model.Import, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.Import{}
+	return result, sdb.Db.Select(&result, "SELECT * FROM IMPORT WHERE sha256 = ? ORDER BY id", sha256)
+}
+
+// GetSimProfileFieldImports finds the imports that set the fields of a profile.
+func (sdb SimBatchDB) GetSimProfileFieldImports(simID int64) ([]model.SimProfileFieldImport, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.SimProfileFieldImport{}
+	return result, sdb.Db.Select(&result, "SELECT * FROM SIM_PROFILE_FIELD_IMPORT WHERE simID = ? ORDER BY field", simID)
+}
+
+// CreateProfileStateDrift stores a disagreement between the local and the SM-DP+'s state of a profile.
+func (sdb SimBatchDB) CreateProfileStateDrift(drift *model.ProfileStateDrift) error {
+	res, err := sdb.Db.NamedExec(`INSERT INTO PROFILE_STATE_DRIFT (timestamp, profileVendor, iccid, localState, localStateUpdated, smdpState, source)
+                                   VALUES (:timestamp, :profileVendor, :iccid, :localState, :localStateUpdated, :smdpState, :source)`, drift)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+	drift.ID = id
+	return nil
+}
+
+// GetLatestProfileStateDrift finds the latest disagreement about the state of a profile,
+// returns nil if there has been none.
+func (sdb SimBatchDB) GetLatestProfileStateDrift(iccid string) (*model.ProfileStateDrift, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.ProfileStateDrift{}
+	if err := sdb.Db.Select(&result, "SELECT * FROM PROFILE_STATE_DRIFT WHERE iccid = ? ORDER BY id DESC LIMIT 1", iccid); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// GetProfileStateDrifts finds the disagreements about the state of a profile, or
+// any of the profiles in a batch, found at or after a time (RFC3339), oldest first.
+// Empty strings and zero batch ID / limit means "don't restrict on this".
+func (sdb SimBatchDB) GetProfileStateDrifts(iccid string, batchID int64, from string, limit int) ([]model.ProfileStateDrift, error) {
+	query := "SELECT * FROM PROFILE_STATE_DRIFT d WHERE 1=1"
+	var args []interface{}
+
+	if iccid != "" {
+		query += " AND d.iccid = ?"
+		args = append(args, iccid)
+	}
+	if batchID != 0 {
+		query += " AND d.iccid IN (SELECT iccid FROM SIM_PROFILE WHERE batchID = ?)"
+		args = append(args, batchID)
+	}
+	if from != "" {
+		query += " AND d.timestamp >= ?"
+		args = append(args, from)
+	}
+	query += " ORDER BY d.id"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	//noinspection GoPreferNilSlice
+	result := []model.ProfileStateDrift{}
+	return result, sdb.Db.Select(&result, query, args...)
+}
+
+// ConfirmHssLoaded records that the HSS has confirmed that all the profiles
+// in the batch have been loaded.
+func (sdb SimBatchDB) ConfirmHssLoaded(batchID int64, timestamp string, operator string) error {
+	_, err := sdb.Db.NamedExec("UPDATE BATCH SET hssLoaded=:hssLoaded, hssLoadedBy=:hssLoadedBy WHERE id = :batchID",
+		map[string]interface{}{
+			"batchID":     batchID,
+			"hssLoaded":   timestamp,
+			"hssLoadedBy": operator,
+		})
+	return err
+}
+
+// CheckBatchStateTransition checks that going from one lifecycle state to another
+// is done in the right order, i.e. that the target state is either the current
+// state (re-running a step) or the state immediately following it.
+func CheckBatchStateTransition(fromState string, toState string) error {
+	fromIndex := batchStateIndex(fromState)
+	toIndex := batchStateIndex(toState)
+	if toIndex < 0 {
+		return fmt.Errorf("unknown batch state '%s'", toState)
+	}
+	if fromIndex < 0 {
+		return fmt.Errorf("unknown batch state '%s'", fromState)
+	}
+	if toIndex != fromIndex && toIndex != fromIndex+1 {
+		return fmt.Errorf("illegal batch state transition from %s to %s", fromState, toState)
+	}
+	return nil
+}
+
+func batchStateIndex(state string) int {
+	for i, s := range model.BatchStates {
+		if s == state {
+			return i
+		}
+	}
+	return -1
+}
+
+// TransitionBatchState moves a batch to a new lifecycle state, and records the transition.
+// Unless forced, the transition must be legal according to CheckBatchStateTransition.
+// Re-running a step (transitioning to the current state) is not recorded.
+func (sdb SimBatchDB) TransitionBatchState(batch *model.Batch, toState string, timestamp string, operator string, note string, forced bool) error {
+	if batchStateIndex(toState) < 0 {
+		return fmt.Errorf("unknown batch state '%s'", toState)
+	}
+
+	if !forced {
+		if err := CheckBatchStateTransition(batch.State, toState); err != nil {
+			return err
+		}
+	}
+
+	if batch.State == toState {
+		return nil
+	}
+
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	// Guard against the state having been changed by someone else since the
+	// batch was read.
+	res, err := tx.Exec("UPDATE BATCH SET state = ? WHERE id = ? AND state = ?", toState, batch.BatchID, batch.State)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if noOfRows, err := res.RowsAffected(); err != nil || noOfRows != 1 {
+		tx.Rollback()
+		return fmt.Errorf("batch '%s' is no longer in state %s", batch.Name, batch.State)
+	}
+
+	transition := &model.BatchStateTransition{
+		BatchID:   batch.BatchID,
+		FromState: batch.State,
+		ToState:   toState,
+		Timestamp: timestamp,
+		Operator:  operator,
+		Note:      note,
+		Forced:    forced,
+	}
+	if _, err = tx.NamedExec(`INSERT INTO BATCH_STATE_TRANSITION (batchID, fromState, toState, timestamp, operator, note, forced)
+                               VALUES (:batchID, :fromState, :toState, :timestamp, :operator, :note, :forced)`, transition); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	batch.State = toState
+	return nil
+}
+
+// CreateBatchStateTransition persists a batch state transition without checking it,
+// used to record the initial state of new batches.
+func (sdb SimBatchDB) CreateBatchStateTransition(transition *model.BatchStateTransition) error {
+	res, err := sdb.Db.NamedExec(`INSERT INTO BATCH_STATE_TRANSITION (batchID, fromState, toState, timestamp, operator, note, forced)
+                                   VALUES (:batchID, :fromState, :toState, :timestamp, :operator, :note, :forced)`, transition)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+	transition.ID = id
+	return nil
+}
+
+// GetBatchStateTransitions returns all the recorded state transitions of a batch,
+// oldest first.
+func (sdb SimBatchDB) GetBatchStateTransitions(batchID int64) ([]model.BatchStateTransition, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.BatchStateTransition{}
+	return result, sdb.Db.Select(&result, "SELECT * FROM BATCH_STATE_TRANSITION WHERE batchID = ? ORDER BY id", batchID)
+}
+
+// CreateEs2JournalEntry stores a record of an ES2+ exchange, and indexes it
+// by each of the ICCIDs it concerns.
+func (sdb SimBatchDB) CreateEs2JournalEntry(entry *model.Es2JournalEntry) error {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.NamedExec(`INSERT INTO ES2_JOURNAL (timestamp, profileVendor, endpoint, es2Function, functionCallIdentifier, iccids, httpStatus, latencyMillis, request, response, error)
+                                   VALUES (:timestamp, :profileVendor, :endpoint, :es2Function, :functionCallIdentifier, :iccids, :httpStatus, :latencyMillis, :request, :response, :error)`, entry)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+	for _, iccid := range strings.Split(entry.Iccids, ",") {
+		if iccid == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO ES2_JOURNAL_ICCID (journalID, iccid) VALUES (?, ?)", id, iccid); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	entry.ID = id
+	return nil
+}
+
+// GetEs2JournalEntries finds the ES2+ exchanges concerning an ICCID, any of the
+// profiles in a batch, and/or within a time range (RFC3339 timestamps, inclusive).
+// Empty strings and zero batch ID / limit means "don't restrict on this".
+func (sdb SimBatchDB) GetEs2JournalEntries(iccid string, batchID int64, from string, to string, limit int) ([]model.Es2JournalEntry, error) {
+	query := "SELECT * FROM ES2_JOURNAL j WHERE 1=1"
+	var args []interface{}
+
+	if iccid != "" {
+		query += " AND j.id IN (SELECT ji.journalID FROM ES2_JOURNAL_ICCID ji WHERE ji.iccid = ?)"
+		args = append(args, iccid)
+	}
+	if batchID != 0 {
+		query += " AND j.id IN (SELECT ji.journalID FROM ES2_JOURNAL_ICCID ji JOIN SIM_PROFILE s ON s.iccid = ji.iccid WHERE s.batchID = ?)"
+		args = append(args, batchID)
+	}
+	if from != "" {
+		query += " AND j.timestamp >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		query += " AND j.timestamp <= ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY j.id"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	//noinspection GoPreferNilSlice
+	result := []model.Es2JournalEntry{}
+	return result, sdb.Db.Select(&result, query, args...)
+}
+
+// CreatePendingEs2Operation stores a state changing ES2+ call before it is sent.
+func (sdb SimBatchDB) CreatePendingEs2Operation(op *model.PendingEs2Operation) error {
+	res, err := sdb.Db.NamedExec(`INSERT INTO PENDING_ES2_OPERATION (profileVendor, iccid, es2Function, functionCallIdentifier, created, attempts, lastError)
+                                   VALUES (:profileVendor, :iccid, :es2Function, :functionCallIdentifier, :created, :attempts, :lastError)`, op)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+	op.ID = id
+	return nil
+}
+
+// GetPendingEs2Operation finds the pending ES2+ call of a kind for a profile, returns
+// nil if there is none.
+func (sdb SimBatchDB) GetPendingEs2Operation(profileVendor string, iccid string, es2Function string) (*model.PendingEs2Operation, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.PendingEs2Operation{}
+	if err := sdb.Db.Select(&result, "SELECT * FROM PENDING_ES2_OPERATION WHERE profileVendor = ? AND iccid = ? AND es2Function = ?",
+		profileVendor, iccid, es2Function); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// GetAllPendingEs2Operations returns all the pending ES2+ calls, oldest first.
+func (sdb SimBatchDB) GetAllPendingEs2Operations() ([]model.PendingEs2Operation, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.PendingEs2Operation{}
+	return result, sdb.Db.Select(&result, "SELECT * FROM PENDING_ES2_OPERATION ORDER BY id")
+}
+
+// UpdatePendingEs2Operation records another attempt at a pending ES2+ call.
+func (sdb SimBatchDB) UpdatePendingEs2Operation(op *model.PendingEs2Operation) error {
+	_, err := sdb.Db.NamedExec("UPDATE PENDING_ES2_OPERATION SET attempts = :attempts, lastError = :lastError WHERE id = :id", op)
+	return err
+}
+
+// DeletePendingEs2Operation forgets a pending ES2+ call, once its outcome is known.
+func (sdb SimBatchDB) DeletePendingEs2Operation(id int64) error {
+	_, err := sdb.Db.Exec("DELETE FROM PENDING_ES2_OPERATION WHERE id = ?", id)
+	return err
+}
+
+// CreateJob stores a new job.
+func (sdb SimBatchDB) CreateJob(job *model.Job) error {
+	res, err := sdb.Db.NamedExec(`INSERT INTO JOB (kind, args, state, submitted, submittedBy)
+                                   VALUES (:kind, :args, :state, :submitted, :submittedBy)`, job)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+	job.ID = id
+	return nil
+}
+
+// GetJobByID finds a job, returns nil if there is no job with the ID.
+func (sdb SimBatchDB) GetJobByID(id int64) (*model.Job, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.Job{}
+	if err := sdb.Db.Select(&result, "SELECT * FROM JOB WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// GetJobs returns the jobs in a state, or all jobs if the state is empty, newest
+// first.  A zero limit means "no limit".
+func (sdb SimBatchDB) GetJobs(state string, limit int) ([]model.Job, error) {
+	query := "SELECT * FROM JOB WHERE 1=1"
+	var args []interface{}
+	if state != "" {
+		query += " AND state = ?"
+		args = append(args, state)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	//noinspection GoPreferNilSlice
+	result := []model.Job{}
+	return result, sdb.Db.Select(&result, query, args...)
+}
+
+// ClaimNextJob hands the oldest queued job to a worker, and marks it as
+// running.  The progress counters are reset for the new attempt, except
+// that the profiles completed by earlier attempts are counted as succeeded.
+// Returns nil if there are no queued jobs.
+func (sdb SimBatchDB) ClaimNextJob(worker string, timestamp string) (*model.Job, error) {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	//noinspection GoPreferNilSlice
+	queued := []model.Job{}
+	if err := tx.Select(&queued, "SELECT * FROM JOB WHERE state = ? ORDER BY id LIMIT 1", model.JobQueued); err != nil {
+		return nil, err
+	}
+	if len(queued) == 0 {
+		return nil, nil
+	}
+
+	job := queued[0]
+	job.State = model.JobRunning
+	job.Worker = worker
+	job.Heartbeat = timestamp
+	if job.Started == "" {
+		job.Started = timestamp
+	}
+	job.Attempts++
+	job.Total = 0
+	job.Failed = 0
+	job.Error = ""
+	if err := tx.Get(&job.Succeeded, "SELECT COUNT(*) FROM JOB_COMPLETED_ICCID WHERE jobID = ?", job.ID); err != nil {
+		return nil, err
+	}
+
+	res, err := tx.NamedExec(`UPDATE JOB SET state = :state, worker = :worker, heartbeat = :heartbeat, started = :started, attempts = :attempts,
+                                  total = 0, succeeded = :succeeded, failed = 0, error = '' WHERE id = :id AND state = 'QUEUED'`, &job)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows != 1 {
+		// Claimed by another worker.
+		return nil, err
+	}
+	return &job, tx.Commit()
+}
+
+// UpdateJobProgress stores the progress counters of a running job, and
+// its heartbeat.  Returns false if the job is no longer run by the worker,
+// because it has been requeued from it in the meantime.
+func (sdb SimBatchDB) UpdateJobProgress(job *model.Job) (bool, error) {
+	res, err := sdb.Db.NamedExec(`UPDATE JOB SET total = :total, succeeded = :succeeded, failed = :failed, heartbeat = :heartbeat
+                                 WHERE id = :id AND worker = :worker AND state = 'RUNNING'`, job)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+// FinishJob stores the state a worker left a job in, either a final state or
+// QUEUED to have it resumed.  Nothing is stored if the job has been requeued
+// from the worker in the meantime, because it seemed to have died.
+func (sdb SimBatchDB) FinishJob(job *model.Job) error {
+	_, err := sdb.Db.NamedExec(`UPDATE JOB SET state = :state, finished = :finished, error = :error,
+                                 total = :total, succeeded = :succeeded, failed = :failed, heartbeat = :heartbeat
+                                 WHERE id = :id AND worker = :worker AND state = 'RUNNING'`, job)
+	return err
+}
+
+// RequestJobCancel cancels a queued job right away, and asks the worker
+// running a running job to stop it.  Finished jobs are left as they are.
+// Returns the job as it is after the request, nil if there is no job with the ID.
+func (sdb SimBatchDB) RequestJobCancel(id int64, timestamp string) (*model.Job, error) {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE JOB SET state = ?, finished = ? WHERE id = ? AND state = ?",
+		model.JobCancelled, timestamp, id, model.JobQueued); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE JOB SET cancelRequested = 1 WHERE id = ? AND state = ?", id, model.JobRunning); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return sdb.GetJobByID(id)
+}
+
+// RequeueStaleJobs puts running jobs whose worker hasn't given a heartbeat
+// since the given time, e.g. because it was killed, back in the queue so
+// that they are resumed, or cancels them if that has been requested.
+// Returns the number of jobs requeued or cancelled.
+func (sdb SimBatchDB) RequeueStaleJobs(before string) (int64, error) {
+	res, err := sdb.Db.Exec(`UPDATE JOB SET worker = '',
+                                 state = CASE WHEN cancelRequested THEN ? ELSE ? END,
+                                 finished = CASE WHEN cancelRequested THEN heartbeat ELSE finished END
+                             WHERE state = ? AND heartbeat < ?`,
+		model.JobCancelled, model.JobQueued, model.JobRunning, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CreateJobLogEntry adds a line to the log of a job.
+func (sdb SimBatchDB) CreateJobLogEntry(entry *model.JobLogEntry) error {
+	res, err := sdb.Db.NamedExec(`INSERT INTO JOB_LOG (jobID, timestamp, level, iccid, message)
+                                   VALUES (:jobID, :timestamp, :level, :iccid, :message)`, entry)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting last inserted id failed '%s'", err)
+	}
+	entry.ID = id
+	return nil
+}
+
+// CreateJobCompletedIccid records that a job has completed the work on a
+// profile, so that the profile is skipped when the job is resumed.
+func (sdb SimBatchDB) CreateJobCompletedIccid(jobID int64, iccid string, timestamp string) error {
+	_, err := sdb.Db.Exec("INSERT OR REPLACE INTO JOB_COMPLETED_ICCID (jobID, iccid, timestamp) VALUES (?, ?, ?)", jobID, iccid, timestamp)
+	return err
+}
+
+// GetJobCompletedIccids returns the ICCIDs of the profiles a job has completed
+// the work on, in earlier attempts or the current one.
+func (sdb SimBatchDB) GetJobCompletedIccids(jobID int64) ([]string, error) {
+	//noinspection GoPreferNilSlice
+	result := []string{}
+	return result, sdb.Db.Select(&result, "SELECT iccid FROM JOB_COMPLETED_ICCID WHERE jobID = ? ORDER BY iccid", jobID)
+}
+
+// GetJobLog returns the log of a job, oldest first, after the entry with the
+// given ID.  An empty level means "all levels".
+func (sdb SimBatchDB) GetJobLog(jobID int64, level string, afterID int64) ([]model.JobLogEntry, error) {
+	query := "SELECT * FROM JOB_LOG WHERE jobID = ? AND id > ?"
+	args := []interface{}{jobID, afterID}
+	if level != "" {
+		query += " AND level = ?"
+		args = append(args, level)
+	}
+	query += " ORDER BY id"
+
+	//noinspection GoPreferNilSlice
+	result := []model.JobLogEntry{}
+	return result, sdb.Db.Select(&result, query, args...)
+}
+
+// SetProxyForTarget sets the proxy used to reach an upload target (host:port),
+// replacing any proxy previously set for it.
+func (sdb SimBatchDB) SetProxyForTarget(target string, proxyURL string) error {
+	_, err := sdb.Db.NamedExec(`INSERT OR REPLACE INTO PROXY_SETTING (target, proxyUrl) VALUES (:target, :proxyUrl)`,
+		map[string]interface{}{
+			"target":   target,
+			"proxyUrl": proxyURL,
+		})
+	return err
+}
+
+// GetProxyForTarget finds the proxy used to reach an upload target (host:port),
+// returns nil if no proxy is set for it.
+func (sdb SimBatchDB) GetProxyForTarget(target string) (*model.ProxySetting, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.ProxySetting{}
+	if err := sdb.Db.Select(&result, "SELECT * FROM PROXY_SETTING WHERE target = ?", target); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return &result[0], nil
+}
+
+// DeleteProxyForTarget makes an upload target be reached directly again.
+func (sdb SimBatchDB) DeleteProxyForTarget(target string) error {
+	_, err := sdb.Db.Exec("DELETE FROM PROXY_SETTING WHERE target = ?", target)
+	return err
+}
+
+// GetAllProxySettings returns the proxies of all upload targets, ordered by target.
+func (sdb SimBatchDB) GetAllProxySettings() ([]model.ProxySetting, error) {
+	//noinspection GoPreferNilSlice
+	result := []model.ProxySetting{}
+	return result, sdb.Db.Select(&result, "SELECT * FROM PROXY_SETTING ORDER BY target")
+}
+
+// RecordPrimeUpload records the time and outcome of uploading a batch to prime.
+func (sdb SimBatchDB) RecordPrimeUpload(batchID int64, timestamp string, status string) error {
+	_, err := sdb.Db.NamedExec("UPDATE BATCH SET primeUploaded=:primeUploaded, primeUploadStatus=:primeUploadStatus WHERE id = :batchID",
+		map[string]interface{}{
+			"batchID":           batchID,
+			"primeUploaded":     timestamp,
+			"primeUploadStatus": status,
+		})
+	return err
+}
+
+// MarkSimProfilesUploadedToPrime records that the profiles have been uploaded
+// to prime, all or none of them.
+func (sdb SimBatchDB) MarkSimProfilesUploadedToPrime(simIDs []int64, timestamp string) error {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, simID := range simIDs {
+		if _, err := tx.Exec("UPDATE SIM_PROFILE SET uploadedToPrime = ? WHERE id = ?", timestamp, simID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ClearPrimeUploadProgress forgets which profiles in a batch have been uploaded
+// to prime, so that they are all uploaded again.
+func (sdb SimBatchDB) ClearPrimeUploadProgress(batchID int64) error {
+	_, err := sdb.Db.Exec("UPDATE SIM_PROFILE SET uploadedToPrime = '' WHERE batchID = ?", batchID)
+	return err
+}
+
+// Prefixes of the secrets hashes.  Hashes made before the PINs and PUKs
+// were included are still recognised.
+const (
+	secretsHashPrefix       = "sha256v2:"
+	legacySecretsHashPrefix = "sha256:"
+)
+
+func hashFields(prefix string, fields ...string) string {
+	h := sha256.New()
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s%x", prefix, h.Sum(nil))
+}
+
+// SecretsHash computes a hash over the identity and secret key material,
+// PINs and PUKs included, of a sim profile.  It is kept after the secrets
+// themselves have been purged, so that later imports of the same profiles
+// can still be compared with what was originally loaded.
+func SecretsHash(entry model.SimEntry) string {
+	return hashFields(secretsHashPrefix,
+		entry.Iccid, entry.Imsi, strings.ToUpper(entry.Ki), strings.ToUpper(entry.Opc),
+		entry.Pin1, entry.Pin2, entry.Puk1, entry.Puk2)
+}
+
+// SecretsHashMatches tells if a hash kept for a profile was computed from
+// the given secrets.
+func SecretsHashMatches(hash string, entry model.SimEntry) bool {
+	if strings.HasPrefix(hash, legacySecretsHashPrefix) {
+		return hash == hashFields(legacySecretsHashPrefix, entry.Iccid, entry.Imsi, strings.ToUpper(entry.Ki), strings.ToUpper(entry.Opc))
+	}
+	return hash == SecretsHash(entry)
+}
+
+// PurgeSecretsForBatch wipes Ki, OPc, PINs and PUKs from all the profiles
+// in a batch, leaving a hash of the secrets in their place, and marks the batch
+// as purged.  Returns the number of profiles purged.
+func (sdb SimBatchDB) PurgeSecretsForBatch(batchID int64, timestamp string, operator string) (int, error) {
+	tx, err := sdb.Db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	entries := []model.SimEntry{}
+	if err := tx.Select(&entries, "SELECT * from SIM_PROFILE WHERE batchID = ?", batchID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		hash := entry.SecretsHash
+		if hash == "" {
+			hash = SecretsHash(entry)
+		}
+		_, err = tx.NamedExec("UPDATE SIM_PROFILE SET ki='', opc='', pin1='', pin2='', puk1='', puk2='', secretsHash=:secretsHash WHERE id = :simID",
+			map[string]interface{}{
+				"simID":       entry.ID,
+				"secretsHash": hash,
+			})
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	_, err = tx.NamedExec("UPDATE BATCH SET secretsPurged=:secretsPurged, secretsPurgedBy=:secretsPurgedBy WHERE id = :batchID",
+		map[string]interface{}{
+			"batchID":         batchID,
+			"secretsPurged":   timestamp,
+			"secretsPurgedBy": operator,
+		})
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return len(entries), tx.Commit()
+}
+
+// DropTables Drop all tables used by the store package.
+func (sdb *SimBatchDB) DropTables() error {
+	foo := `DROP  TABLE BATCH`
+	_, err := sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE SIM_PROFILE`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE BATCH_STATE_TRANSITION`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE ES2_JOURNAL`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE ES2_JOURNAL_ICCID`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE PENDING_ES2_OPERATION`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE PROXY_SETTING`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE PROFILE_STATE_DRIFT`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE JOB`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE JOB_LOG`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE JOB_COMPLETED_ICCID`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE IMPORT`
+	_, err = sdb.Db.Exec(foo)
+	if err != nil {
+		return err
+	}
+	foo = `DROP  TABLE SIM_PROFILE_FIELD_IMPORT`
 	_, err = sdb.Db.Exec(foo)
 	return err
 }
@@ -527,6 +1962,7 @@ func (sdb SimBatchDB) DeclareBatch(
 		FirstMsisdn:     firstMsisdn,
 		MsisdnIncrement: msisdnIncrement,
 		ProfileVendor:   profileVendor,
+		HssVendor:       hssVendor,
 	}
 
 	tx := sdb.Begin()
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// NewTempDatabase creates a database with all its tables in a temporary
+// directory, for use by tests.  The returned function closes the database
+// and removes the directory.
+func NewTempDatabase(t testing.TB) (*SimBatchDB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sbm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenFileSqliteDatabase(filepath.Join(dir, "sbm.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Db.Close()
+		os.RemoveAll(dir)
+	}
+	if err := db.GenerateTables(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return db, cleanup
+}
@@ -1,12 +1,23 @@
 package uploadtoprime
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/outboundproxy"
 	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
+const csvHeader = "ICCID, IMSI, MSISDN, PIN1, PIN2, PUK1, PUK2, PROFILE\n"
 
 // GeneratePostingCurlscript print on standard output a bash script
 // that can be used to upload the payload to an url.
@@ -19,19 +30,264 @@ func GeneratePostingCurlscript(url string, payload string) {
 }
 
 // GenerateCsvPayload generate the csv payload to be sent to prime
-func GenerateCsvPayload(db *store.SimBatchDB, batch model.Batch) string {
-	var sb strings.Builder
-	sb.WriteString("ICCID, IMSI, MSISDN, PIN1, PIN2, PUK1, PUK2, PROFILE\n")
+func GenerateCsvPayload(db *store.SimBatchDB, batch model.Batch) (string, error) {
+	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
+	if err != nil {
+		return "", err
+	}
+	return CsvPayload(batch, entries), nil
+}
+
+// CsvPayload generates the csv payload to be sent to prime for profiles
+// of a batch that have already been read.
+func CsvPayload(batch model.Batch, entries []model.SimEntry) string {
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, fmt.Sprintf("%s, %s, %s,,,,,%s\n", entry.Iccid, entry.Imsi, entry.Msisdn, batch.ProfileType))
+	}
+	return csvHeader + strings.Join(lines, "")
+}
+
+// chunkEntries splits profiles into chunks of at most chunkSize profiles.  A
+// chunkSize of zero or less gives a single chunk.
+func chunkEntries(entries []model.SimEntry, chunkSize int) [][]model.SimEntry {
+	if chunkSize <= 0 {
+		chunkSize = len(entries)
+	}
+
+	var chunks [][]model.SimEntry
+	for start := 0; start < len(entries); start += chunkSize {
+		end := start + chunkSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		chunks = append(chunks, entries[start:end])
+	}
+	return chunks
+}
+
+///
+///  Direct upload to prime
+///
+
+// UploadConfig holds the parameters used when uploading batches
+// directly to prime's sim-inventory.
+type UploadConfig struct {
+	// BearerToken, if not empty, is sent in an "Authorization: Bearer" header.
+	BearerToken string
+
+	// ClientCertFile and ClientKeyFile, if not empty, are used as the client
+	// certificate for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// CACertFile, if not empty, is a PEM file with the certificate(s) used to
+	// verify prime's server certificate.
+	CACertFile string
+
+	// MaxRetries is the number of times a failing request is retried.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry.  It is doubled for every retry.
+	RetryDelay time.Duration
+
+	// Timeout is the timeout of every single request.
+	Timeout time.Duration
+
+	// ChunkSize is the max number of profiles per request, zero means everything in one request.
+	ChunkSize int
+
+	// Proxy, if not nil, is the HTTP CONNECT or SOCKS5 proxy prime is reached through.
+	Proxy *url.URL
+}
+
+// ImportResponse is the response prime returns after having imported a sim batch.
+type ImportResponse struct {
+	ID         int64  `json:"id"`
+	Status     string `json:"status"`
+	StatusText string `json:"statusText"`
+	Importer   string `json:"importer"`
+	Size       int64  `json:"size"`
+	EndedAt    int64  `json:"endedAt"`
+}
+
+// UploadResult summarises the outcome of uploading a batch to prime.  The
+// chunks are those of this upload, the profiles already uploaded by an
+// earlier one are not in any of them.
+type UploadResult struct {
+	NoOfChunks              int
+	NoOfChunksUploaded      int
+	NoOfProfiles            int
+	NoOfProfilesInBatch     int
+	NoOfProfilesAlreadyDone int
+	Responses               []ImportResponse
+}
+
+// Outcome gives a short description of the result, suitable for
+// recording with the batch.
+func (r *UploadResult) Outcome() string {
+	uploaded := r.NoOfProfilesAlreadyDone + r.NoOfProfiles
+	switch {
+	case r.NoOfChunksUploaded == r.NoOfChunks:
+		return "SUCCESS"
+	case uploaded == 0:
+		return "FAILED"
+	default:
+		return fmt.Sprintf("PARTIAL %d/%d profiles", uploaded, r.NoOfProfilesInBatch)
+	}
+}
+
+// NewHTTPClient creates an HTTP client for talking to prime, set up for mutual
+// TLS if the configuration contains a client certificate.
+func NewHTTPClient(config UploadConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CACertFile != "" {
+		pem, err := ioutil.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", config.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
 
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	if config.Proxy != nil {
+		transport.DialContext = outboundproxy.NewDialer(config.Proxy, config.Timeout).DialContext
+	}
+
+	return &http.Client{
+		Timeout:   config.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+// UploadBatch PUTs the CSV payload for a batch to the url, in chunks if the
+// configuration says so.  The upload stops at the first chunk that can't be
+// uploaded, the returned result tells how far it got, it is nil if the
+// upload couldn't start at all.  The profiles in every
+// chunk prime has accepted are recorded as uploaded, and the profiles an
+// earlier upload got through are not uploaded again, so running it again
+// resumes an upload that stopped half way.
+func UploadBatch(client *http.Client, config UploadConfig, url string, db *store.SimBatchDB, batch model.Batch) (*UploadResult, error) {
 	entries, err := db.GetAllSimEntriesForBatch(batch.BatchID)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	var remaining []model.SimEntry
+	for _, entry := range entries {
+		if entry.UploadedToPrime == "" {
+			remaining = append(remaining, entry)
+		}
 	}
 
-	for  _ , entry:= range entries {
-		line := fmt.Sprintf("%s, %s, %s,,,,,%s\n", entry.Iccid, entry.Imsi, entry.Msisdn, batch.ProfileType)
-		sb.WriteString(line)
+	chunks := chunkEntries(remaining, config.ChunkSize)
+	result := &UploadResult{
+		NoOfChunks:              len(chunks),
+		NoOfProfilesInBatch:     len(entries),
+		NoOfProfilesAlreadyDone: len(entries) - len(remaining),
 	}
+	if result.NoOfProfilesAlreadyDone > 0 {
+		log.Printf("Skipping the %d profiles already uploaded", result.NoOfProfilesAlreadyDone)
+	}
+
+	for i, chunk := range chunks {
+		response, err := uploadChunk(client, config, url, CsvPayload(batch, chunk))
+		if err != nil {
+			return result, fmt.Errorf("upload of chunk %d of %d failed: %v", i+1, len(chunks), err)
+		}
 
-	return sb.String()
+		var simIDs []int64
+		for _, entry := range chunk {
+			simIDs = append(simIDs, entry.ID)
+		}
+		if err := db.MarkSimProfilesUploadedToPrime(simIDs, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return result, fmt.Errorf("chunk %d of %d was uploaded, but couldn't be recorded as uploaded: %v", i+1, len(chunks), err)
+		}
+		result.NoOfChunksUploaded++
+		result.NoOfProfiles += len(chunk)
+		result.Responses = append(result.Responses, *response)
+	}
+	return result, nil
+}
+
+func uploadChunk(client *http.Client, config UploadConfig, url string, payload string) (*ImportResponse, error) {
+	delay := config.RetryDelay
+	var err error
+	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying upload in %v (attempt %d of %d), last error: %v", delay, attempt, config.MaxRetries, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var response *ImportResponse
+		var retryable bool
+		response, retryable, err = putPayload(client, config, url, payload)
+		if err == nil {
+			return response, nil
+		}
+		if !retryable {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// putPayload does a single PUT request. The boolean return value tells if
+// it makes sense to retry the request if it failed.
+func putPayload(client *http.Client, config UploadConfig, url string, payload string) (*ImportResponse, bool, error) {
+	req, err := http.NewRequest("PUT", url, bytes.NewBufferString(payload))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+config.BearerToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, fmt.Errorf("prime responded with HTTP status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return parseImportResponse(body)
+}
+
+func parseImportResponse(body []byte) (*ImportResponse, bool, error) {
+	response := &ImportResponse{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return response, false, nil
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, false, fmt.Errorf("couldn't parse response from prime '%s': %v", strings.TrimSpace(string(body)), err)
+	}
+	if response.Status != "" && response.Status != "SUCCESS" {
+		return response, false, fmt.Errorf("prime reported import status '%s' %s", response.Status, response.StatusText)
+	}
+	return response, false, nil
 }
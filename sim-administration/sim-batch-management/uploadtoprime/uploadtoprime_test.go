@@ -0,0 +1,112 @@
+package uploadtoprime
+
+import (
+	"fmt"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/model"
+	"github.com/ostelco/ostelco-core/sim-administration/sim-batch-management/store"
+	"gotest.tools/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T, noOfProfiles int) (*store.SimBatchDB, *model.Batch, func()) {
+	db, cleanup := store.NewTempDatabase(t)
+
+	batch := &model.Batch{Name: "b1", ProfileVendor: "Durian", ProfileType: "OYA_M1_BF76", Quantity: noOfProfiles}
+	assert.NilError(t, db.CreateBatch(batch))
+	for i := 0; i < noOfProfiles; i++ {
+		entry := &model.SimEntry{
+			BatchID: batch.BatchID,
+			Iccid:   fmt.Sprintf("894700000000001214%d", i),
+			Imsi:    fmt.Sprintf("24201710001121%d", i),
+			Msisdn:  fmt.Sprintf("479000000%d", i),
+		}
+		assert.NilError(t, db.CreateSimEntry(entry))
+	}
+
+	return db, batch, cleanup
+}
+
+// primeServer records the payloads it is sent, and fails every request
+// after the first `accept` ones.
+type primeServer struct {
+	accept   int
+	payloads []string
+}
+
+func (p *primeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	p.payloads = append(p.payloads, string(body))
+	if len(p.payloads) > p.accept {
+		http.Error(w, "no more, thanks", http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, `{"id": %d, "status": "SUCCESS", "size": %d}`, len(p.payloads), strings.Count(string(body), "\n")-1)
+}
+
+func TestGenerateCsvPayload(t *testing.T) {
+	db, batch, cleanup := newTestStore(t, 2)
+	defer cleanup()
+
+	payload, err := GenerateCsvPayload(db, *batch)
+	assert.NilError(t, err)
+	assert.Equal(t, csvHeader+
+		"8947000000000012140, 242017100011210, 4790000000,,,,,OYA_M1_BF76\n"+
+		"8947000000000012141, 242017100011211, 4790000001,,,,,OYA_M1_BF76\n", payload)
+}
+
+func TestGenerateCsvPayloadReturnsStoreErrors(t *testing.T) {
+	db, batch, cleanup := newTestStore(t, 2)
+	defer cleanup()
+	db.Db.Close()
+
+	_, err := GenerateCsvPayload(db, *batch)
+	assert.Assert(t, err != nil)
+}
+
+func TestUploadResumesWhereItStopped(t *testing.T) {
+	db, batch, cleanup := newTestStore(t, 5)
+	defer cleanup()
+	prime := &primeServer{accept: 2}
+	server := httptest.NewServer(prime)
+	defer server.Close()
+	config := UploadConfig{ChunkSize: 2}
+
+	result, err := UploadBatch(server.Client(), config, server.URL, db, *batch)
+	assert.ErrorContains(t, err, "upload of chunk 3 of 3 failed")
+	assert.Equal(t, 2, result.NoOfChunksUploaded)
+	assert.Equal(t, 4, result.NoOfProfiles)
+	assert.Equal(t, "PARTIAL 4/5 profiles", result.Outcome())
+
+	// Only the profile that didn't make it is sent the second time.
+	prime.accept = 4
+	result, err = UploadBatch(server.Client(), config, server.URL, db, *batch)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, result.NoOfChunks)
+	assert.Equal(t, 1, result.NoOfProfiles)
+	assert.Equal(t, 4, result.NoOfProfilesAlreadyDone)
+	assert.Equal(t, "SUCCESS", result.Outcome())
+	assert.Equal(t, csvHeader+"8947000000000012144, 242017100011214, 4790000004,,,,,OYA_M1_BF76\n", prime.payloads[3])
+
+	// Once the progress is cleared, everything is uploaded again.
+	assert.NilError(t, db.ClearPrimeUploadProgress(batch.BatchID))
+	prime.accept = 10
+	result, err = UploadBatch(server.Client(), config, server.URL, db, *batch)
+	assert.NilError(t, err)
+	assert.Equal(t, 5, result.NoOfProfiles)
+	assert.Equal(t, 0, result.NoOfProfilesAlreadyDone)
+}
+
+func TestNothingUploadedIsAFailure(t *testing.T) {
+	db, batch, cleanup := newTestStore(t, 2)
+	defer cleanup()
+	server := httptest.NewServer(&primeServer{})
+	defer server.Close()
+
+	result, err := UploadBatch(server.Client(), UploadConfig{}, server.URL, db, *batch)
+	assert.ErrorContains(t, err, "HTTP status 400")
+	assert.Equal(t, "FAILED", result.Outcome())
+}